@@ -0,0 +1,246 @@
+// cold session archives of the file store
+package session
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveSuffix names the archive of a cold session root/<id>.tar.gz
+const archiveSuffix = ".tar.gz"
+
+// archivePath is the archive of the session
+func (f file) archivePath(ID string) (string, error) {
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return "", err
+	}
+	return directory + archiveSuffix, nil
+}
+
+// archivedID returns the session of an archive name
+func archivedID(name string) (string, bool) {
+	if !strings.HasSuffix(name, archiveSuffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, archiveSuffix), true
+}
+
+// archive replaces the directory of a cold session with a gzipped tarball
+// holding the same modification time, so GC still sees how idle it is. The
+// directory is moved aside first, a write racing with the archiving fails
+// instead of being lost
+func (f file) archive(ID string) (err error) {
+	f.locks.withLock(ID, func() {
+		var directory, path string
+		if directory, err = f.directoryPath(ID); err != nil {
+			return
+		}
+		if path, err = f.archivePath(ID); err != nil {
+			return
+		}
+		var info os.FileInfo
+		if info, err = os.Stat(directory); err != nil {
+			return
+		}
+		var staging string
+		if staging, err = ioutil.TempDir(f.root, ".archive"); err != nil {
+			return
+		}
+		defer os.RemoveAll(staging)
+		moved := filepath.Join(staging, ID)
+		if err = os.Rename(directory, moved); err != nil {
+			return
+		}
+		tmp := filepath.Join(staging, ID+archiveSuffix)
+		if err = writeArchive(tmp, moved); err != nil {
+			// put the session back rather than lose it
+			os.Rename(moved, directory)
+			return
+		}
+		if err = os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+			os.Rename(moved, directory)
+			return
+		}
+		size := fileSize(tmp)
+		if err = os.Rename(tmp, path); err != nil {
+			os.Rename(moved, directory)
+			return
+		}
+		if f.tracking() {
+			f.track(size - du(moved))
+		}
+	})
+	if isStorageFull(err) {
+		err = ErrStorageFull
+	}
+	return
+}
+
+func writeArchive(path, directory string) (err error) {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, permission)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	gz := gzip.NewWriter(fd)
+	tw := tar.NewWriter(gz)
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == directory {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		if header.Name, err = filepath.Rel(directory, path); err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(header.Name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// thaw extracts the archive of a session back to its directory, keeping
+// the modification time so reading an archived session does not refresh it.
+// A session with no archive is left alone
+func (f file) thaw(ID string) (err error) {
+	if f.ArchiveAfter <= 0 || ID == "" {
+		return nil
+	}
+	f.locks.withLock(ID, func() {
+		var directory, path string
+		if directory, err = f.directoryPath(ID); err != nil {
+			return
+		}
+		if path, err = f.archivePath(ID); err != nil {
+			return
+		}
+		var info os.FileInfo
+		if info, err = os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return
+		}
+		var staging string
+		if staging, err = ioutil.TempDir(f.root, ".thaw"); err != nil {
+			return
+		}
+		defer os.RemoveAll(staging)
+		if err = readArchive(path, staging); err != nil {
+			return
+		}
+		if err = os.Chmod(staging, permission); err != nil {
+			return
+		}
+		if err = os.Chtimes(staging, info.ModTime(), info.ModTime()); err != nil {
+			return
+		}
+		if err = os.Rename(staging, directory); err != nil {
+			return
+		}
+		if err = os.Remove(path); err == nil && f.tracking() {
+			f.track(du(directory) - info.Size())
+		}
+	})
+	if isStorageFull(err) {
+		err = ErrStorageFull
+	}
+	return
+}
+
+func readArchive(path, directory string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(directory, filepath.FromSlash(header.Name))
+		if !within(directory, target) {
+			return ErrInvalidKey
+		}
+		if header.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(target, permission); err != nil {
+				return err
+			}
+			continue
+		}
+		dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, permission)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, tr)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		// keeps the sticky bit of the keys with a TTL
+		if err := os.Chmod(target, header.FileInfo().Mode()&(os.ModePerm|os.ModeSticky)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+// archived reports whether the session is archived
+func (f file) archived(ID string) bool {
+	path, err := f.archivePath(ID)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// cold reports whether GC should archive the entry
+func (f file) cold(info os.FileInfo, t time.Time) bool {
+	return f.ArchiveAfter > 0 && info.IsDir() && !strings.HasPrefix(info.Name(), ".") &&
+		info.ModTime().Add(f.ArchiveAfter).Before(t)
+}
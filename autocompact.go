@@ -0,0 +1,157 @@
+// background compaction of the single file layout
+package session
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// sessionChurn counts the rewrites of each session of the single file
+// layout since its last compaction
+type sessionChurn struct {
+	writes map[string]int
+	lock   sync.Mutex
+}
+
+func newSessionChurn() *sessionChurn {
+	return &sessionChurn{writes: make(map[string]int)}
+}
+
+func (c *sessionChurn) add(ID string) {
+	c.lock.Lock()
+	c.writes[ID]++
+	c.lock.Unlock()
+}
+
+func (c *sessionChurn) reset(ID string) {
+	c.lock.Lock()
+	delete(c.writes, ID)
+	c.lock.Unlock()
+}
+
+func (c *sessionChurn) clear() {
+	c.lock.Lock()
+	c.writes = make(map[string]int)
+	c.lock.Unlock()
+}
+
+// dirty returns the sessions rewritten at least threshold times
+func (c *sessionChurn) dirty(threshold int) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var IDs []string
+	for ID, writes := range c.writes {
+		if writes >= threshold {
+			IDs = append(IDs, ID)
+		}
+	}
+	return IDs
+}
+
+// CompactionStats counts the work of a compactor, see NewCompactor
+type CompactionStats struct {
+	// Runs is the number of passes
+	Runs int64
+	// Sessions is the number of sessions compacted
+	Sessions int64
+	// BytesReclaimed is the size of the compacted sessions before minus after
+	BytesReclaimed int64
+	// Errors is the number of sessions that failed to compact
+	Errors int64
+}
+
+// compactor compacts the dirty sessions of a single file store
+type compactor struct {
+	store     file
+	threshold int
+
+	stats CompactionStats
+	lock  sync.Mutex
+
+	done   chan struct{}
+	closed sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewCompactor compacts, every interval, the sessions of store rewritten
+// at least threshold times since their last compaction, see Compact, so
+// sessions with heavy churn are kept to their minimal form without any
+// cost on the writes. Each session is compacted under its lock, the writes
+// to it wait meanwhile. A session expired meanwhile is dropped. Only the
+// single file layout counts rewrites, see NewSingleFileStore. An interval
+// <= 0 compacts every minute. Close stops the compactor
+func NewCompactor(store file, interval time.Duration, threshold int) *compactor {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	c := &compactor{store: store, threshold: threshold, done: make(chan struct{})}
+	c.wg.Add(1)
+	go c.loop(interval)
+	return c
+}
+
+func (c *compactor) loop(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.run(time.Now())
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// run compacts the dirty sessions once
+func (c *compactor) run(now time.Time) {
+	var stats CompactionStats
+	for _, ID := range c.store.churn.dirty(c.threshold) {
+		if !c.store.Exists(ID) {
+			c.store.churn.reset(ID)
+			continue
+		}
+		directory, err := c.store.directoryPath(ID)
+		if err != nil {
+			c.store.churn.reset(ID)
+			continue
+		}
+		before := du(directory)
+		if err := c.store.compactSession(ID, now); err != nil {
+			log.Println(err)
+			stats.Errors++
+			continue
+		}
+		// also forgets the sessions Compact leaves as they are
+		c.store.churn.reset(ID)
+		stats.Sessions++
+		stats.BytesReclaimed += before - du(directory)
+	}
+	c.lock.Lock()
+	c.stats.Runs++
+	c.stats.Sessions += stats.Sessions
+	c.stats.BytesReclaimed += stats.BytesReclaimed
+	c.stats.Errors += stats.Errors
+	c.lock.Unlock()
+}
+
+// Stats returns the work done so far
+func (c *compactor) Stats() CompactionStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Close stops the compactor, waiting for a pass in progress
+func (c *compactor) Close() error {
+	c.closed.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+	})
+	return nil
+}
@@ -0,0 +1,51 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Compactor(t *testing.T) {
+	defer os.RemoveAll("churn")
+	f := NewSingleFileStore(nil, "churn", "/")
+	// an interval <= 0 is defaulted, not handed to a ticker
+	NewCompactor(f, 0, 3).Close()
+	c := NewCompactor(f, time.Hour, 3)
+	defer c.Close()
+	busy, quiet := f.GenerateID(), f.GenerateID()
+	for i := 0; i < 3; i++ {
+		f.Set(busy, "n", i)
+	}
+	f.Set(quiet, "n", 0)
+	// a temporary file left behind by a crash
+	leftover := filepath.Join("churn", busy, sessionFile+".tmp")
+	ioutil.WriteFile(leftover, make([]byte, 100), permission)
+
+	c.run(time.Now())
+	if stats := c.Stats(); stats.Runs != 1 || stats.Sessions != 1 || stats.BytesReclaimed != 100 || stats.Errors != 0 {
+		t.Fatalf("only the busy session should be compacted, got %+v", stats)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatal("the compaction should remove the temporary file")
+	}
+	if f.Get(busy, "n") != 2 || f.Get(quiet, "n") != 0 {
+		t.Fatal("the compaction should keep the values")
+	}
+	c.run(time.Now())
+	if stats := c.Stats(); stats.Sessions != 1 {
+		t.Fatalf("a compacted session should not be compacted again before it churns, got %+v", stats)
+	}
+
+	f.Set(quiet, "n", 1)
+	f.Set(quiet, "n", 2)
+	f.Expire(quiet)
+	c.run(time.Now())
+	if stats := c.Stats(); stats.Sessions != 1 || len(f.churn.dirty(1)) != 0 {
+		t.Fatalf("an expired session should be forgotten, got %+v", stats)
+	}
+	c.Close()
+	c.Close()
+}
@@ -0,0 +1,108 @@
+package session
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const tagName = "session"
+
+// sessionFields walks the exported fields of a struct value and reports the
+// session key of each one, a `session:"name"` tag overrides the field name and
+// `session:"-"` skips the field
+func sessionFields(v reflect.Value, f func(key string, field reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		key := sf.Tag.Get(tagName)
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = sf.Name
+		}
+		f(key, v.Field(i))
+	}
+}
+
+func structValue(i interface{}, method string) (reflect.Value, error) {
+	v := reflect.ValueOf(i)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return v, fmt.Errorf("session: %s needs a struct or pointer to struct, got %T", method, i)
+	}
+	return v, nil
+}
+
+// Bind populates the struct pointed by dst from the session keys
+// keys missing in the session leave the field untouched
+func (s Session) Bind(ID string, dst interface{}) (err error) {
+	if reflect.ValueOf(dst).Kind() != reflect.Ptr {
+		return fmt.Errorf("session: Bind needs a pointer to struct, got %T", dst)
+	}
+	v, err := structValue(dst, "Bind")
+	if err != nil {
+		return err
+	}
+	sessionFields(v, func(key string, field reflect.Value) {
+		if err != nil {
+			return
+		}
+		val := s.Get(ID, key)
+		if val == nil {
+			return
+		}
+		rv := reflect.ValueOf(val)
+		if !rv.Type().AssignableTo(field.Type()) {
+			err = fmt.Errorf("session: key %q holds %T, can not bind it to field of type %v", key, val, field.Type())
+			return
+		}
+		field.Set(rv)
+	})
+	return
+}
+
+// Save writes every field of the struct src as a session key
+func (s Session) Save(ID string, src interface{}) (err error) {
+	v, err := structValue(src, "Save")
+	if err != nil {
+		return err
+	}
+	sessionFields(v, func(key string, field reflect.Value) {
+		if err != nil {
+			return
+		}
+		err = s.Set(ID, key, field.Interface())
+	})
+	return
+}
+
+// GetInto stores the value of key into the variable pointed by dst
+// it returns ErrKeyNotFound when the key is absent and an error when the value
+// does not fit dst, instead of panicking like a type assertion would
+func (s Session) GetInto(ID string, key string, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("session: GetInto needs a non nil pointer, got %T", dst)
+	}
+	val, err := s.getWithError(ID, key)
+	if err != nil {
+		return err
+	}
+	elem := v.Elem()
+	if val == nil {
+		elem.Set(reflect.Zero(elem.Type()))
+		return nil
+	}
+	rv := reflect.ValueOf(val)
+	if !rv.Type().AssignableTo(elem.Type()) {
+		return fmt.Errorf("session: key %q holds %T, can not store it into %T", key, val, dst)
+	}
+	elem.Set(rv)
+	return nil
+}
@@ -0,0 +1,65 @@
+package session
+
+import "testing"
+
+type bindProfile struct {
+	Name     string
+	Age      int    `session:"age"`
+	Password string `session:"-"`
+	internal string
+}
+
+func Test_Bind(t *testing.T) {
+	s := memorySession()
+	sid := s.GenerateID()
+
+	src := bindProfile{"gopher", 5, "secret", "internal"}
+	if err := s.Save(sid, src); err != nil {
+		t.Fatal(err)
+	}
+	if s.Get(sid, "age").(int) != 5 {
+		t.Fatal("age should be saved under its tag")
+	}
+	if s.Get(sid, "Password") != nil {
+		t.Fatal("skipped field should not be saved")
+	}
+
+	var dst bindProfile
+	if err := s.Bind(sid, &dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Name != "gopher" || dst.Age != 5 || dst.Password != "" || dst.internal != "" {
+		t.Fatalf("unexpected bound value %+v", dst)
+	}
+
+	s.Set(sid, "age", "five")
+	if err := s.Bind(sid, &dst); err == nil {
+		t.Fatal("binding a mismatched type should fail")
+	}
+	if err := s.Bind(sid, dst); err == nil {
+		t.Fatal("binding into a non pointer should fail")
+	}
+}
+
+func Test_GetInto(t *testing.T) {
+	s := fileSession()
+	sid := s.GenerateID()
+	s.Set(sid, "profile", bindProfile{Name: "gopher"})
+
+	var p bindProfile
+	if err := s.GetInto(sid, "profile", &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "gopher" {
+		t.Fatalf("unexpected value %+v", p)
+	}
+
+	var n int
+	if err := s.GetInto(sid, "profile", &n); err == nil {
+		t.Fatal("mismatched type should fail")
+	}
+	if err := s.GetInto(sid, "absent", &n); err != ErrKeyNotFound {
+		t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+	}
+	s.Flush()
+}
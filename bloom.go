@@ -0,0 +1,99 @@
+package session
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// bloom is a counting bloom filter, used to answer "definitely absent"
+// without touching the backing storage
+//
+// sized for about 1% false positives at capacity, counters allow removal
+//
+type bloom struct {
+	counters []uint8
+	k        uint32
+
+	lock sync.RWMutex
+}
+
+const (
+	bloomBitsPerItem = 10
+	bloomHashes      = 7
+)
+
+func newBloom(capacity int) *bloom {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &bloom{
+		counters: make([]uint8, capacity*bloomBitsPerItem),
+		k:        bloomHashes,
+	}
+}
+
+// indexes derived with double hashing
+//
+func (b *bloom) indexes(s string) []uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	n := uint32(len(b.counters))
+	idx := make([]uint32, b.k)
+	for i := uint32(0); i < b.k; i++ {
+		idx[i] = (h1 + i*h2) % n
+	}
+	return idx
+}
+
+// add s to the filter
+//
+func (b *bloom) add(s string) {
+	idx := b.indexes(s)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, i := range idx {
+		if b.counters[i] < 255 {
+			b.counters[i]++
+		}
+	}
+}
+
+// remove s from the filter, s must have been added before
+//
+func (b *bloom) remove(s string) {
+	idx := b.indexes(s)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, i := range idx {
+		// saturated counters stay, they can not tell how many items share them
+		if b.counters[i] > 0 && b.counters[i] < 255 {
+			b.counters[i]--
+		}
+	}
+}
+
+// mayContain returns false only if s is definitely not in the filter
+//
+func (b *bloom) mayContain(s string) bool {
+	idx := b.indexes(s)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, i := range idx {
+		if b.counters[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reset empties the filter
+//
+func (b *bloom) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i := range b.counters {
+		b.counters[i] = 0
+	}
+}
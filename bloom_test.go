@@ -0,0 +1,84 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func Test_Bloom(t *testing.T) {
+	b := newBloom(100)
+	for i := 0; i < 100; i++ {
+		b.add(fmt.Sprintf("sessionid%d", i))
+	}
+	for i := 0; i < 100; i++ {
+		if !b.mayContain(fmt.Sprintf("sessionid%d", i)) {
+			t.Fatal("added item should always be found")
+		}
+	}
+
+	falsePositives := 0
+	for i := 100; i < 10100; i++ {
+		if b.mayContain(fmt.Sprintf("sessionid%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Fatalf("too many false positives: %d in 10000", falsePositives)
+	}
+
+	b.remove("sessionid1")
+	if b.mayContain("sessionid1") && !b.mayContain("sessionid2") {
+		t.Fatal("removal should not affect other items")
+	}
+	b.reset()
+	if b.mayContain("sessionid2") {
+		t.Fatal("reset filter should be empty")
+	}
+}
+
+func Test_FileBloomFilter(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	existing := f.GenerateID()
+
+	f = f.WithBloomFilter(100)
+	if !f.Exists(existing) {
+		t.Fatal("filter should be rebuilt from the existing sessions")
+	}
+	sid := f.GenerateID()
+	f.Set(sid, "key", "value")
+	if f.Get(sid, "key").(string) != "value" {
+		t.Fatal("should be value")
+	}
+	if f.Exists("absent") {
+		t.Fatal("absent session should not exist")
+	}
+	f.Expire(sid)
+	if f.Exists(sid) || f.Get(sid, "key") != nil {
+		t.Fatal("expired session should not exist")
+	}
+	f.Flush()
+}
+
+func Test_FileBloomConcurrentExpire(t *testing.T) {
+	defer os.RemoveAll("bloomexpire")
+	// a tiny filter so the IDs share counters
+	f := NewFileStore(nil, "bloomexpire", "/").WithBloomFilter(1)
+	kept := f.GenerateID()
+	for i := 0; i < 50; i++ {
+		sid := f.GenerateID()
+		var wg sync.WaitGroup
+		for j := 0; j < 16; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f.Expire(sid)
+			}()
+		}
+		wg.Wait()
+		if !f.Exists(kept) {
+			t.Fatal("concurrent Expires of a session should forget it once")
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// circuit breaker store
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+var _ SessionStore = new(breaker)
+
+const (
+	defaultFailureThreshold = 5
+	defaultCooldown         = 10 * time.Second
+)
+
+// BreakerSettings tunes a circuit breaker, zero values get the defaults
+type BreakerSettings struct {
+	// FailureThreshold is the number of consecutive failures opening the
+	// breaker, defaults to 5
+	FailureThreshold int
+
+	// Cooldown is how long the breaker stays open before letting a probe
+	// through, defaults to 10 seconds
+	Cooldown time.Duration
+
+	// IsFailure tells the errors telling the store is unhealthy, by default
+	// every error but those about the request itself: ErrSessionNotFound,
+	// ErrKeyNotFound, ErrKeyExists, ErrTooManyKeys, ErrIDTooLong,
+	// ErrInvalidKey, ErrKeyNotAllowed, ErrNotList, ErrNotIndexed,
+	// ErrVersionConflict, ErrNegativeExtend and ErrReadOnly
+	IsFailure func(err error) bool
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker fails fast while inner keeps failing
+type breaker struct {
+	inner    SessionStore
+	settings BreakerSettings
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// probing is set while the single call of the half open state runs
+	probing bool
+	lock    sync.Mutex
+}
+
+// NewCircuitBreakerStore wraps inner so that after FailureThreshold
+// consecutive failures every operation fails with ErrCircuitOpen, without
+// calling inner, for Cooldown. The breaker then lets one call through: its
+// success closes the breaker, its failure opens it for another Cooldown.
+// While open, Get returns nil, GenerateID an empty ID and GC does nothing
+func NewCircuitBreakerStore(inner SessionStore, settings BreakerSettings) *breaker {
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = defaultFailureThreshold
+	}
+	if settings.Cooldown <= 0 {
+		settings.Cooldown = defaultCooldown
+	}
+	if settings.IsFailure == nil {
+		settings.IsFailure = isStoreFailure
+	}
+	return &breaker{inner: inner, settings: settings}
+}
+
+func isStoreFailure(err error) bool {
+	switch err {
+	case nil, ErrSessionNotFound, ErrKeyNotFound, ErrKeyExists, ErrTooManyKeys, ErrIDTooLong, ErrInvalidKey,
+		ErrKeyNotAllowed, ErrNotList, ErrNotIndexed, ErrVersionConflict, ErrNegativeExtend, ErrReadOnly:
+		return false
+	}
+	return true
+}
+
+// allow tells whether a call may go to inner
+func (b *breaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.settings.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+	case breakerClosed:
+		return nil
+	}
+	if b.probing {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// done records the outcome of a call allowed through, a call that panicked
+// counts as failed
+func (b *breaker) done(failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.state, b.openedAt = breakerOpen, time.Now()
+		} else {
+			b.state, b.failures = breakerClosed, 0
+		}
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	if b.failures++; b.failures >= b.settings.FailureThreshold {
+		b.state, b.openedAt = breakerOpen, time.Now()
+	}
+}
+
+func (b *breaker) call(f func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	failed := true
+	defer func() {
+		b.done(failed)
+	}()
+	err := f()
+	failed = b.settings.IsFailure(err)
+	return err
+}
+
+func (b *breaker) GenerateID() (ID string) {
+	b.call(func() error {
+		if ID = b.inner.GenerateID(); ID == "" {
+			return ErrStorageFull
+		}
+		return nil
+	})
+	return
+}
+
+func (b *breaker) Set(ID string, key string, val interface{}) error {
+	return b.call(func() error {
+		return b.inner.Set(ID, key, val)
+	})
+}
+
+func (b *breaker) Get(ID string, key string) interface{} {
+	val, _ := b.GetWithError(ID, key)
+	return val
+}
+
+func (b *breaker) GetWithError(ID string, key string) (val interface{}, err error) {
+	err = b.call(func() (err error) {
+		val, err = getWithError(b.inner, ID, key)
+		return
+	})
+	return
+}
+
+func (b *breaker) Delete(ID string, key string) error {
+	return b.call(func() error {
+		return b.inner.Delete(ID, key)
+	})
+}
+
+func (b *breaker) Update(ID string) error {
+	return b.call(func() error {
+		return b.inner.Update(ID)
+	})
+}
+
+func (b *breaker) Expire(ID string) error {
+	return b.call(func() error {
+		return b.inner.Expire(ID)
+	})
+}
+
+func (b *breaker) Flush() error {
+	return b.call(func() error {
+		return b.inner.Flush()
+	})
+}
+
+func (b *breaker) GC(lifeTime time.Duration, timeNow time.Time) {
+	b.call(func() error {
+		b.inner.GC(lifeTime, timeNow)
+		return nil
+	})
+}
@@ -0,0 +1,108 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+// faulty fails every Set while broken
+type faulty struct {
+	*memory
+	broken bool
+	calls  int
+}
+
+func (f *faulty) Set(ID string, key string, val interface{}) error {
+	f.calls++
+	if f.broken {
+		return errOutage
+	}
+	return f.memory.Set(ID, key, val)
+}
+
+func Test_CircuitBreakerStore(t *testing.T) {
+	inner := &faulty{memory: NewMemoryStore(nil)}
+	b := NewCircuitBreakerStore(inner, BreakerSettings{FailureThreshold: 2, Cooldown: 20 * time.Millisecond})
+	sid := b.GenerateID()
+
+	inner.broken = true
+	for i := 0; i < 2; i++ {
+		if err := b.Set(sid, "key", "val"); err != errOutage {
+			t.Fatalf("error should be the store error but get %v", err)
+		}
+	}
+	if err := b.Set(sid, "key", "val"); err != ErrCircuitOpen || inner.calls != 2 {
+		t.Fatalf("the breaker should be open, got %v after %d calls", err, inner.calls)
+	}
+	if _, err := b.GetWithError(sid, "key"); err != ErrCircuitOpen {
+		t.Fatalf("every operation should fail fast, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.Set(sid, "key", "val"); err != errOutage || inner.calls != 3 {
+		t.Fatalf("a probe should go through once half open, got %v", err)
+	}
+	if err := b.Set(sid, "key", "val"); err != ErrCircuitOpen {
+		t.Fatalf("a failed probe should open the breaker again, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	inner.broken = false
+	if err := b.Set(sid, "key", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetWithError(sid, "absent"); err != ErrKeyNotFound {
+		t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+	}
+	if b.Get(sid, "key").(string) != "val" {
+		t.Fatal("a successful probe should close the breaker")
+	}
+
+	for _, err := range []error{ErrKeyNotAllowed, ErrReadOnly, ErrNotList, ErrVersionConflict, ErrTooManyKeys} {
+		if isStoreFailure(err) {
+			t.Fatalf("%v is about the request, not the store", err)
+		}
+	}
+}
+
+// panicky panics on every Set while broken
+type panicky struct {
+	*faulty
+	panics bool
+}
+
+func (p *panicky) Set(ID string, key string, val interface{}) error {
+	if p.panics {
+		panic("outage")
+	}
+	return p.faulty.Set(ID, key, val)
+}
+
+func Test_CircuitBreakerProbePanic(t *testing.T) {
+	inner := &panicky{faulty: &faulty{memory: NewMemoryStore(nil)}}
+	b := NewCircuitBreakerStore(inner, BreakerSettings{FailureThreshold: 1, Cooldown: 20 * time.Millisecond})
+	sid := b.GenerateID()
+	set := func() (err error) {
+		defer func() {
+			if recover() != nil {
+				err = errOutage
+			}
+		}()
+		return b.Set(sid, "key", "val")
+	}
+
+	inner.broken = true
+	if err := set(); err != errOutage {
+		t.Fatalf("error should be the store error but get %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	inner.panics = true
+	if err := set(); err != errOutage {
+		t.Fatalf("a probe should go through once half open, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	inner.broken, inner.panics = false, false
+	if err := set(); err != nil {
+		t.Fatalf("a panicking probe should not keep the breaker open, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// read cache of the file store
+package session
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// readCache keeps the values recently read from the file store, evicting
+// the least recently read once over capacity. A nil cache caches nothing
+type readCache struct {
+	// gen changes on every invalidation, a read started before it does
+	// not fill the cache. First in the struct to be 64-bit aligned
+	gen int64
+
+	capacity int
+	entries  *lru
+
+	// serializes fills and invalidations
+	lock sync.Mutex
+}
+
+type cacheKey struct {
+	ID, key string
+}
+
+type cachedValue struct {
+	ID   string
+	val  interface{}
+	meta map[string]string
+}
+
+func newReadCache(capacity int) *readCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &readCache{capacity: capacity, entries: newLRU()}
+}
+
+// generation is taken before reading the value to fill the cache with
+func (c *readCache) generation() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.gen)
+}
+
+func (c *readCache) get(ID, key string) (val interface{}, meta map[string]string, ok bool) {
+	if c == nil {
+		return
+	}
+	v, ok := c.entries.get(cacheKey{ID, key})
+	if !ok {
+		return
+	}
+	cached := v.(cachedValue)
+	return cached.val, cached.meta, true
+}
+
+// put fills the cache with a value read since generation gen
+func (c *readCache) put(gen int64, ID, key string, val interface{}, meta map[string]string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if atomic.LoadInt64(&c.gen) != gen {
+		return
+	}
+	c.entries.put(cacheKey{ID, key}, cachedValue{ID, val, meta})
+	for {
+		var n int
+		c.entries.withLock(func() { n = c.entries.length() })
+		if n <= c.capacity {
+			return
+		}
+		if k, ok := c.entries.front(); ok {
+			c.entries.remove(k)
+		}
+	}
+}
+
+// invalidate drops a key, it must be called once the key is written
+func (c *readCache) invalidate(ID string, keys ...string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	atomic.AddInt64(&c.gen, 1)
+	for _, key := range keys {
+		c.entries.remove(cacheKey{ID, key})
+	}
+}
+
+// invalidateSession drops every key of a session
+func (c *readCache) invalidateSession(ID string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	atomic.AddInt64(&c.gen, 1)
+	c.entries.remove(c.entries.findExpiredItems(func(v interface{}) bool {
+		return v.(cachedValue).ID == ID
+	})...)
+}
+
+func (c *readCache) reset() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	atomic.AddInt64(&c.gen, 1)
+	c.entries.withLock(func() {
+		c.entries.l.Init()
+		c.entries.cache = make(map[interface{}]*list.Element)
+	})
+}
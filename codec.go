@@ -0,0 +1,373 @@
+package session
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Codec turns session values into bytes and back
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte) (interface{}, error)
+}
+
+// IDCodec is a Codec that also takes the session of the value into
+// account, the codec store passes the ID to it, see NewEncryptingCodec
+type IDCodec interface {
+	Codec
+	MarshalID(ID string, v interface{}) ([]byte, error)
+	UnmarshalID(ID string, b []byte) (interface{}, error)
+}
+
+// GobCodec is the encoding the file store uses
+var GobCodec Codec = gobCodec{}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("session: gob marshal: %v", r)
+		}
+	}()
+	return marshal(v), nil
+}
+
+func (gobCodec) Unmarshal(b []byte) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("session: gob unmarshal: %v", r)
+		}
+	}()
+	return unmarshal(b), nil
+}
+
+// Tags of the scalar codec wire format
+const (
+	scalarGob     byte = 0x00
+	scalarBool    byte = 0x01
+	scalarInt64   byte = 0x02
+	scalarFloat64 byte = 0x03
+	scalarString  byte = 0x04
+)
+
+// ScalarCodec encodes bool, int64, float64 and string values in a format
+// other runtimes can parse, other types fall back to gob. A value is a one
+// byte tag followed by its payload:
+//
+//	0x00 gob    the GobCodec encoding, opaque outside Go
+//	0x01 bool   one byte, 0x00 false, 0x01 true
+//	0x02 int64  8 bytes, big endian two's complement
+//	0x03 float64 8 bytes, big endian IEEE 754 binary64
+//	0x04 string the UTF-8 bytes, up to the end of the value
+//
+// Only these exact types are tagged, an int or a named string type is gob
+// encoded
+var ScalarCodec Codec = scalarCodec{}
+
+type scalarCodec struct{}
+
+func (scalarCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return []byte{scalarBool, 1}, nil
+		}
+		return []byte{scalarBool, 0}, nil
+	case int64:
+		b := make([]byte, 9)
+		b[0] = scalarInt64
+		binary.BigEndian.PutUint64(b[1:], uint64(v))
+		return b, nil
+	case float64:
+		b := make([]byte, 9)
+		b[0] = scalarFloat64
+		binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+		return b, nil
+	case string:
+		return append([]byte{scalarString}, v...), nil
+	}
+	b, err := GobCodec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{scalarGob}, b...), nil
+}
+
+func (scalarCodec) Unmarshal(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("session: empty scalar value")
+	}
+	tag, payload := b[0], b[1:]
+	switch tag {
+	case scalarGob:
+		return GobCodec.Unmarshal(payload)
+	case scalarBool:
+		if len(payload) != 1 || payload[0] > 1 {
+			return nil, fmt.Errorf("session: malformed scalar bool")
+		}
+		return payload[0] == 1, nil
+	case scalarInt64, scalarFloat64:
+		if len(payload) != 8 {
+			return nil, fmt.Errorf("session: malformed scalar of tag %#x", tag)
+		}
+		n := binary.BigEndian.Uint64(payload)
+		if tag == scalarInt64 {
+			return int64(n), nil
+		}
+		return math.Float64frombits(n), nil
+	case scalarString:
+		return string(payload), nil
+	}
+	return nil, fmt.Errorf("session: unknown scalar tag %#x", tag)
+}
+
+// jsonCodec encodes values as JSON, tagging values of registered types with
+// their name so they decode back to the same Go type. Other values decode to
+// what encoding/json gives for interface{}: float64, string, bool,
+// []interface{} and map[string]interface{}. Only the top level value is
+// tagged, a time.Time nested in a map comes back as a string
+type jsonCodec struct {
+	names map[reflect.Type]string
+	types map[string]reflect.Type
+
+	lock sync.RWMutex
+}
+
+type jsonEnvelope struct {
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// NewJSONCodec returns a JSON codec with time.Time, []byte and json.Number
+// registered
+func NewJSONCodec() *jsonCodec {
+	c := &jsonCodec{names: make(map[reflect.Type]string), types: make(map[string]reflect.Type)}
+	c.Register("time.Time", time.Time{})
+	c.Register("[]byte", []byte(nil))
+	c.Register("json.Number", json.Number(""))
+	return c
+}
+
+// Register makes values of the type of example round-trip with their Go type
+func (c *jsonCodec) Register(name string, example interface{}) {
+	t := reflect.TypeOf(example)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.names[t] = name
+	c.types[name] = t
+}
+
+func (c *jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.RLock()
+	name := c.names[reflect.TypeOf(v)]
+	c.lock.RUnlock()
+	return json.Marshal(jsonEnvelope{name, value})
+}
+
+func (c *jsonCodec) Unmarshal(b []byte) (interface{}, error) {
+	var e jsonEnvelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	if e.Type == "" {
+		var v interface{}
+		err := json.Unmarshal(e.Value, &v)
+		return v, err
+	}
+	c.lock.RLock()
+	t, ok := c.types[e.Type]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("session: json type %q is not registered", e.Type)
+	}
+	p := reflect.New(t)
+	if err := json.Unmarshal(e.Value, p.Interface()); err != nil {
+		return nil, err
+	}
+	return p.Elem().Interface(), nil
+}
+
+var _ SessionStore = new(codecStore)
+
+// codecStore encodes values with a codec before they reach the inner store,
+// which only ever sees []byte values
+type codecStore struct {
+	inner SessionStore
+	codec Codec
+}
+
+// NewCodecStore wraps inner so values are stored encoded by codec, an
+// IDCodec is given the session ID too
+func NewCodecStore(inner SessionStore, codec Codec) *codecStore {
+	return &codecStore{inner, codec}
+}
+
+func (c *codecStore) marshal(ID string, val interface{}) ([]byte, error) {
+	return marshalFor(c.codec, ID, val)
+}
+
+func (c *codecStore) unmarshal(ID string, b []byte) (interface{}, error) {
+	return unmarshalFor(c.codec, ID, b)
+}
+
+// marshalFor encodes a value of the session, passing the ID to an IDCodec
+func marshalFor(codec Codec, ID string, val interface{}) ([]byte, error) {
+	if codec, ok := codec.(IDCodec); ok {
+		return codec.MarshalID(ID, val)
+	}
+	return codec.Marshal(val)
+}
+
+// unmarshalFor decodes a value of the session, passing the ID to an IDCodec
+func unmarshalFor(codec Codec, ID string, b []byte) (interface{}, error) {
+	if codec, ok := codec.(IDCodec); ok {
+		return codec.UnmarshalID(ID, b)
+	}
+	return codec.Unmarshal(b)
+}
+
+func (c *codecStore) GenerateID() string {
+	return c.inner.GenerateID()
+}
+
+func (c *codecStore) Set(ID string, key string, val interface{}) error {
+	b, err := c.marshal(ID, val)
+	if err != nil {
+		return err
+	}
+	return c.inner.Set(ID, key, b)
+}
+
+// Get returns nil for absent keys and for values the codec can not decode,
+// GetWithError tells them apart
+func (c *codecStore) Get(ID string, key string) interface{} {
+	val, _ := c.GetWithError(ID, key)
+	return val
+}
+
+func (c *codecStore) GetWithError(ID string, key string) (interface{}, error) {
+	val, err := Session{SessionStore: c.inner}.getWithError(ID, key)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := val.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("session: key %q holds %T, not encoded bytes", key, val)
+	}
+	return c.unmarshal(ID, b)
+}
+
+func (c *codecStore) Delete(ID string, key string) error {
+	return c.inner.Delete(ID, key)
+}
+
+func (c *codecStore) Update(ID string) error {
+	return c.inner.Update(ID)
+}
+
+func (c *codecStore) Expire(ID string) error {
+	return c.inner.Expire(ID)
+}
+
+func (c *codecStore) Flush() error {
+	return c.inner.Flush()
+}
+
+func (c *codecStore) GC(lifeTime time.Duration, timeNow time.Time) {
+	c.inner.GC(lifeTime, timeNow)
+}
+
+// rekeySuffix names the temporary key a value is rewritten to before it
+// replaces the original one
+const rekeySuffix = ".rekey"
+
+// Rekey rewrites every value of the session, read with oldCodec, encoded
+// with newCodec, on the store a codec store wraps, for example to rotate an
+// encryption key. The inner store must list keys with KeysWithPrefix.
+//
+// Each value is written to a temporary key then moved over the original when
+// the store supports MoveKey, so a crash leaves every key either old or new.
+// A value oldCodec can not decode but newCodec can is taken as already
+// rewritten, which makes Rekey resumable as long as each codec rejects the
+// output of the other, like encrypting codecs with different keys do. An
+// IDCodec is given the ID of the session, as by the codec store
+func Rekey(inner SessionStore, ID string, oldCodec, newCodec Codec) error {
+	lister, ok := inner.(interface {
+		KeysWithPrefix(ID string, prefix string) ([]string, error)
+	})
+	if !ok {
+		return fmt.Errorf("session: %T can not list keys", inner)
+	}
+	mover, _ := inner.(interface {
+		MoveKey(srcID, srcKey, dstID, dstKey string) error
+	})
+	keys, err := lister.KeysWithPrefix(ID, "")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if strings.HasSuffix(key, rekeySuffix) {
+			// left by an interrupted Rekey, rewritten with its original key
+			continue
+		}
+		b, ok := inner.Get(ID, key).([]byte)
+		if !ok {
+			return fmt.Errorf("session: key %q does not hold encoded bytes", key)
+		}
+		val, err := unmarshalFor(oldCodec, ID, b)
+		if err != nil {
+			if _, nerr := unmarshalFor(newCodec, ID, b); nerr == nil {
+				continue
+			}
+			return err
+		}
+		if b, err = marshalFor(newCodec, ID, val); err != nil {
+			return err
+		}
+		if mover == nil {
+			if err := inner.Set(ID, key, b); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := inner.Set(ID, key+rekeySuffix, b); err != nil {
+			return err
+		}
+		if err := mover.MoveKey(ID, key+rekeySuffix, ID, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RekeyAll runs Rekey on every session, the inner store must list sessions
+// with ListByActivity. Sessions expiring meanwhile are skipped
+func RekeyAll(inner SessionStore, oldCodec, newCodec Codec) error {
+	lister, ok := inner.(interface {
+		ListByActivity(limit int) ([]SessionInfo, error)
+	})
+	if !ok {
+		return fmt.Errorf("session: %T can not list sessions", inner)
+	}
+	infos, err := lister.ListByActivity(0)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := Rekey(inner, info.ID, oldCodec, newCodec); err != nil && err != ErrSessionNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type codecPoint struct {
+	X, Y int
+}
+
+func Test_JSONCodec(t *testing.T) {
+	c := NewJSONCodec()
+	c.Register("point", codecPoint{})
+	s := NewCodecStore(NewFileStore(nil, "dir", "/"), c)
+	sid := s.GenerateID()
+
+	now := time.Now()
+	values := map[string]interface{}{
+		"time":   now,
+		"bytes":  []byte("raw"),
+		"number": json.Number("12345678901234567890"),
+		"point":  codecPoint{1, 2},
+		"string": "plain",
+	}
+	for key, val := range values {
+		if err := s.Set(sid, key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, ok := s.Get(sid, "time").(time.Time); !ok || !got.Equal(now) {
+		t.Fatalf("time should round-trip but get %#v", s.Get(sid, "time"))
+	}
+	if got, ok := s.Get(sid, "bytes").([]byte); !ok || !bytes.Equal(got, []byte("raw")) {
+		t.Fatalf("bytes should round-trip but get %#v", s.Get(sid, "bytes"))
+	}
+	if got, ok := s.Get(sid, "number").(json.Number); !ok || got != "12345678901234567890" {
+		t.Fatalf("number should round-trip but get %#v", s.Get(sid, "number"))
+	}
+	if got, ok := s.Get(sid, "point").(codecPoint); !ok || got != (codecPoint{1, 2}) {
+		t.Fatalf("registered type should round-trip but get %#v", s.Get(sid, "point"))
+	}
+	if s.Get(sid, "string").(string) != "plain" {
+		t.Fatal("should be plain")
+	}
+	if _, err := s.GetWithError(sid, "absent"); err != ErrKeyNotFound {
+		t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+	}
+	s.Flush()
+}
+
+func Test_GobCodec(t *testing.T) {
+	b, err := GobCodec.Marshal(specialType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := GobCodec.Unmarshal(b); err != nil || v.(specialType) != (specialType{}) {
+		t.Fatalf("unexpected value %v and error %v", v, err)
+	}
+	if _, err := GobCodec.Unmarshal([]byte("corrupt")); err == nil {
+		t.Fatal("corrupt bytes should fail")
+	}
+}
+
+func Test_ScalarCodec(t *testing.T) {
+	for _, c := range []struct {
+		val  interface{}
+		wire []byte
+	}{
+		{true, []byte{0x01, 0x01}},
+		{false, []byte{0x01, 0x00}},
+		{int64(-2), []byte{0x02, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}},
+		{float64(1.5), []byte{0x03, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"héllo", append([]byte{0x04}, "héllo"...)},
+		{"", []byte{0x04}},
+	} {
+		b, err := ScalarCodec.Marshal(c.val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, c.wire) {
+			t.Fatalf("%#v should encode to %x, got %x", c.val, c.wire, b)
+		}
+		if v, err := ScalarCodec.Unmarshal(b); err != nil || v != c.val {
+			t.Fatalf("%#v should round-trip, got %#v %v", c.val, v, err)
+		}
+	}
+	b, err := ScalarCodec.Marshal(specialType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0x00 {
+		t.Fatalf("other types should fall back to gob, got tag %#x", b[0])
+	}
+	if v, err := ScalarCodec.Unmarshal(b); err != nil || v.(specialType) != (specialType{}) {
+		t.Fatalf("unexpected value %v and error %v", v, err)
+	}
+	for _, corrupt := range [][]byte{nil, {0x01, 0x02}, {0x02, 0x01}, {0x7f}} {
+		if _, err := ScalarCodec.Unmarshal(corrupt); err == nil {
+			t.Fatalf("%x should fail", corrupt)
+		}
+	}
+}
+
+func Test_RekeyAll(t *testing.T) {
+	inner := NewMemoryStore(nil)
+	old, next := GobCodec, NewJSONCodec()
+	s := NewCodecStore(inner, old)
+	first, second := s.GenerateID(), s.GenerateID()
+	s.Set(first, "a", "1")
+	s.Set(first, "b", "2")
+	s.Set(second, "c", "3")
+
+	// first rewritten by an interrupted rotation
+	if err := Rekey(inner, first, old, next); err != nil {
+		t.Fatal(err)
+	}
+	if err := RekeyAll(inner, old, next); err != nil {
+		t.Fatal(err)
+	}
+	s = NewCodecStore(inner, next)
+	for _, c := range []struct{ ID, key, val string }{{first, "a", "1"}, {first, "b", "2"}, {second, "c", "3"}} {
+		if val, err := s.GetWithError(c.ID, c.key); err != nil || val.(string) != c.val {
+			t.Fatalf("%s should be rewritten with the new codec, got %v %v", c.key, val, err)
+		}
+	}
+	if keys, _ := inner.KeysWithPrefix(first, ""); len(keys) != 2 {
+		t.Fatalf("temporary keys should be moved, got %v", keys)
+	}
+}
+
+func Test_RekeyEncrypted(t *testing.T) {
+	inner := NewMemoryStore(nil)
+	old, next := NewEncryptingCodec(GobCodec, []byte("old")), NewEncryptingCodec(GobCodec, []byte("next"))
+	s := NewCodecStore(inner, old)
+	sid := s.GenerateID()
+	s.Set(sid, "key", "value")
+	if err := Rekey(inner, sid, old, next); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := NewCodecStore(inner, next).GetWithError(sid, "key"); err != nil || val.(string) != "value" {
+		t.Fatalf("the value should be sealed with the new key, got %v %v", val, err)
+	}
+	// resumed
+	if err := Rekey(inner, sid, old, next); err != nil {
+		t.Fatal(err)
+	}
+}
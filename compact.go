@@ -0,0 +1,114 @@
+// maintenance of the file store
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stagingPrefixes name the temporary entries of the root, see Create,
+// archive, thaw and Ping
+var stagingPrefixes = []string{".create", ".archive", ".thaw", ".ping"}
+
+// stagingMaxAge is the age past which a temporary entry of the root is
+// taken as left behind by a crash rather than in use
+const stagingMaxAge = time.Hour
+
+// Compact rewrites every live session to its minimal form: the session file
+// of the single file layout is rewritten and its temporary file dropped, the
+// key files expired by their TTL are removed. Temporary entries of the root
+// older than an hour are removed. Each session is compacted under its lock
+// and keeps its modification time, so Compact does not delay its expiry.
+// Archived sessions and sessions that do not decode, see Verify, are left
+// as they are
+func (f file) Compact() error {
+	fis, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, info := range fis {
+		name := info.Name()
+		if strings.HasPrefix(name, ".") {
+			if staging(name) && info.ModTime().Add(stagingMaxAge).Before(now) {
+				if err := os.RemoveAll(filepath.Join(f.root, name)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !info.IsDir() {
+			continue
+		}
+		if err := f.compactSession(name, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func staging(name string) bool {
+	for _, prefix := range stagingPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f file) compactSession(ID string, now time.Time) (err error) {
+	f.locks.withLock(ID, func() {
+		var directory string
+		if directory, err = f.directoryPath(ID); err != nil {
+			return
+		}
+		var info os.FileInfo
+		if info, err = os.Stat(directory); err != nil {
+			if os.IsNotExist(err) {
+				// expired meanwhile
+				err = nil
+			}
+			return
+		}
+		defer func() {
+			if cerr := os.Chtimes(directory, info.ModTime(), info.ModTime()); err == nil && !os.IsNotExist(cerr) {
+				err = cerr
+			}
+		}()
+		if !f.singleFile {
+			f.sweepKeys(ID, now)
+			return
+		}
+		tmp := filepath.Join(directory, sessionFile+".tmp")
+		size := fileSize(tmp)
+		if err = os.Remove(tmp); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+		f.track(-size)
+		var b []byte
+		if b, err = ioutil.ReadFile(filepath.Join(directory, sessionFile)); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return
+		}
+		if !decodes(b) {
+			// left for Verify and Repair
+			return
+		}
+		values, metas := unmarshalSession(b)
+		if err = f.writeSession(ID, values, metas); err == nil {
+			f.churn.reset(ID)
+		}
+	})
+	if isStorageFull(err) {
+		err = ErrStorageFull
+	}
+	return
+}
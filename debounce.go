@@ -0,0 +1,152 @@
+// debounced keep-alives
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+var _ SessionStore = new(debounced)
+
+// debounced coalesces the Updates of a session within a window
+type debounced struct {
+	inner  SessionStore
+	window time.Duration
+
+	// written is when each session was last updated through inner, pending
+	// the sessions updated again since
+	written map[string]time.Time
+	pending map[string]struct{}
+	lock    sync.Mutex
+
+	done   chan struct{}
+	closed sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewDebouncedStore passes the first Update of a session to inner, then
+// coalesces the Updates following within window into a single one, made
+// by a background flusher once the window is over. A session so reads as
+// idle for up to window longer than it is: window should be much shorter
+// than the session lifetime. A coalesced Update returns nil, it can not
+// report an error of inner. Close stops the flusher, flushing the pending
+// Updates first. A window <= 0 passes every Update to inner
+func NewDebouncedStore(inner SessionStore, window time.Duration) *debounced {
+	d := &debounced{
+		inner:   inner,
+		window:  window,
+		written: make(map[string]time.Time),
+		pending: make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+	if window > 0 {
+		d.wg.Add(1)
+		go d.flusher()
+	}
+	return d
+}
+
+func (d *debounced) flusher() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.flush(time.Now())
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// flush updates the pending sessions through inner and forgets the
+// sessions not updated within the window
+func (d *debounced) flush(now time.Time) {
+	d.lock.Lock()
+	IDs := make([]string, 0, len(d.pending))
+	for ID := range d.pending {
+		IDs = append(IDs, ID)
+		d.written[ID] = now
+	}
+	d.pending = make(map[string]struct{})
+	for ID, t := range d.written {
+		if now.Sub(t) >= d.window {
+			delete(d.written, ID)
+		}
+	}
+	d.lock.Unlock()
+	for _, ID := range IDs {
+		d.inner.Update(ID)
+	}
+}
+
+// Close flushes the pending Updates and stops the flusher
+func (d *debounced) Close() error {
+	d.closed.Do(func() {
+		close(d.done)
+		d.wg.Wait()
+		d.flush(time.Now())
+	})
+	return nil
+}
+
+func (d *debounced) GenerateID() string {
+	return d.inner.GenerateID()
+}
+
+func (d *debounced) Set(ID string, key string, val interface{}) error {
+	return d.inner.Set(ID, key, val)
+}
+
+func (d *debounced) Get(ID string, key string) interface{} {
+	return d.inner.Get(ID, key)
+}
+
+func (d *debounced) GetWithError(ID string, key string) (interface{}, error) {
+	return getWithError(d.inner, ID, key)
+}
+
+func (d *debounced) Delete(ID string, key string) error {
+	return d.inner.Delete(ID, key)
+}
+
+func (d *debounced) Update(ID string) error {
+	if d.window <= 0 {
+		return d.inner.Update(ID)
+	}
+	d.lock.Lock()
+	if t, ok := d.written[ID]; ok && time.Since(t) < d.window {
+		d.pending[ID] = struct{}{}
+		d.lock.Unlock()
+		return nil
+	}
+	d.written[ID] = time.Now()
+	d.lock.Unlock()
+	return d.inner.Update(ID)
+}
+
+func (d *debounced) forget(ID string) {
+	d.lock.Lock()
+	delete(d.written, ID)
+	delete(d.pending, ID)
+	d.lock.Unlock()
+}
+
+// Expire drops the pending Update of the session
+func (d *debounced) Expire(ID string) error {
+	d.forget(ID)
+	return d.inner.Expire(ID)
+}
+
+func (d *debounced) Flush() error {
+	d.lock.Lock()
+	d.written = make(map[string]time.Time)
+	d.pending = make(map[string]struct{})
+	d.lock.Unlock()
+	return d.inner.Flush()
+}
+
+func (d *debounced) GC(lifeTime time.Duration, timeNow time.Time) {
+	d.inner.GC(lifeTime, timeNow)
+}
@@ -0,0 +1,66 @@
+package session
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// keepAlives counts the Updates reaching the store
+type keepAlives struct {
+	*memory
+	updates int32
+}
+
+func (k *keepAlives) Update(ID string) error {
+	atomic.AddInt32(&k.updates, 1)
+	return k.memory.Update(ID)
+}
+
+func Test_DebouncedStore(t *testing.T) {
+	inner := &keepAlives{memory: NewMemoryStore(nil)}
+	d := NewDebouncedStore(inner, time.Hour)
+	sid := d.GenerateID()
+	for i := 0; i < 100; i++ {
+		if err := d.Update(sid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&inner.updates); n != 1 {
+		t.Fatalf("only the first Update should reach the store, got %v", n)
+	}
+	before, _ := inner.LastUpdate(sid)
+	d.Close()
+	if n := atomic.LoadInt32(&inner.updates); n != 2 {
+		t.Fatalf("Close should flush the coalesced Updates once, got %v", n)
+	}
+	if after, _ := inner.LastUpdate(sid); !after.After(before) {
+		t.Fatal("the flushed Update should refresh the session")
+	}
+
+	// the flusher writes the pending Updates once the window is over
+	inner = &keepAlives{memory: NewMemoryStore(nil)}
+	d = NewDebouncedStore(inner, 20*time.Millisecond)
+	defer d.Close()
+	sid = d.GenerateID()
+	d.Update(sid)
+	d.Update(sid)
+	other := d.GenerateID()
+	d.Update(other)
+	d.Update(other)
+	d.Expire(other)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&inner.updates); n != 3 {
+		t.Fatalf("expected the pending Update of the live session flushed, got %v Updates", n)
+	}
+
+	inner = &keepAlives{memory: NewMemoryStore(nil)}
+	d = NewDebouncedStore(inner, 0)
+	sid = d.GenerateID()
+	d.Update(sid)
+	d.Update(sid)
+	d.Close()
+	if n := atomic.LoadInt32(&inner.updates); n != 2 {
+		t.Fatalf("without a window every Update should reach the store, got %v", n)
+	}
+}
@@ -0,0 +1,65 @@
+// handing the sessions of a memory store over to another store
+package session
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// renewer is a store whose sessions can be marked as updated at another
+// time, past ones included, see Drain
+type renewer interface {
+	renewAt(ID string, at time.Time) error
+}
+
+func (m *memory) readOnly() bool {
+	return atomic.LoadInt32(&m.drained) == 1
+}
+
+// Drain copies every session to dst and leaves the store read-only, before
+// a shutdown for instance: from the moment Drain starts the writes to the
+// store fail with ErrReadOnly, while reads, Update, Expire and GC still
+// work. It returns the number of sessions copied.
+//
+// The sessions are created in dst by their first Set, so dst must create
+// missing sessions on Set, see MissingSessionCreate, and sessions holding
+// no key are not copied. Their last update is kept when dst is a memory
+// or file store. Metadata is not copied. Drain
+// stops at the first error of dst, the count tells how far it got
+func (m *memory) Drain(dst SessionStore) (count int, err error) {
+	atomic.StoreInt32(&m.drained, 1)
+	type drained struct {
+		ID         string
+		data       map[string]interface{}
+		lastUpdate time.Time
+	}
+	for _, s := range m.shards {
+		var sessions []drained
+		s.withReadLock(func() {
+			for ID, d := range s.data {
+				data := make(map[string]interface{}, len(d.data))
+				for key, val := range d.data {
+					data[key] = val
+				}
+				sessions = append(sessions, drained{ID, data, d.lastUpdate})
+			}
+		})
+		for _, d := range sessions {
+			if len(d.data) == 0 {
+				continue
+			}
+			for key, val := range d.data {
+				if err = dst.Set(d.ID, key, val); err != nil {
+					return
+				}
+			}
+			if r, ok := dst.(renewer); ok {
+				if err = r.renewAt(d.ID, d.lastUpdate); err != nil {
+					return
+				}
+			}
+			count++
+		}
+	}
+	return
+}
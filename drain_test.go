@@ -0,0 +1,55 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Drain(t *testing.T) {
+	src, dst := NewMemoryStore(nil), NewMemoryStore(nil)
+	dst.OnMissingSession = MissingSessionCreate
+	alice, bob, empty := src.GenerateID(), src.GenerateID(), src.GenerateID()
+	src.Set(alice, "user", "alice")
+	src.Set(alice, "age", 12)
+	src.Set(bob, "user", "bob")
+	src.renewAt(bob, time.Now().Add(-time.Hour))
+
+	count, err := src.Drain(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 sessions drained, got %d", count)
+	}
+	if dst.Get(alice, "user") != "alice" || dst.Get(alice, "age") != 12 || dst.Get(bob, "user") != "bob" {
+		t.Fatal("the values should be copied")
+	}
+	if _, err := dst.GetWithError(empty, "user"); err != ErrSessionNotFound {
+		t.Fatal("a session without keys should not be copied")
+	}
+	var lastUpdate time.Time
+	s := dst.shard(bob)
+	s.withReadLock(func() { lastUpdate = s.data[bob].lastUpdate })
+	if time.Since(lastUpdate) < 59*time.Minute {
+		t.Fatalf("the last update should be kept, got %v", lastUpdate)
+	}
+
+	if err := src.Set(alice, "user", "eve"); err != ErrReadOnly {
+		t.Fatalf("error should be ErrReadOnly but get %v", err)
+	}
+	if err := src.Delete(alice, "user"); err != ErrReadOnly {
+		t.Fatalf("error should be ErrReadOnly but get %v", err)
+	}
+	if err := src.MoveKey(alice, "user", alice, "name"); err != ErrReadOnly {
+		t.Fatalf("a move within a session should fail with ErrReadOnly, got %v", err)
+	}
+	if _, err := src.Create(nil); err != ErrReadOnly {
+		t.Fatalf("error should be ErrReadOnly but get %v", err)
+	}
+	if src.GenerateID() != "" {
+		t.Fatal("a drained store should not create sessions")
+	}
+	if src.Get(alice, "user") != "alice" {
+		t.Fatal("a drained store should still be read")
+	}
+}
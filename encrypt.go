@@ -0,0 +1,80 @@
+// encrypting codec
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+var _ IDCodec = new(encrypting)
+
+// encrypting seals the encoding of an inner codec with AES-256-GCM under a
+// key derived from a master secret and the session ID
+type encrypting struct {
+	inner  Codec
+	master []byte
+}
+
+// NewEncryptingCodec encrypts the values encoded by inner. Through a codec
+// store each session gets its own key, an HMAC-SHA256 of its ID under a
+// key derived from secret, and the ID is authenticated with the value, so
+// a value copied to another session does not decrypt. Used without an ID,
+// through Marshal and Unmarshal, all the values share one key
+func NewEncryptingCodec(inner Codec, secret []byte) *encrypting {
+	return &encrypting{inner, derive(secret, "session value encryption")}
+}
+
+func (e *encrypting) aead(ID string) (cipher.AEAD, error) {
+	key := e.master
+	if ID != "" {
+		key = derive(e.master, ID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *encrypting) Marshal(v interface{}) ([]byte, error) {
+	return e.MarshalID("", v)
+}
+
+func (e *encrypting) Unmarshal(b []byte) (interface{}, error) {
+	return e.UnmarshalID("", b)
+}
+
+// MarshalID returns the random nonce followed by the sealed encoding
+func (e *encrypting) MarshalID(ID string, v interface{}) ([]byte, error) {
+	plain, err := e.inner.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e.aead(ID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(ID)), nil
+}
+
+func (e *encrypting) UnmarshalID(ID string, b []byte) (interface{}, error) {
+	aead, err := e.aead(ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("session: encrypted value too short")
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(ID))
+	if err != nil {
+		return nil, fmt.Errorf("session: can not decrypt value: %v", err)
+	}
+	return e.inner.Unmarshal(plain)
+}
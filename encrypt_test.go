@@ -0,0 +1,34 @@
+package session
+
+import "testing"
+
+func Test_EncryptingCodec(t *testing.T) {
+	codec := NewEncryptingCodec(GobCodec, []byte("secret"))
+	inner := NewMemoryStore(nil)
+	s := NewCodecStore(inner, codec)
+	alice, bob := s.GenerateID(), s.GenerateID()
+	if err := s.Set(alice, "card", "4242"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := s.GetWithError(alice, "card"); err != nil || val.(string) != "4242" {
+		t.Fatalf("expected the value back, got %v %v", val, err)
+	}
+	sealed := inner.Get(alice, "card").([]byte)
+	if _, err := codec.UnmarshalID(bob, sealed); err == nil {
+		t.Fatal("the key of another session should not decrypt the value")
+	}
+	inner.Set(bob, "card", sealed)
+	if _, err := s.GetWithError(bob, "card"); err == nil {
+		t.Fatal("a value copied to another session should not decrypt")
+	}
+	if _, err := NewEncryptingCodec(GobCodec, []byte("other")).UnmarshalID(alice, sealed); err == nil {
+		t.Fatal("another secret should not decrypt the value")
+	}
+	b, err := codec.Marshal(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := codec.Unmarshal(b); err != nil || val.(int) != 42 {
+		t.Fatalf("the shared key should decrypt, got %v %v", val, err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !plan9
+// +build !plan9
+
+// errno checks of the file store
+package session
+
+import "syscall"
+
+// isNoSpace reports whether errno is a full disk or an exhausted quota
+func isNoSpace(errno error) bool {
+	return errno == syscall.ENOSPC || errno == syscall.EDQUOT
+}
+
+// isNotEmpty reports whether errno is a rename onto a non-empty directory
+func isNotEmpty(errno error) bool {
+	return errno == syscall.ENOTEMPTY
+}
+
+// isCrossDevice reports whether errno is a rename across file systems
+func isCrossDevice(errno error) bool {
+	return errno == syscall.EXDEV
+}
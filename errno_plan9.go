@@ -0,0 +1,16 @@
+// errno checks of the file store, plan9 has no errno: a full disk fails the
+// write as any other error, a rename onto an existing directory is caught by
+// os.IsExist and a rename across file systems is not retried as a copy
+package session
+
+func isNoSpace(errno error) bool {
+	return false
+}
+
+func isNotEmpty(errno error) bool {
+	return false
+}
+
+func isCrossDevice(errno error) bool {
+	return false
+}
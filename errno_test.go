@@ -0,0 +1,26 @@
+//go:build !plan9
+// +build !plan9
+
+package session
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func Test_StorageFull(t *testing.T) {
+	for _, err := range []error{
+		syscall.ENOSPC,
+		&os.PathError{Op: "mkdir", Path: "dir/id", Err: syscall.ENOSPC},
+		&os.PathError{Op: "write", Path: "dir/id/key", Err: syscall.EDQUOT},
+		&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ENOSPC},
+	} {
+		if !isStorageFull(err) {
+			t.Fatalf("%v should be a storage full error", err)
+		}
+	}
+	if isStorageFull(&os.PathError{Op: "mkdir", Path: "dir/id", Err: syscall.EEXIST}) {
+		t.Fatal("a collision is not a storage full error")
+	}
+}
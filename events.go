@@ -0,0 +1,205 @@
+// event sourcing store
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+var _ SessionStore = new(eventStore)
+
+// eventStore records every mutation going through it to a sink, as a
+// sequence of length prefixed records: a header holding the time, operation,
+// ID and key, followed for OpSet by the value, each encoded with the codec
+type eventStore struct {
+	inner SessionStore
+	sink  io.Writer
+
+	// Codec encodes the records, GobCodec by default. Values go through it,
+	// so it must handle every type stored
+	Codec Codec
+
+	// BestEffort logs sink failures instead of returning them
+	BestEffort bool
+
+	// serializes writes so records do not interleave
+	lock sync.Mutex
+	// serializes the operations on a session with their records, so the
+	// records of a session are in the order inner applied them
+	sessions sessionLocks
+}
+
+// NewEventStore wraps inner so its mutations are recorded to sink. An event
+// is written once inner succeeded, so when the sink fails the operation is
+// applied but reports the error, unless BestEffort is set
+func NewEventStore(inner SessionStore, sink io.Writer) *eventStore {
+	return &eventStore{inner: inner, sink: sink, Codec: GobCodec}
+}
+
+func (e *eventStore) record(op Op, ID, key string, val interface{}) error {
+	err := e.write(op, ID, key, val)
+	if err != nil && e.BestEffort {
+		log.Println(err)
+		return nil
+	}
+	return err
+}
+
+func (e *eventStore) write(op Op, ID, key string, val interface{}) error {
+	header, err := e.Codec.Marshal(map[string]string{
+		"time": time.Now().Format(time.RFC3339Nano),
+		"op":   op.String(),
+		"id":   ID,
+		"key":  key,
+	})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writeRecord(&buf, header)
+	if op == OpSet {
+		value, err := e.Codec.Marshal(val)
+		if err != nil {
+			return err
+		}
+		writeRecord(&buf, value)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err = e.sink.Write(buf.Bytes())
+	return err
+}
+
+func writeRecord(buf *bytes.Buffer, b []byte) {
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))])
+	buf.Write(b)
+}
+
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// the buffer grows with the bytes read, so a corrupt length fails
+	// short instead of allocating it
+	if n > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, r, int64(n)); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b.Bytes(), nil
+}
+
+// ReplayEvents applies the events recorded by an event store to store.
+// Generated IDs can not be replayed, so store should create sessions on Set,
+// see MissingSessionCreate, and sessions never set are not recreated
+func ReplayEvents(r io.Reader, codec Codec, store SessionStore) error {
+	br := bufio.NewReader(r)
+	for {
+		b, err := readRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		v, err := codec.Unmarshal(b)
+		if err != nil {
+			return err
+		}
+		header, ok := v.(map[string]string)
+		if !ok {
+			// the JSON codec decodes maps as map[string]interface{}
+			header = make(map[string]string)
+			m, _ := v.(map[string]interface{})
+			for k, v := range m {
+				header[k], _ = v.(string)
+			}
+		}
+		ID, key := header["id"], header["key"]
+		switch header["op"] {
+		case OpSet.String():
+			if b, err = readRecord(br); err != nil {
+				return err
+			}
+			val, err := codec.Unmarshal(b)
+			if err != nil {
+				return err
+			}
+			err = store.Set(ID, key, val)
+		case OpDelete.String():
+			err = store.Delete(ID, key)
+		case OpExpire.String():
+			err = store.Expire(ID)
+		case OpGenerate.String():
+		default:
+			err = fmt.Errorf("session: unknown event %q", header["op"])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *eventStore) GenerateID() string {
+	ID := e.inner.GenerateID()
+	if err := e.record(OpGenerate, ID, "", nil); err != nil {
+		log.Println(err)
+	}
+	return ID
+}
+
+// apply runs the operation on inner and records it once it succeeded, under
+// the lock of the session
+func (e *eventStore) apply(op Op, ID, key string, val interface{}, run func() error) (err error) {
+	e.sessions.withLock(ID, func() {
+		if err = run(); err == nil {
+			err = e.record(op, ID, key, val)
+		}
+	})
+	return
+}
+
+func (e *eventStore) Set(ID string, key string, val interface{}) error {
+	return e.apply(OpSet, ID, key, val, func() error {
+		return e.inner.Set(ID, key, val)
+	})
+}
+
+func (e *eventStore) Get(ID string, key string) interface{} {
+	return e.inner.Get(ID, key)
+}
+
+func (e *eventStore) Delete(ID string, key string) error {
+	return e.apply(OpDelete, ID, key, nil, func() error {
+		return e.inner.Delete(ID, key)
+	})
+}
+
+func (e *eventStore) Update(ID string) error {
+	return e.inner.Update(ID)
+}
+
+func (e *eventStore) Expire(ID string) error {
+	return e.apply(OpExpire, ID, "", nil, func() error {
+		return e.inner.Expire(ID)
+	})
+}
+
+func (e *eventStore) Flush() error {
+	return e.inner.Flush()
+}
+
+func (e *eventStore) GC(lifeTime time.Duration, timeNow time.Time) {
+	e.inner.GC(lifeTime, timeNow)
+}
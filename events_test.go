@@ -0,0 +1,93 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("sink down")
+}
+
+func Test_EventStore(t *testing.T) {
+	for _, codec := range []Codec{GobCodec, NewJSONCodec()} {
+		var sink bytes.Buffer
+		s := NewEventStore(NewMemoryStore(nil), &sink)
+		s.Codec = codec
+		sid := s.GenerateID()
+		s.Set(sid, "kept", "val")
+		s.Set(sid, "deleted", "val")
+		s.Delete(sid, "deleted")
+		expired := s.GenerateID()
+		s.Set(expired, "key", "val")
+		s.Expire(expired)
+
+		m := NewMemoryStore(nil)
+		m.OnMissingSession = MissingSessionCreate
+		if err := ReplayEvents(&sink, codec, m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Get(sid, "kept").(string) != "val" || m.Get(sid, "deleted") != nil {
+			t.Fatal("replaying should rebuild the session")
+		}
+		if m.Count() != 1 {
+			t.Fatal("the expired session should not be rebuilt")
+		}
+	}
+
+	s := NewEventStore(NewMemoryStore(nil), failingWriter{})
+	sid := s.GenerateID()
+	if err := s.Set(sid, "key", "val"); err == nil {
+		t.Fatal("a sink failure should fail the operation")
+	}
+	s.BestEffort = true
+	if err := s.Set(sid, "key", "val"); err != nil {
+		t.Fatal("a best effort sink failure should not fail the operation")
+	}
+}
+
+// slowStore returns late from the Sets of slow, once the value is set
+type slowStore struct {
+	SessionStore
+	slow interface{}
+}
+
+func (s slowStore) Set(ID string, key string, val interface{}) error {
+	err := s.SessionStore.Set(ID, key, val)
+	if val == s.slow {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
+
+func Test_EventStoreConcurrentSets(t *testing.T) {
+	var sink bytes.Buffer
+	s := NewEventStore(slowStore{NewMemoryStore(nil), "first"}, &sink)
+	sid := s.GenerateID()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.Set(sid, "key", "first")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		s.Set(sid, "key", "second")
+	}()
+	wg.Wait()
+
+	m := NewMemoryStore(nil)
+	m.OnMissingSession = MissingSessionCreate
+	if err := ReplayEvents(&sink, s.Codec, m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get(sid, "key") != s.Get(sid, "key") {
+		t.Fatalf("the records should follow the Sets applied, replayed %v instead of %v", m.Get(sid, "key"), s.Get(sid, "key"))
+	}
+}
@@ -0,0 +1,234 @@
+package session
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// EvictionPolicy picks the session to evict once the memory store holds more
+// sessions than its limit, see SetMaxSessions. Implementations must be safe
+// for concurrent use and ignore IDs they were not given with Add
+type EvictionPolicy interface {
+	// Add records a new session
+	Add(ID string)
+	// Access records a read or a write of a session
+	Access(ID string)
+	// Remove forgets a session removed by Expire, GC, Flush or eviction
+	Remove(ID string)
+	// Victim returns the session to evict next
+	Victim() (ID string, ok bool)
+}
+
+// lruPolicy evicts the least recently used session
+type lruPolicy struct {
+	l *lru
+	// fifo ignores accesses, evicting the oldest session
+	fifo bool
+}
+
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{l: newLRU()}
+}
+
+func NewFIFOPolicy() EvictionPolicy {
+	return &lruPolicy{l: newLRU(), fifo: true}
+}
+
+func (p *lruPolicy) Add(ID string) {
+	p.l.put(ID, nil)
+}
+
+func (p *lruPolicy) Access(ID string) {
+	if !p.fifo && p.l.contains(ID) {
+		p.l.put(ID, nil)
+	}
+}
+
+func (p *lruPolicy) Remove(ID string) {
+	p.l.remove(ID)
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	k, ok := p.l.front()
+	if !ok {
+		return "", false
+	}
+	return k.(string), true
+}
+
+// lfuPolicy evicts the least frequently used session, the oldest one first
+// among equally used sessions. A new session starts at the lowest count in
+// use so it is not always the first victim
+type lfuPolicy struct {
+	h     lfuHeap
+	items map[string]*lfuItem
+	seq   uint64
+
+	lock sync.Mutex
+}
+
+type lfuItem struct {
+	ID    string
+	count int
+	seq   uint64
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].seq < h[j].seq
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{items: make(map[string]*lfuItem)}
+}
+
+func (p *lfuPolicy) Add(ID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.items[ID]; ok {
+		return
+	}
+	p.seq++
+	item := &lfuItem{ID: ID, seq: p.seq}
+	if len(p.h) > 0 {
+		item.count = p.h[0].count
+	}
+	p.items[ID] = item
+	heap.Push(&p.h, item)
+}
+
+func (p *lfuPolicy) Access(ID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if item, ok := p.items[ID]; ok {
+		item.count++
+		heap.Fix(&p.h, item.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(ID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if item, ok := p.items[ID]; ok {
+		heap.Remove(&p.h, item.index)
+		delete(p.items, ID)
+	}
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.h) == 0 {
+		return "", false
+	}
+	return p.h[0].ID, true
+}
+
+// SizedEvictionPolicy is an EvictionPolicy also told the estimated size of
+// each session, see SetMaxBytes. Resize may come before Add, for a session
+// created with its first key
+type SizedEvictionPolicy interface {
+	EvictionPolicy
+	// Resize records the estimated bytes of the keys and values of a session
+	Resize(ID string, bytes int64)
+}
+
+// sizedLRUPolicy evicts the session with the highest score, its size times
+// the number of accesses to the store since it was last used, so a large
+// session goes before a small one used as long ago. Victim scans every
+// session
+type sizedLRUPolicy struct {
+	items map[string]*sizedItem
+	clock uint64
+
+	lock sync.Mutex
+}
+
+type sizedItem struct {
+	bytes int64
+	seq   uint64
+	// added is false for a session resized but not yet added
+	added bool
+}
+
+func NewSizedLRUPolicy() SizedEvictionPolicy {
+	return &sizedLRUPolicy{items: make(map[string]*sizedItem)}
+}
+
+func (p *sizedLRUPolicy) item(ID string) *sizedItem {
+	item, ok := p.items[ID]
+	if !ok {
+		item = new(sizedItem)
+		p.items[ID] = item
+	}
+	return item
+}
+
+func (p *sizedLRUPolicy) Add(ID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clock++
+	item := p.item(ID)
+	item.added, item.seq = true, p.clock
+}
+
+func (p *sizedLRUPolicy) Access(ID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if item, ok := p.items[ID]; ok && item.added {
+		p.clock++
+		item.seq = p.clock
+	}
+}
+
+func (p *sizedLRUPolicy) Resize(ID string, bytes int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.item(ID).bytes = bytes
+}
+
+func (p *sizedLRUPolicy) Remove(ID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.items, ID)
+}
+
+func (p *sizedLRUPolicy) Victim() (ID string, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var best float64
+	var bestSeq uint64
+	for id, item := range p.items {
+		if !item.added {
+			continue
+		}
+		// floats so a large session idle for long does not overflow, the
+		// age starts at 1 so an empty or just used session still ranks
+		score := float64(item.bytes+1) * float64(p.clock-item.seq+1)
+		if !ok || score > best || score == best && item.seq < bestSeq {
+			ID, best, bestSeq, ok = id, score, item.seq, true
+		}
+	}
+	return
+}
@@ -0,0 +1,187 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEviction(t *testing.T, policy EvictionPolicy, evicted string) {
+	IDs := []string{"a", "b", "c"}
+	next := 0
+	m := NewMemoryStore(func() string {
+		next++
+		return IDs[next-1]
+	})
+	m.SetMaxSessions(2, policy)
+
+	m.GenerateID()
+	m.GenerateID()
+	m.Get("a", "key")
+	m.Set("a", "key", "value")
+	m.Get("b", "key")
+	m.Get("a", "key")
+	m.GenerateID()
+
+	for _, ID := range IDs {
+		if err := m.Set(ID, "key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if exists := m.Get(ID, "key") != nil; exists == (ID == evicted) {
+			t.Fatalf("%s should be the only evicted session", evicted)
+		}
+	}
+}
+
+func Test_Eviction(t *testing.T) {
+	// a is used last and most often, b is used in between, a is created first
+	testEviction(t, NewLRUPolicy(), "b")
+	testEviction(t, NewLFUPolicy(), "b")
+	testEviction(t, NewFIFOPolicy(), "a")
+}
+
+func Test_OnEvict(t *testing.T) {
+	m := NewMemoryStore(nil)
+	m.SetMaxSessions(1, NewFIFOPolicy())
+	evicted := make(map[string]interface{})
+	m.OnEvict = func(ID string, data map[string]interface{}) {
+		if m.Count() != 1 {
+			t.Error("the session should be gone when OnEvict runs")
+		}
+		// the store is usable from the callback
+		m.Get(ID, "key")
+		evicted[ID] = data["key"]
+	}
+	first := m.GenerateID()
+	m.Set(first, "key", "spilled")
+	m.Expire(m.GenerateID())
+	if len(evicted) != 1 || evicted[first] != "spilled" {
+		t.Fatalf("OnEvict should get the data of the evicted session only, got %v", evicted)
+	}
+}
+
+func Test_MaxBytes(t *testing.T) {
+	m := NewMemoryStore(nil)
+	m.SetMaxBytes(1000, nil)
+	var evicted []string
+	m.OnEvict = func(ID string, data map[string]interface{}) {
+		evicted = append(evicted, ID)
+	}
+	big := m.GenerateID()
+	m.Set(big, "k", strings.Repeat("x", 600))
+	var small []string
+	for i := 0; i < 5; i++ {
+		ID := m.GenerateID()
+		m.Set(ID, "k", strings.Repeat("x", 50))
+		small = append(small, ID)
+	}
+	// the small sessions were used since, the big one goes first
+	m.Set(m.GenerateID(), "k", strings.Repeat("x", 200))
+	if len(evicted) != 1 || evicted[0] != big {
+		t.Fatalf("only the big session should be evicted, got %v of %s", evicted, big)
+	}
+	for _, ID := range small {
+		if m.Get(ID, "k") == nil {
+			t.Fatalf("small session %s should be kept", ID)
+		}
+	}
+
+	// a session growing over the budget evicts too
+	m.Set(small[0], "k", strings.Repeat("x", 900))
+	if stats := m.Stats(); stats.Bytes > 1000 {
+		t.Fatalf("the store should be back under its budget, got %+v", stats)
+	}
+	for i := 0; i < 50; i++ {
+		m.Set(m.GenerateID(), "k", strings.Repeat("x", 10*i))
+		if stats := m.Stats(); stats.Bytes > 1000 {
+			t.Fatalf("the store should stay under its budget, got %+v", stats)
+		}
+	}
+
+	// as do Patch and Append
+	grown := m.GenerateID()
+	m.Patch(grown, "k", func(interface{}) interface{} { return strings.Repeat("x", 1500) })
+	if stats := m.Stats(); stats.Bytes > 1000 {
+		t.Fatalf("Patch should evict past the budget, got %+v", stats)
+	}
+	grown = m.GenerateID()
+	for i := 0; i < 30; i++ {
+		m.Append(grown, "k", strings.Repeat("x", 50))
+		if stats := m.Stats(); stats.Bytes > 1000 {
+			t.Fatalf("Append should evict past the budget, got %+v", stats)
+		}
+	}
+
+	m.SetMaxBytes(0, nil)
+	if m.eviction != nil {
+		t.Fatal("removing the cap should drop the policy")
+	}
+}
+
+func Test_SizedLRUPolicy(t *testing.T) {
+	p := NewSizedLRUPolicy()
+	p.Resize("a", 100)
+	p.Add("a")
+	p.Add("b")
+	p.Resize("b", 1000)
+	p.Add("c")
+	p.Resize("c", 10)
+	p.Resize("untracked", 1e6)
+	if ID, _ := p.Victim(); ID != "b" {
+		t.Fatalf("the largest session should be the victim, got %s", ID)
+	}
+	p.Remove("b")
+	// a is older but c is used much less recently than it is large
+	for i := 0; i < 20; i++ {
+		p.Access("a")
+	}
+	if ID, _ := p.Victim(); ID != "c" {
+		t.Fatalf("the idle session should be the victim, got %s", ID)
+	}
+	p.Remove("a")
+	p.Remove("c")
+	if _, ok := p.Victim(); ok {
+		t.Fatal("resized sessions never added should not be victims")
+	}
+}
+
+// racingPolicy writes to the session it is told to remove, as a concurrent
+// Set would
+type racingPolicy struct {
+	*sizedLRUPolicy
+	race func(ID string)
+}
+
+func (p racingPolicy) Remove(ID string) {
+	p.sizedLRUPolicy.Remove(ID)
+	p.race(ID)
+}
+
+func Test_MaxBytesConcurrentEvict(t *testing.T) {
+	m := NewMemoryStore(nil)
+	policy := racingPolicy{sizedLRUPolicy: NewSizedLRUPolicy().(*sizedLRUPolicy)}
+	policy.race = func(ID string) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.Set(ID, "other", "x")
+		}()
+		select {
+		case <-done:
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	m.SetMaxBytes(500, policy)
+	victim := m.GenerateID()
+	m.Set(victim, "k", strings.Repeat("x", 300))
+	m.Set(m.GenerateID(), "k", strings.Repeat("x", 300))
+	if _, err := m.LastUpdate(victim); err != ErrSessionNotFound {
+		t.Fatalf("the session should be evicted, got %v", err)
+	}
+	policy.lock.Lock()
+	_, left := policy.items[victim]
+	policy.lock.Unlock()
+	if left {
+		t.Fatal("an evicted session should not be left in the policy")
+	}
+}
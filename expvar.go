@@ -0,0 +1,74 @@
+// expvar metrics
+package session
+
+import (
+	"expvar"
+	"time"
+)
+
+var _ SessionStore = new(expvarStore)
+
+// expvarStore counts the operations going through it in an expvar.Map
+type expvarStore struct {
+	inner SessionStore
+	vars  *expvar.Map
+}
+
+// PublishExpvar publishes an expvar map named prefix holding a counter per
+// operation, an errors counter and, when store has a Count method, the number
+// of live sessions. Use the returned store so operations get counted.
+// Like expvar.Publish it panics if prefix is already published
+func PublishExpvar(prefix string, store SessionStore) *expvarStore {
+	e := &expvarStore{store, expvar.NewMap(prefix)}
+	if counter, ok := store.(interface {
+		Count() int
+	}); ok {
+		e.vars.Set("sessions", expvar.Func(func() interface{} {
+			return counter.Count()
+		}))
+	}
+	return e
+}
+
+func (e *expvarStore) count(op string, err error) error {
+	e.vars.Add(op, 1)
+	if err != nil {
+		e.vars.Add("errors", 1)
+	}
+	return err
+}
+
+func (e *expvarStore) GenerateID() string {
+	e.vars.Add("generate", 1)
+	return e.inner.GenerateID()
+}
+
+func (e *expvarStore) Set(ID string, key string, val interface{}) error {
+	return e.count("set", e.inner.Set(ID, key, val))
+}
+
+func (e *expvarStore) Get(ID string, key string) interface{} {
+	e.vars.Add("get", 1)
+	return e.inner.Get(ID, key)
+}
+
+func (e *expvarStore) Delete(ID string, key string) error {
+	return e.count("delete", e.inner.Delete(ID, key))
+}
+
+func (e *expvarStore) Update(ID string) error {
+	return e.count("update", e.inner.Update(ID))
+}
+
+func (e *expvarStore) Expire(ID string) error {
+	return e.count("expire", e.inner.Expire(ID))
+}
+
+func (e *expvarStore) Flush() error {
+	return e.count("flush", e.inner.Flush())
+}
+
+func (e *expvarStore) GC(lifeTime time.Duration, timeNow time.Time) {
+	e.vars.Add("gc", 1)
+	e.inner.GC(lifeTime, timeNow)
+}
@@ -0,0 +1,32 @@
+package session
+
+import (
+	"expvar"
+	"testing"
+)
+
+func Test_PublishExpvar(t *testing.T) {
+	m := NewMemoryStore(nil)
+	m.IDValidator = func(ID string) error { return nil }
+	s := PublishExpvar("session_test", m)
+	sid := s.GenerateID()
+	s.Set(sid, "key", "val")
+	s.Get(sid, "key")
+	s.Get(sid, "key")
+	s.Update("")
+
+	vars := expvar.Get("session_test").(*expvar.Map)
+	for name, want := range map[string]string{
+		"generate": "1",
+		"set":      "1",
+		"get":      "2",
+		"update":   "1",
+		"errors":   "1",
+		"sessions": "1",
+	} {
+		v := vars.Get(name)
+		if v == nil || v.String() != want {
+			t.Fatalf("%s should be %s, got %v", name, want, v)
+		}
+	}
+}
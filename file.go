@@ -2,133 +2,1581 @@
 package session
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const permission = 0775
 
+// defaultMaxIDLength is the file name limit of most file systems
+const defaultMaxIDLength = 255
+
 type file struct {
 	root          string
 	pathSeparator string
 	generateID    func() string
+
+	// Durable makes every write fsync the value file and its session
+	// directory before returning, so a successful Set survives a power loss.
+	// It costs one or two disk flushes per write, off by default
+	Durable bool
+
+	// IDValidator, if set, rejects malformed IDs in every method taking an ID
+	IDValidator func(ID string) error
+
+	// MaxKeysPerSession, if positive, caps the number of keys a session holds
+	MaxKeysPerSession int
+
+	// KeyNormalizer, if set, rewrites every key before it is used, to
+	// lowercase keys for instance, so keys spelt differently are the same
+	// key. Key prefixes are rewritten too. It must return the same key for a
+	// key it already rewrote, and should be set before the store is used
+	KeyNormalizer func(key string) string
+
+	// MaxListLength, if positive, caps the lists built by Append, the oldest
+	// items are dropped first
+	MaxListLength int
+
+	// MaxIDLength caps the length of generated IDs, which name directories,
+	// defaults to 255 bytes, the file name limit of most file systems
+	MaxIDLength int
+
+	// OnMissingSession tells what Set does on a session that does not exist
+	OnMissingSession MissingSession
+
+	// ExpireGrace, if positive, makes Expire move the session to
+	// root/.trash for ExpireGrace, during which Recover brings it back,
+	// before GC removes it. The expired sessions keep their disk space
+	// meanwhile, which MaxTotalBytes and Stats do not count
+	ExpireGrace time.Duration
+
+	// ArchiveAfter, if positive, makes GC replace the directory of a session
+	// idle for longer than ArchiveAfter with a gzipped tarball root/<id>.tar.gz,
+	// which saves inodes for huge numbers of idle but live sessions. Any
+	// operation on an archived session first extracts it, paying for the
+	// decompression, and the next GC archives it again once it is cold.
+	// ArchiveAfter should be shorter than the session lifetime
+	ArchiveAfter time.Duration
+
+	// SweepExpiredKeys makes GC also remove the key files expired by their
+	// TTL, see SetWithTTL. It lists every live session on each GC
+	SweepExpiredKeys bool
+
+	// MaxTotalBytes, if positive, caps the bytes of all the session files. A
+	// write going over fails with ErrStorageFull, or with EvictOnFull set
+	// first expires the least recently updated sessions until it fits. The
+	// usage is counted by a scan of the root on the first write, then kept
+	// up to date by the store, see Stats
+	MaxTotalBytes int64
+	EvictOnFull   bool
+
+	// filter knows the live sessions, see WithBloomFilter
+	filter *bloom
+
+	// cache keeps recently read values, see WithReadCache
+	cache *readCache
+
+	// gc remembers where a budgeted GC stopped
+	gc *fileGC
+
+	// usage counts the bytes of the session files, see MaxTotalBytes
+	usage *fileUsage
+
+	// index maps values to sessions, see WithIndex
+	index *valueIndex
+
+	// singleFile keeps a whole session in one file, see NewSingleFileStore
+	singleFile bool
+	locks      *sessionLocks
+
+	// churn counts the session rewrites of the single file layout, see
+	// NewCompactor
+	churn *sessionChurn
+
+	// flushing is held for reading by the writes and for writing by Flush,
+	// so Flush waits for the writes in flight
+	flushing *sync.RWMutex
+
+	// see Metrics
+	metrics *storeCounters
+}
+
+type fileGC struct {
+	last string
+	lock sync.Mutex
 }
 
-var _ SessionStore = file{}
+var (
+	_ SessionStore    = file{}
+	_ Pinger          = file{}
+	_ BudgetedGC      = file{}
+	_ Creator         = file{}
+	_ OptionsGC       = file{}
+	_ MetricsReporter = file{}
+)
 
+// NewFileStore stores sessions under rootPath, an empty pathSeparator
+// defaults to the separator of the OS. Paths are built with filepath.Join,
+// pathSeparator is only checked. A root written by an older version of the
+// store is migrated first, see RegisterMigration. It panics if
+// pathSeparator is not a separator of the OS, or rootPath can not be
+// created or migrated
 func NewFileStore(IDGenerator func() string, rootPath string, pathSeparator string) file {
+	if pathSeparator == "" {
+		pathSeparator = string(os.PathSeparator)
+	}
+	if pathSeparator != string(os.PathSeparator) && pathSeparator != "/" {
+		panic(fmt.Errorf("session: %q is not a path separator", pathSeparator))
+	}
 	if err := os.MkdirAll(rootPath, permission); err != nil {
 		panic(err)
 	}
 	if err := os.Chmod(rootPath, permission); err != nil {
 		panic(err)
 	}
+	if err := checkVersion(rootPath); err != nil {
+		panic(err)
+	}
 	if IDGenerator == nil {
 		IDGenerator = DefaultGenerator
 	}
-	return file{rootPath, pathSeparator, IDGenerator}
+	return file{root: rootPath, pathSeparator: pathSeparator, generateID: IDGenerator, gc: new(fileGC), locks: new(sessionLocks), usage: new(fileUsage), churn: newSessionChurn(), flushing: new(sync.RWMutex), metrics: new(storeCounters)}
+}
+
+// WithBloomFilter returns a copy of the store that keeps an in-memory bloom
+// filter of live session IDs, sized for capacity sessions, so Exists and Get
+// answer a definite miss without touching the filesystem.
+//
+// The filter only speeds up misses: about 1% of misses still hit the disk at
+// capacity, more once capacity is exceeded. It is rebuilt from the root here,
+// so the store must be the only writer of the root directory
+func (f file) WithBloomFilter(capacity int) file {
+	f.filter = newBloom(capacity)
+	if fis, err := ioutil.ReadDir(f.root); err == nil {
+		for _, fi := range fis {
+			if fi.IsDir() {
+				f.filter.add(fi.Name())
+			} else if ID, ok := archivedID(fi.Name()); ok {
+				f.filter.add(ID)
+			}
+		}
+	}
+	return f
 }
 
-func (f file) directoryPath(ID string) string {
-	return strings.Join([]string{
-		strings.TrimRight(f.root, f.pathSeparator),
-		strings.TrimLeft(ID, f.pathSeparator),
-	}, f.pathSeparator)
+// WithReadCache returns a copy of the store that keeps the last capacity
+// values read in memory, so reading a hot key again skips the disk.
+//
+// Writes through the store drop the keys they change from the cache, so the
+// cache is only consistent when this store is the only writer of the root,
+// in a single process. Values are shared with the cache, they must not be
+// modified once stored, and keys with a TTL are never cached
+func (f file) WithReadCache(capacity int) file {
+	f.cache = newReadCache(capacity)
+	return f
 }
 
-func (f file) filePath(ID, key string) string {
-	return strings.Join([]string{
-		strings.TrimRight(f.root, f.pathSeparator),
-		strings.TrimLeft(ID+f.pathSeparator+key, f.pathSeparator),
-	}, f.pathSeparator)
+// mayExist is false only if the session definitely does not exist
+func (f file) mayExist(ID string) bool {
+	return f.filter == nil || f.filter.mayContain(ID)
+}
+
+// forget removes an expired session from the filter
+func (f file) forget(ID string) {
+	if f.filter != nil {
+		f.filter.remove(ID)
+	}
+}
+
+// directoryPath is the directory of the session, IDs escaping the root,
+// naming the root itself or an entry starting with a dot, which are kept for
+// the store, .tags, .version and .trash for instance, are rejected with
+// ErrInvalidKey
+func (f file) directoryPath(ID string) (string, error) {
+	path := filepath.Join(f.root, ID)
+	if !within(f.root, path) {
+		return "", ErrInvalidKey
+	}
+	if rel, _ := filepath.Rel(f.root, path); strings.HasPrefix(rel, ".") {
+		return "", ErrInvalidKey
+	}
+	return path, nil
+}
+
+// filePath is the file of the key, named by encodeKey, the empty key is
+// rejected with ErrInvalidKey
+func (f file) filePath(ID, key string) (string, error) {
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return "", err
+	}
+	return keyPath(directory, key)
 }
 
+// keyPath is the file of the key in directory, see filePath
+func keyPath(directory, key string) (string, error) {
+	if key == "" {
+		return "", ErrInvalidKey
+	}
+	name, err := encodeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(directory, name), nil
+}
+
+// fileKey returns the key of a key file, a name encodeKey could not have
+// produced is returned as is
+func fileKey(name string) string {
+	key, err := decodeKey(name)
+	if err != nil {
+		return name
+	}
+	return key
+}
+
+// within reports whether path lies strictly inside base
+func within(base, path string) bool {
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// GenerateID returns an empty ID when the disk is full, see GenerateIDWithError
 func (f file) GenerateID() string {
-	for {
-		id := f.generateID()
-		directory := f.directoryPath(id)
+	id, err := f.GenerateIDWithError()
+	if err != nil {
+		log.Println(err)
+	}
+	return id
+}
+
+// GenerateIDWithError creates a session directory, retrying on collisions
+// up to maxCollisions times, then failing with ErrTooManyCollisions. A full
+// disk or quota is reported as ErrStorageFull, IDs no directory can be named
+// after as ErrInvalidKey, when empty or escaping the root, or ErrIDTooLong,
+// when longer than MaxIDLength, and other failures as they are
+func (f file) GenerateIDWithError() (string, error) {
+	return f.generateIDWithPrefix("")
+}
+
+// GenerateIDWithPrefix is GenerateIDWithError with prefix prepended to the
+// generated ID, a prefix holding a path separator is rejected with ErrInvalidKey
+func (f file) GenerateIDWithPrefix(prefix string) (string, error) {
+	if strings.ContainsAny(prefix, "/\\\x00"+f.pathSeparator) {
+		return "", ErrInvalidKey
+	}
+	return f.generateIDWithPrefix(prefix)
+}
+
+func (f file) generateIDWithPrefix(prefix string) (string, error) {
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	for collisions := 0; collisions < maxCollisions; {
+		id := prefix + f.generateID()
+		if err := f.checkID(id); err != nil {
+			return "", err
+		}
+		directory, err := f.directoryPath(id)
+		if err != nil {
+			return "", err
+		}
 		if err := os.Mkdir(directory, permission); err != nil {
-			log.Println(err)
+			if isStorageFull(err) {
+				return "", ErrStorageFull
+			}
+			if !os.IsExist(err) {
+				return "", err
+			}
+			collisions++
+			warnCollisions(collisions)
 			continue
 		}
 		if err := os.Chmod(directory, permission); err != nil {
-			log.Println(err)
+			os.Remove(directory)
+			return "", err
+		}
+		if f.ArchiveAfter > 0 && f.archived(id) {
+			os.Remove(directory)
+			collisions++
+			warnCollisions(collisions)
 			continue
 		}
-		return id
+		if f.filter != nil {
+			f.filter.add(id)
+		}
+		atomic.AddInt64(&f.metrics.created, 1)
+		return id, nil
 	}
+	return "", ErrTooManyCollisions
+}
+
+// Create writes the initial keys to a staging directory and renames it to
+// the session directory, so the session appears with all its keys or not at all
+func (f file) Create(initial map[string]interface{}) (string, error) {
+	initial = f.normalizeData(initial)
+	if f.MaxKeysPerSession > 0 && len(initial) > f.MaxKeysPerSession {
+		return "", ErrTooManyKeys
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	staging, err := ioutil.TempDir(f.root, ".create")
+	if err != nil {
+		if isStorageFull(err) {
+			return "", ErrStorageFull
+		}
+		return "", err
+	}
+	defer func() {
+		// the staged files were counted, unless the session took them
+		if f.tracking() {
+			f.track(-du(staging))
+		}
+		os.RemoveAll(staging)
+	}()
+	if err := os.Chmod(staging, permission); err != nil {
+		return "", err
+	}
+	if f.singleFile {
+		err = f.writeSessionIn(staging, initial, make(map[string]map[string]string), newVersion())
+	} else {
+		for key, val := range initial {
+			if err = f.writeFileIn(staging, key, marshalVersioned(val, nil, newVersion())); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := f.reserve("", 0); err != nil {
+		return "", err
+	}
+	for collisions := 1; collisions <= maxCollisions; collisions++ {
+		id := f.generateID()
+		if err := f.checkID(id); err != nil {
+			return "", err
+		}
+		directory, err := f.directoryPath(id)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(directory); err == nil {
+			warnCollisions(collisions)
+			continue
+		}
+		if err := os.Rename(staging, directory); err != nil {
+			if e, ok := err.(*os.LinkError); os.IsExist(err) || ok && isNotEmpty(e.Err) {
+				warnCollisions(collisions)
+				continue
+			}
+			return "", err
+		}
+		if f.filter != nil {
+			f.filter.add(id)
+		}
+		atomic.AddInt64(&f.metrics.created, 1)
+		if f.Durable {
+			return id, syncDir(f.root)
+		}
+		return id, nil
+	}
+	return "", ErrTooManyCollisions
+}
+
+// checkID rejects the IDs a generator should never return
+func (f file) checkID(ID string) error {
+	max := f.MaxIDLength
+	if max <= 0 {
+		max = defaultMaxIDLength
+	}
+	if ID == "" {
+		return ErrInvalidKey
+	}
+	if len(ID) > max {
+		return ErrIDTooLong
+	}
+	return nil
+}
+
+// isStorageFull reports whether err comes from a full disk or an exhausted quota
+func isStorageFull(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return isNoSpace(err)
+}
+
+// write the key file, fsync it and its directory if durable
+func (f file) writeFile(ID, key string, b []byte) error {
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return err
+	}
+	return f.writeFileIn(directory, key, b)
+}
+
+// writeFileIn writes the file of the key in directory, the directory of a
+// session or a staging directory
+func (f file) writeFileIn(directory, key string, b []byte) (err error) {
+	defer func() {
+		if isStorageFull(err) {
+			err = ErrStorageFull
+		}
+	}()
+	path, err := keyPath(directory, key)
+	if err != nil {
+		return err
+	}
+	if f.tracking() {
+		old := fileSize(path)
+		defer func() {
+			if err == nil {
+				f.track(int64(len(b)) - old)
+			}
+		}()
+	}
+	if !f.Durable {
+		return ioutil.WriteFile(path, b, permission)
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, permission)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(b); err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// refuse a new key once the session is full, updates are allowed
+func (f file) checkKeyLimit(ID, key string) error {
+	if f.MaxKeysPerSession <= 0 {
+		return nil
+	}
+	path, err := f.filePath(ID, key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	if len(names) >= f.MaxKeysPerSession {
+		return ErrTooManyKeys
+	}
+	return nil
 }
 
 // set value
 func (f file) Set(ID string, key string, val interface{}) error {
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
-		return nil
+		return ErrInvalidKey
 	}
-	return ioutil.WriteFile(f.filePath(ID, key), marshal(val), permission)
+	return f.storeValue(ID, key, val, nil)
 }
 
 // get value according to key
 func (f file) Get(ID string, key string) interface{} {
-	if ID == "" {
+	key = f.normalize(key)
+	if validateID(f.IDValidator, ID) != nil || ID == "" {
 		return nil
 	}
-	b, err := ioutil.ReadFile(f.filePath(ID, key))
+	atomic.AddInt64(&f.metrics.gets, 1)
+	val, _, _ := f.loadValue(ID, key)
+	return val
+}
+
+// get value, telling an absent key from a key holding nil
+func (f file) GetWithError(ID string, key string) (interface{}, error) {
+	atomic.AddInt64(&f.metrics.gets, 1)
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return nil, err
+	}
+	val, _, err := f.loadValue(ID, key)
+	return val, err
+}
+
+// loadValue reads a key in either layout
+func (f file) loadValue(ID, key string) (interface{}, map[string]string, error) {
+	if err := f.thaw(ID); err != nil {
+		return nil, nil, err
+	}
+	if f.cache != nil {
+		if val, meta, ok := f.cache.get(ID, key); ok {
+			atomic.AddInt64(&f.metrics.hits, 1)
+			return val, meta, nil
+		}
+		atomic.AddInt64(&f.metrics.misses, 1)
+	}
+	gen := f.cache.generation()
+	if f.singleFile {
+		values, metas, err := f.readSession(ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		val, ok := values[key]
+		if !ok {
+			return nil, nil, ErrKeyNotFound
+		}
+		f.cache.put(gen, ID, key, val, metas[key])
+		return val, metas[key], nil
+	}
+	b, ttl, err := f.readFileTTL(ID, key)
 	if err != nil {
+		return nil, nil, err
+	}
+	val, meta := unmarshalWithMeta(b)
+	if !ttl {
+		f.cache.put(gen, ID, key, val, meta)
+	}
+	return val, meta, nil
+}
+
+// storeValue writes a key in either layout, a nil meta drops the previous one
+func (f file) storeValue(ID, key string, val interface{}, meta map[string]string) error {
+	return f.storeValueUntil(ID, key, val, meta, time.Time{})
+}
+
+// storeValueUntil is storeValue giving the key a deadline unless it is
+// zero, see SetWithTTL
+func (f file) storeValueUntil(ID, key string, val interface{}, meta map[string]string, deadline time.Time) (err error) {
+	atomic.AddInt64(&f.metrics.sets, 1)
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(ID, key)
+	defer func() {
+		if err == nil {
+			f.index.set(ID, key, val)
+		}
+	}()
+	if err := f.thaw(ID); err != nil {
+		return err
+	}
+	if err := f.missing(ID); err != nil {
+		return err
+	}
+	b := marshalVersioned(val, meta, newVersion())
+	if f.MaxTotalBytes > 0 {
+		if err := f.reserve(ID, int64(len(b))); err != nil {
+			return err
+		}
+	}
+	if f.singleFile {
+		return f.modifySession(ID, func(values map[string]interface{}, metas map[string]map[string]string) error {
+			if _, ok := values[key]; !ok && f.MaxKeysPerSession > 0 && len(values) >= f.MaxKeysPerSession {
+				return ErrTooManyKeys
+			}
+			values[key] = val
+			if meta == nil {
+				delete(metas, key)
+			} else {
+				metas[key] = meta
+			}
+			return nil
+		})
+	}
+	if err := f.checkKeyLimit(ID, key); err != nil {
+		return err
+	}
+	if !deadline.IsZero() {
+		return f.writeFileUntil(ID, key, b, deadline)
+	}
+	if err := f.clearTTL(ID, key); err != nil {
+		return err
+	}
+	return f.writeFile(ID, key, b)
+}
+
+// missing applies OnMissingSession when the session does not exist
+func (f file) missing(ID string) error {
+	if f.OnMissingSession == MissingSessionDefault || f.Exists(ID) {
 		return nil
 	}
-	return unmarshal(b)
+	if f.OnMissingSession == MissingSessionError {
+		return ErrSessionNotFound
+	}
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(directory, permission); err != nil && !os.IsExist(err) {
+		if isStorageFull(err) {
+			return ErrStorageFull
+		}
+		return err
+	}
+	if err := os.Chmod(directory, permission); err != nil {
+		return err
+	}
+	if f.filter != nil {
+		f.filter.add(ID)
+	}
+	return nil
+}
+
+// removeKey deletes a key in either layout
+func (f file) removeKey(ID, key string) error {
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(ID, key)
+	if err := f.thaw(ID); err != nil {
+		return err
+	}
+	if f.singleFile {
+		err := f.modifySession(ID, func(values map[string]interface{}, metas map[string]map[string]string) error {
+			delete(values, key)
+			delete(metas, key)
+			return nil
+		})
+		if err == nil {
+			f.index.unset(ID, key)
+		}
+		return err
+	}
+	path, err := f.filePath(ID, key)
+	if err != nil {
+		return err
+	}
+	size := fileSize(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	f.track(-size)
+	f.index.unset(ID, key)
+	return nil
+}
+
+// listKeys lists the keys of a session in either layout
+func (f file) listKeys(ID string) ([]string, error) {
+	if ID == "" || !f.mayExist(ID) {
+		return nil, ErrSessionNotFound
+	}
+	if err := f.thaw(ID); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	if f.singleFile {
+		values, _, err := f.readSession(ID)
+		if err != nil {
+			return nil, err
+		}
+		for key := range values {
+			keys = append(keys, key)
+		}
+		return keys, nil
+	}
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(directory)
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			keys = append(keys, fileKey(fi.Name()))
+		}
+	}
+	return keys, nil
+}
+
+// read the key file, translating missing files to ErrSessionNotFound or ErrKeyNotFound
+func (f file) readFile(ID, key string) ([]byte, error) {
+	b, _, err := f.readFileTTL(ID, key)
+	return b, err
+}
+
+// readFileTTL is readFile also reporting whether the key has a TTL
+func (f file) readFileTTL(ID, key string) ([]byte, bool, error) {
+	if ID == "" || !f.mayExist(ID) {
+		return nil, false, ErrSessionNotFound
+	}
+	path, err := f.filePath(ID, key)
+	if err != nil {
+		return nil, false, err
+	}
+	b, ttl, err := readKeyFile(path)
+	if !os.IsNotExist(err) {
+		return b, ttl, err
+	}
+	if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+		return nil, false, ErrSessionNotFound
+	}
+	return nil, false, ErrKeyNotFound
+}
+
+// readKeyFile reads a key file, a key expired by its TTL is reported as a
+// missing file
+func readKeyFile(path string) (b []byte, ttl bool, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if expiredKey(info, time.Now()) {
+		return nil, false, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	b, err = ioutil.ReadAll(fd)
+	return b, info.Mode()&os.ModeSticky != 0, err
+}
+
+// set value along with its metadata
+func (f file) SetWithMeta(ID string, key string, val interface{}, meta map[string]string) error {
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
+	if ID == "" {
+		return ErrInvalidKey
+	}
+	return f.storeValue(ID, key, val, meta)
+}
+
+// get value along with the metadata it was set with
+func (f file) GetWithMeta(ID string, key string) (interface{}, map[string]string, error) {
+	atomic.AddInt64(&f.metrics.gets, 1)
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return nil, nil, err
+	}
+	return f.loadValue(ID, key)
+}
+
+// KeyModTime returns when the key was last written, the single file layout
+// only knows when the session file was last written
+func (f file) KeyModTime(ID string, key string) (modTime time.Time, err error) {
+	key = f.normalize(key)
+	if err = validateID(f.IDValidator, ID); err != nil {
+		return
+	}
+	if err = f.thaw(ID); err != nil {
+		return
+	}
+	if f.singleFile {
+		f.locks.withLock(ID, func() {
+			var values map[string]interface{}
+			if values, _, err = f.readSession(ID); err != nil {
+				return
+			}
+			if _, ok := values[key]; !ok {
+				err = ErrKeyNotFound
+				return
+			}
+			var path string
+			if path, err = f.filePath(ID, sessionFile); err != nil {
+				return
+			}
+			var info os.FileInfo
+			if info, err = os.Stat(path); err == nil {
+				modTime = info.ModTime()
+			}
+		})
+		return
+	}
+	if ID == "" || !f.mayExist(ID) {
+		return time.Time{}, ErrSessionNotFound
+	}
+	path, err := f.filePath(ID, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err == nil {
+		return info.ModTime(), nil
+	}
+	if !os.IsNotExist(err) {
+		return time.Time{}, err
+	}
+	if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+		return time.Time{}, ErrSessionNotFound
+	}
+	return time.Time{}, ErrKeyNotFound
 }
 
 // delete key
 func (f file) Delete(ID string, key string) error {
+	atomic.AddInt64(&f.metrics.deletes, 1)
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
 		return nil
 	}
-	return os.Remove(f.filePath(ID, key))
+	return f.removeKey(ID, key)
+}
+
+// list keys starting with prefix
+func (f file) KeysWithPrefix(ID string, prefix string) ([]string, error) {
+	prefix = f.normalize(prefix)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return nil, err
+	}
+	all, err := f.listKeys(ID)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, key := range all {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// delete keys starting with prefix
+func (f file) DeleteWithPrefix(ID string, prefix string) (int, error) {
+	prefix = f.normalize(prefix)
+	keys, err := f.KeysWithPrefix(ID, prefix)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, key := range keys {
+		if err := f.removeKey(ID, key); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// MoveKey moves a value, with its metadata, to another key of the same or
+// another session, overwriting the destination key. It is a rename within
+// the root, falling back to copy then delete across file systems
+func (f file) MoveKey(srcID, srcKey, dstID, dstKey string) (err error) {
+	srcKey, dstKey = f.normalize(srcKey), f.normalize(dstKey)
+	if err := validateID(f.IDValidator, srcID); err != nil {
+		return err
+	}
+	if err := validateID(f.IDValidator, dstID); err != nil {
+		return err
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(dstID, dstKey)
+	defer f.cache.invalidate(srcID, srcKey)
+	defer func() {
+		if err == nil {
+			f.index.unset(srcID, srcKey)
+			f.reindexKey(dstID, dstKey)
+		}
+	}()
+	if err := f.thaw(srcID); err != nil {
+		return err
+	}
+	if err := f.thaw(dstID); err != nil {
+		return err
+	}
+	if f.singleFile {
+		return f.moveSessionKey(srcID, srcKey, dstID, dstKey)
+	}
+	if _, err := f.readFile(srcID, srcKey); err != nil {
+		return err
+	}
+	src, err := f.filePath(srcID, srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := f.filePath(dstID, dstKey)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Dir(dst)); os.IsNotExist(err) {
+		return ErrSessionNotFound
+	}
+	if srcID != dstID {
+		if err := f.checkKeyLimit(dstID, dstKey); err != nil {
+			return err
+		}
+	}
+	// the file overwritten at the destination is no longer used
+	var overwritten int64
+	if f.tracking() && src != dst {
+		overwritten = fileSize(dst)
+	}
+	defer func() {
+		if err == nil {
+			f.track(-overwritten)
+		}
+	}()
+	err = os.Rename(src, dst)
+	if le, ok := err.(*os.LinkError); ok && isCrossDevice(le.Err) {
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := f.writeFile(dstID, dstKey, b); err != nil {
+			return err
+		}
+		if err := os.Remove(src); err != nil {
+			return err
+		}
+		f.track(-int64(len(b)))
+		return nil
+	}
+	return err
+}
+
+// RenameKey moves a value, with its metadata, to newKey of the same session.
+// It fails with ErrKeyExists when newKey is set, MoveKey overwrites it. The
+// key file is hard linked to its new name then unlinked, so the file system
+// must support hard links
+func (f file) RenameKey(ID, oldKey, newKey string) (err error) {
+	oldKey, newKey = f.normalize(oldKey), f.normalize(newKey)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(ID, oldKey, newKey)
+	defer func() {
+		if err == nil {
+			f.index.unset(ID, oldKey)
+			f.reindexKey(ID, newKey)
+		}
+	}()
+	if err := f.thaw(ID); err != nil {
+		return err
+	}
+	if f.singleFile {
+		return f.modifySession(ID, func(values map[string]interface{}, metas map[string]map[string]string) error {
+			val, ok := values[oldKey]
+			if !ok {
+				return ErrKeyNotFound
+			}
+			if _, ok := values[newKey]; ok {
+				return ErrKeyExists
+			}
+			values[newKey] = val
+			delete(values, oldKey)
+			if meta, ok := metas[oldKey]; ok {
+				metas[newKey] = meta
+				delete(metas, oldKey)
+			}
+			return nil
+		})
+	}
+	if _, err := f.readFile(ID, oldKey); err != nil {
+		return err
+	}
+	src, err := f.filePath(ID, oldKey)
+	if err != nil {
+		return err
+	}
+	dst, err := f.filePath(ID, newKey)
+	if err != nil {
+		return err
+	}
+	// unlike a rename, a link never replaces an existing file
+	if err := os.Link(src, dst); err != nil {
+		if os.IsExist(err) {
+			return ErrKeyExists
+		}
+		if os.IsNotExist(err) {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Patch replaces the value of key with what patch returns for the current
+// one, nil when the key is absent, under the lock of the session. The
+// metadata of the key is kept, its TTL dropped. Set does not take the lock
+// in the per key layout, so there Patch is only atomic against other Patch
+// calls. patch runs with the lock held, it must not block nor use the store.
+// It runs again on the value then current when EvictOnFull has to make room
+// for the result
+func (f file) Patch(ID, key string, patch func(current interface{}) interface{}) (err error) {
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(ID, key)
+	if err := f.thaw(ID); err != nil {
+		return err
+	}
+	var val interface{}
+	defer func() {
+		if err == nil {
+			f.index.set(ID, key, val)
+		}
+	}()
+	if f.singleFile {
+		return f.withRoom(ID, func(room func(n int64) error) error {
+			return f.modifySession(ID, func(values map[string]interface{}, metas map[string]map[string]string) error {
+				if _, ok := values[key]; !ok && f.MaxKeysPerSession > 0 && len(values) >= f.MaxKeysPerSession {
+					return ErrTooManyKeys
+				}
+				val = patch(values[key])
+				if err := room(int64(len(marshal(val)))); err != nil {
+					return err
+				}
+				values[key] = val
+				return nil
+			})
+		})
+	}
+	return f.withRoom(ID, func(room func(n int64) error) (err error) {
+		f.locks.withLock(ID, func() {
+			var current interface{}
+			var meta map[string]string
+			var b []byte
+			if b, err = f.readFile(ID, key); err == nil {
+				current, meta = unmarshalWithMeta(b)
+			} else if err != ErrKeyNotFound {
+				return
+			}
+			if err = f.checkKeyLimit(ID, key); err != nil {
+				return
+			}
+			val = patch(current)
+			b = marshalVersioned(val, meta, newVersion())
+			if err = room(int64(len(b))); err != nil {
+				return
+			}
+			if err = f.clearTTL(ID, key); err != nil {
+				return
+			}
+			err = f.writeFile(ID, key, b)
+		})
+		return
+	})
+}
+
+// GetOrSet returns the value of key, or stores and returns what compute
+// returns when the key is absent, under the lock of the session so compute
+// runs at most once however many callers race. As with Patch, Set does not
+// take the lock in the per key layout. compute must not block nor use the
+// store, an error of compute is returned and nothing is stored
+func (f file) GetOrSet(ID, key string, compute func() (interface{}, error)) (val interface{}, err error) {
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return nil, err
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(ID, key)
+	if err := f.thaw(ID); err != nil {
+		return nil, err
+	}
+	// the value computed is kept for the second run of withRoom
+	computed, stored := false, false
+	get := func() (err error) {
+		if !computed {
+			if val, err = compute(); err != nil {
+				return
+			}
+			computed = true
+		}
+		return
+	}
+	err = f.withRoom(ID, func(room func(n int64) error) (err error) {
+		f.locks.withLock(ID, func() {
+			if f.singleFile {
+				var values map[string]interface{}
+				var metas map[string]map[string]string
+				if values, metas, err = f.readSession(ID); err != nil {
+					return
+				}
+				var ok bool
+				if val, ok = values[key]; ok {
+					return
+				}
+				if f.MaxKeysPerSession > 0 && len(values) >= f.MaxKeysPerSession {
+					err = ErrTooManyKeys
+					return
+				}
+				if err = get(); err != nil {
+					return
+				}
+				if err = room(int64(len(marshal(val)))); err != nil {
+					return
+				}
+				values[key] = val
+				if err = f.writeSession(ID, values, metas); err == nil {
+					stored = true
+				}
+				return
+			}
+			var b []byte
+			if b, err = f.readFile(ID, key); err == nil {
+				val = unmarshal(b)
+				return
+			} else if err != ErrKeyNotFound {
+				return
+			}
+			if err = f.checkKeyLimit(ID, key); err != nil {
+				return
+			}
+			if err = get(); err != nil {
+				return
+			}
+			b = marshalVersioned(val, nil, newVersion())
+			if err = room(int64(len(b))); err != nil {
+				return
+			}
+			if err = f.writeFile(ID, key, b); err == nil {
+				stored = true
+			}
+		})
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stored {
+		f.index.set(ID, key, val)
+	}
+	return
 }
 
 // expire session
 func (f file) Expire(ID string) error {
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
 		return nil
 	}
-	return os.RemoveAll(f.directoryPath(ID))
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	return f.expire(ID)
+}
+
+// expire is Expire for the callers already holding f.flushing, which must
+// not be read locked twice as a waiting Flush would block the second lock
+func (f file) expire(ID string) error {
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return err
+	}
+	if f.ExpireGrace > 0 {
+		// the trash keeps plain directories
+		if err := f.thaw(ID); err != nil {
+			return err
+		}
+	}
+	// under the lock of the session, so of concurrent Expires only the one
+	// removing the session forgets it and counts its size
+	var existed bool
+	var size int64
+	f.locks.withLock(ID, func() {
+		_, serr := os.Stat(directory)
+		existed = serr == nil || f.archived(ID)
+		if f.tracking() {
+			size = du(directory) + fileSize(directory+archiveSuffix)
+		}
+		if err = os.Remove(directory + archiveSuffix); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		if f.ExpireGrace > 0 {
+			err = f.moveToTrash(ID, directory)
+		} else {
+			err = os.RemoveAll(directory)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if existed {
+		f.forget(ID)
+	}
+	f.track(-size)
+	f.untag(ID)
+	f.index.remove(ID)
+	f.cache.invalidateSession(ID)
+	return nil
+}
+
+// Exists reports whether the session exists
+func (f file) Exists(ID string) bool {
+	if validateID(f.IDValidator, ID) != nil || ID == "" || !f.mayExist(ID) {
+		return false
+	}
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(directory)
+	return err == nil || f.archived(ID)
+}
+
+// LastUpdate returns the modification time of the session directory, or of
+// its archive
+func (f file) LastUpdate(ID string) (time.Time, error) {
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return time.Time{}, err
+	}
+	if ID == "" || !f.mayExist(ID) {
+		return time.Time{}, ErrSessionNotFound
+	}
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(directory)
+	if os.IsNotExist(err) {
+		info, err = os.Stat(directory + archiveSuffix)
+	}
+	if os.IsNotExist(err) {
+		return time.Time{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
 }
 
 // change mtime and atime
 func (f file) Update(ID string) error {
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
 		return nil
 	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	if err := f.thaw(ID); err != nil {
+		return err
+	}
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return err
+	}
 	t := time.Now()
-	return os.Chtimes(f.directoryPath(ID), t, t)
+	return os.Chtimes(directory, t, t)
 }
 
-// Flush remove all session
+// UpdateIfStale updates the session only if it was not updated within
+// threshold, which saves the Chtimes of an Update for busy sessions.
+// updated tells whether it did
+func (f file) UpdateIfStale(ID string, threshold time.Duration) (updated bool, err error) {
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return false, err
+	}
+	if ID == "" {
+		return false, ErrSessionNotFound
+	}
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(directory)
+	if os.IsNotExist(err) && !f.archived(ID) {
+		return false, ErrSessionNotFound
+	}
+	// an archived session is cold, so stale
+	if err == nil && time.Since(info.ModTime()) < threshold {
+		return false, nil
+	}
+	if err := f.Update(ID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Renew marks the session as updated extend from now, so it outlives a plain
+// Update by extend. A negative extend fails with ErrNegativeExtend
+func (f file) Renew(ID string, extend time.Duration) error {
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
+	if extend < 0 {
+		return ErrNegativeExtend
+	}
+	return f.renewAt(ID, time.Now().Add(extend))
+}
+
+// renewAt sets the modification time of the session, in the past too
+func (f file) renewAt(ID string, at time.Time) error {
+	if ID == "" {
+		return ErrSessionNotFound
+	}
+	if err := f.thaw(ID); err != nil {
+		return err
+	}
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		return ErrSessionNotFound
+	}
+	return os.Chtimes(directory, at, at)
+}
+
+// Flush remove all session, with their tags, and empties the bloom filter,
+// the read cache, the value index and the usage and compaction counts. The
+// root directory and its version file are kept so the store stays usable.
+// It waits for the writes in flight, the writes started meanwhile wait for
+// it
 func (f file) Flush() error {
-	return os.RemoveAll(f.root)
+	f.flushing.Lock()
+	defer f.flushing.Unlock()
+	fis, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Name() == versionFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(f.root, fi.Name())); err != nil {
+			return err
+		}
+	}
+	if f.filter != nil {
+		f.filter.reset()
+	}
+	f.cache.reset()
+	f.resetUsage()
+	f.index.reset()
+	f.churn.clear()
+	f.gc.lock.Lock()
+	f.gc.last = ""
+	f.gc.lock.Unlock()
+	return nil
 }
 
 // GC removes all expired sessions
 func (f file) GC(lifeTime time.Duration, t time.Time) {
-	filepath.Walk(f.root,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				return nil
-			}
-			if path == f.root {
-				return nil
+	f.GCWithBudget(lifeTime, t, 0)
+}
+
+// GCWithBudget walks the sessions in name order, stopping once budget is
+// spent and resuming after the last walked session on the following call.
+// It also archives the cold sessions, see ArchiveAfter
+func (f file) GCWithBudget(lifeTime time.Duration, t time.Time, budget time.Duration) (collected, remaining int) {
+	return f.GCWithOptions(lifeTime, t, GCOptions{Budget: budget})
+}
+
+// GCWithOptions is GCWithBudget pausing after each batch of removed sessions
+func (f file) GCWithOptions(lifeTime time.Duration, t time.Time, options GCOptions) (collected, remaining int) {
+	budget := options.Budget
+	f.gc.lock.Lock()
+	defer f.gc.lock.Unlock()
+	defer func(start time.Time) {
+		atomic.AddInt64(&f.metrics.expired, int64(collected))
+		f.metrics.swept(start)
+	}(time.Now())
+	f.purgeTrash(t)
+
+	fis, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	start, first := time.Now(), 0
+	if budget > 0 {
+		first = sort.Search(len(fis), func(i int) bool { return fis[i].Name() > f.gc.last })
+	}
+	i := first
+	for ; i < len(fis); i++ {
+		// always walk one session so a tiny budget still makes progress
+		if budget > 0 && i > first && time.Since(start) > budget {
+			break
+		}
+		info := fis[i]
+		ID, archived := archivedID(info.Name())
+		if !archived {
+			ID = info.Name()
+		}
+		if !info.IsDir() && !archived {
+			continue
+		}
+		// temporary entries and tags, see Compact and Tag
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if !info.ModTime().Add(lifeTime).Before(t) {
+			if f.SweepExpiredKeys && info.IsDir() && !f.singleFile {
+				f.sweepKeys(info.Name(), t)
 			}
-			if info.ModTime().Add(lifeTime).Before(t) {
-				return os.RemoveAll(path)
+			if f.cold(info, t) {
+				if err := f.archive(ID); err != nil {
+					log.Println(err)
+				}
 			}
-			return nil
-		})
+			continue
+		}
+		if !f.collect(ID, filepath.Join(f.root, info.Name()), lifeTime, t) {
+			continue
+		}
+		f.forget(ID)
+		f.untag(ID)
+		f.index.remove(ID)
+		f.cache.invalidateSession(ID)
+		collected++
+		if options.BatchSize > 0 && collected%options.BatchSize == 0 {
+			time.Sleep(options.BatchPause)
+		}
+	}
+	if budget > 0 {
+		if remaining = len(fis) - i; remaining > 0 {
+			f.gc.last = fis[i-1].Name()
+		} else {
+			f.gc.last = ""
+		}
+	}
+	return
+}
+
+// collect removes the expired entry of the session under its lock, unless a
+// concurrent Expire removed it or an Update refreshed it since the root was
+// read. It reports whether the entry was removed
+func (f file) collect(ID, path string, lifeTime time.Duration, t time.Time) (removed bool) {
+	f.locks.withLock(ID, func() {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Add(lifeTime).Before(t) {
+			return
+		}
+		var size int64
+		if f.tracking() {
+			size = du(path)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Println(err)
+			return
+		}
+		f.track(-size)
+		removed = true
+	})
+	return
+}
+
+// ListByActivity returns at most limit sessions, most recently updated first
+func (f file) ListByActivity(limit int) ([]SessionInfo, error) {
+	fis, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SessionInfo, 0, len(fis))
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if fi.IsDir() {
+			infos = append(infos, SessionInfo{fi.Name(), fi.ModTime()})
+		} else if ID, ok := archivedID(fi.Name()); ok {
+			infos = append(infos, SessionInfo{ID, fi.ModTime()})
+		}
+	}
+	return sortByActivity(infos, limit), nil
+}
+
+// GCWhere expires the sessions, archived ones included, for which predicate
+// returns true, whatever their age. predicate is called with no lock held,
+// it should have no side effect
+func (f file) GCWhere(predicate func(ID string, lastUpdate time.Time) bool) (removed int, err error) {
+	infos, err := f.ListByActivity(0)
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range infos {
+		if !predicate(info.ID, info.LastUpdate) {
+			continue
+		}
+		if err := f.Expire(info.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// ExpireOlderThan expires the sessions last updated before cutoff, whatever
+// the lifetime, and returns how many it removed
+func (f file) ExpireOlderThan(cutoff time.Time) (removed int, err error) {
+	return f.GCWhere(func(ID string, lastUpdate time.Time) bool {
+		return lastUpdate.Before(cutoff)
+	})
+}
+
+// SessionsInAgeRange returns the sessions last updated between max and min
+// before now, min included, most recently updated first. It reads the
+// modification time of every session
+func (f file) SessionsInAgeRange(min, max time.Duration, now time.Time) ([]string, error) {
+	infos, err := f.ListByActivity(0)
+	if err != nil {
+		return nil, err
+	}
+	return inAgeRange(infos, min, max, now), nil
+}
+
+// SelfTest sets a value in a throwaway session, reads it back and expires
+// the session, which catches a root that is not writable or a broken codec
+func (f file) SelfTest() error {
+	return selfTest(f)
+}
+
+// Ping checks the root directory is writable
+func (f file) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(f.root, ".ping")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
 }
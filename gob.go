@@ -3,29 +3,146 @@ package session
 import (
 	"bytes"
 	"encoding/gob"
+	"reflect"
+	"sync"
 )
 
-const _KEY = "data"
+const (
+	_KEY     = "data"
+	_META    = "meta"
+	_VERSION = "version"
+)
+
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register(map[string]string{})
+	gob.Register(map[string]map[string]string{})
+}
+
+// registered caches the types already given to gob.Register, so encoding a
+// known type does not go through the lock of the gob registry
+var registered sync.Map
+
+// RegisterType registers the types of the examples with gob once, it should
+// be called at startup with every custom type stored. Unregistered types
+// are registered on their first encoding. Like gob.Register, it panics when
+// two types get the same name
+func RegisterType(examples ...interface{}) {
+	for _, example := range examples {
+		register(example)
+	}
+}
 
-func init() { gob.Register(map[string]interface{}{}) }
+func register(v interface{}) {
+	if v == nil {
+		return
+	}
+	t := reflect.TypeOf(v)
+	if _, ok := registered.Load(t); ok {
+		return
+	}
+	gob.Register(v)
+	registered.Store(t, struct{}{})
+}
 
 func marshal(d interface{}) []byte {
-	data := map[string]interface{}{_KEY: d}
-	gob.Register(d)
-	buf := bytes.NewBuffer(nil)
+	return encode(map[string]interface{}{_KEY: d})
+}
+
+// marshalWithMeta keeps meta next to the value, unmarshal still sees the value only
+func marshalWithMeta(d interface{}, meta map[string]string) []byte {
+	return encode(map[string]interface{}{_KEY: d, _META: meta})
+}
+
+// marshalVersioned is marshalWithMeta also stamping the version of the
+// value, see GetVersioned, a nil meta is left out
+func marshalVersioned(d interface{}, meta map[string]string, version uint64) []byte {
+	v := map[string]interface{}{_KEY: d, _VERSION: version}
+	if meta != nil {
+		v[_META] = meta
+	}
+	return encode(v)
+}
+
+// unmarshalVersioned returns the value and version of a key file, see
+// versionOf
+func unmarshalVersioned(b []byte) (interface{}, uint64) {
+	if isList(b) {
+		return decodeList(b), unversioned
+	}
+	v := decode(b)
+	return v[_KEY], versionOf(v)
+}
+
+// buffers reused by encode, only buffers are pooled: a gob encoder sends the
+// type of a value only once per stream, so a reused encoder would produce
+// payloads that can not be decoded on their own
+var buffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// marshalSession encodes a whole session for the single file layout, a
+// zero version is left out
+func marshalSession(values map[string]interface{}, metas map[string]map[string]string, version uint64) []byte {
+	for _, val := range values {
+		register(val)
+	}
+	v := map[string]interface{}{_KEY: values, _META: metas}
+	if version != 0 {
+		v[_VERSION] = version
+	}
+	return encode(v)
+}
+
+func unmarshalSession(b []byte) (map[string]interface{}, map[string]map[string]string) {
+	values, metas, _ := unmarshalVersionedSession(b)
+	return values, metas
+}
+
+func unmarshalVersionedSession(b []byte) (map[string]interface{}, map[string]map[string]string, uint64) {
+	v := decode(b)
+	values, _ := v[_KEY].(map[string]interface{})
+	metas, _ := v[_META].(map[string]map[string]string)
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	if metas == nil {
+		metas = make(map[string]map[string]string)
+	}
+	return values, metas, versionOf(v)
+}
+
+func encode(data map[string]interface{}) []byte {
+	register(data[_KEY])
+	buf := buffers.Get().(*bytes.Buffer)
+	defer buffers.Put(buf)
+	buf.Reset()
 	enc := gob.NewEncoder(buf)
 	if err := enc.Encode(data); err != nil {
 		panic(err)
 	}
-	return buf.Bytes()
+	return append([]byte(nil), buf.Bytes()...)
 }
 
 func unmarshal(b []byte) interface{} {
-	buf := bytes.NewBuffer(b)
-	dec := gob.NewDecoder(buf)
+	if isList(b) {
+		return decodeList(b)
+	}
+	return decode(b)[_KEY]
+}
+
+func unmarshalWithMeta(b []byte) (interface{}, map[string]string) {
+	if isList(b) {
+		return decodeList(b), nil
+	}
+	v := decode(b)
+	meta, _ := v[_META].(map[string]string)
+	return v[_KEY], meta
+}
+
+func decode(b []byte) map[string]interface{} {
+	dec := gob.NewDecoder(bytes.NewReader(b))
 	var v = make(map[string]interface{})
 	if err := dec.Decode(&v); err != nil {
 		panic(err)
 	}
-	return v[_KEY]
+	return v
 }
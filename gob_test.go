@@ -0,0 +1,36 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Benchmark_Marshal(b *testing.B) {
+	b.ReportAllocs()
+	val := map[string]interface{}{"name": "gopher", "age": 5}
+	for i := 0; i < b.N; i++ {
+		marshal(val)
+	}
+}
+
+func Benchmark_Unmarshal(b *testing.B) {
+	b.ReportAllocs()
+	data := marshal(map[string]interface{}{"name": "gopher", "age": 5})
+	for i := 0; i < b.N; i++ {
+		unmarshal(data)
+	}
+}
+
+type gobPoint struct {
+	X, Y int
+}
+
+func Test_RegisterType(t *testing.T) {
+	RegisterType(gobPoint{}, nil)
+	if _, ok := registered.Load(reflect.TypeOf(gobPoint{})); !ok {
+		t.Fatal("the type should be cached once registered")
+	}
+	if unmarshal(marshal(gobPoint{1, 2})).(gobPoint) != (gobPoint{1, 2}) {
+		t.Fatal("a registered type should round-trip")
+	}
+}
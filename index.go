@@ -0,0 +1,244 @@
+// secondary index on the values of chosen keys
+package session
+
+import (
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// indexEntry is an indexed key and one of its values
+type indexEntry struct {
+	key string
+	val interface{}
+}
+
+// valueIndex maps the values of the indexed keys to their sessions and back.
+// Values are compared with ==, so 1 and int64(1) are different values, and
+// values that are not comparable, such as slices and maps, are not indexed.
+// A nil index indexes nothing
+type valueIndex struct {
+	// keys is set once on creation and only read afterwards
+	keys map[string]bool
+	ids  map[indexEntry]map[string]struct{}
+	of   map[string]map[string]interface{}
+	lock sync.RWMutex
+}
+
+func newValueIndex(keys ...string) *valueIndex {
+	x := &valueIndex{
+		keys: make(map[string]bool, len(keys)),
+		ids:  make(map[indexEntry]map[string]struct{}),
+		of:   make(map[string]map[string]interface{}),
+	}
+	for _, key := range keys {
+		x.keys[key] = true
+	}
+	return x
+}
+
+func (x *valueIndex) indexed(key string) bool {
+	return x != nil && x.keys[key]
+}
+
+// indexable tells whether val can be a map key, a comparable type may still
+// hold a slice or a map in an interface field, which panics once hashed
+func indexable(val interface{}) (ok bool) {
+	if val == nil {
+		return true
+	}
+	if !reflect.TypeOf(val).Comparable() {
+		return false
+	}
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return val == val
+}
+
+// set indexes the value of the key of the session, replacing the previous one
+func (x *valueIndex) set(ID, key string, val interface{}) {
+	if !x.indexed(key) {
+		return
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.unindex(ID, key)
+	if !indexable(val) {
+		return
+	}
+	if x.of[ID] == nil {
+		x.of[ID] = make(map[string]interface{})
+	}
+	x.of[ID][key] = val
+	e := indexEntry{key, val}
+	if x.ids[e] == nil {
+		x.ids[e] = make(map[string]struct{})
+	}
+	x.ids[e][ID] = struct{}{}
+}
+
+// setAll indexes the values of the indexed keys of a session
+func (x *valueIndex) setAll(ID string, data map[string]interface{}) {
+	if x == nil {
+		return
+	}
+	for key := range x.keys {
+		if val, ok := data[key]; ok {
+			x.set(ID, key, val)
+		}
+	}
+}
+
+// unset drops the value of the key of the session
+func (x *valueIndex) unset(ID, key string) {
+	if !x.indexed(key) {
+		return
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.unindex(ID, key)
+}
+
+func (x *valueIndex) unindex(ID, key string) {
+	val, ok := x.of[ID][key]
+	if !ok {
+		return
+	}
+	delete(x.of[ID], key)
+	if len(x.of[ID]) == 0 {
+		delete(x.of, ID)
+	}
+	e := indexEntry{key, val}
+	delete(x.ids[e], ID)
+	if len(x.ids[e]) == 0 {
+		delete(x.ids, e)
+	}
+}
+
+// find returns the sessions whose key holds val, sorted
+func (x *valueIndex) find(key string, val interface{}) ([]string, error) {
+	if !x.indexed(key) || !indexable(val) {
+		return nil, ErrNotIndexed
+	}
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	e := indexEntry{key, val}
+	IDs := make([]string, 0, len(x.ids[e]))
+	for ID := range x.ids[e] {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+	return IDs, nil
+}
+
+// remove drops the indexed values of the sessions
+func (x *valueIndex) remove(IDs ...string) {
+	if x == nil {
+		return
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for _, ID := range IDs {
+		for key := range x.of[ID] {
+			x.unindex(ID, key)
+		}
+	}
+}
+
+func (x *valueIndex) reset() {
+	if x == nil {
+		return
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.ids = make(map[indexEntry]map[string]struct{})
+	x.of = make(map[string]map[string]interface{})
+}
+
+// IndexKeys makes the store keep a reverse index from the values of keys to
+// the sessions holding them, see FindByValue. It should be called before
+// the store is used
+func (m *memory) IndexKeys(keys ...string) {
+	m.index = newValueIndex(m.normalizeAll(keys)...)
+}
+
+// FindByValue returns the sessions whose key holds val, sorted. It fails
+// with ErrNotIndexed if the key is not indexed, see IndexKeys, or val is not
+// comparable
+func (m *memory) FindByValue(key string, val interface{}) ([]string, error) {
+	return m.index.find(m.normalize(key), val)
+}
+
+// WithIndex returns a copy of the store that keeps a reverse index from the
+// values of keys to the sessions holding them, see FindByValue. The index is
+// rebuilt from the root here, archived sessions are left out until their
+// key is set again.
+//
+// The index lives in memory and only sees the values written by Set and
+// SetWithMeta through this store, so it is only complete when this store is
+// the only writer of the root, in a single process. Values moved, renamed,
+// patched or merged in through this store are indexed as they are written
+func (f file) WithIndex(keys ...string) file {
+	keys = f.normalizeAll(keys)
+	f.index = newValueIndex(keys...)
+	fis, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return f
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		for _, key := range keys {
+			if val, _, err := f.loadValue(fi.Name(), key); err == nil {
+				f.index.set(fi.Name(), key, val)
+			}
+		}
+	}
+	return f
+}
+
+// reindex indexes the values of a session put back, see Recover
+func (f file) reindex(ID string) {
+	if f.index == nil {
+		return
+	}
+	for key := range f.index.keys {
+		if val, _, err := f.loadValue(ID, key); err == nil {
+			f.index.set(ID, key, val)
+		}
+	}
+}
+
+// reindexKey indexes the value the key of the session holds once written
+// behind storeValue, by a rename for instance
+func (f file) reindexKey(ID, key string) {
+	if !f.index.indexed(key) {
+		return
+	}
+	if val, _, err := f.loadValue(ID, key); err == nil {
+		f.index.set(ID, key, val)
+	}
+}
+
+// FindByValue returns the sessions whose key holds val, sorted. It fails
+// with ErrNotIndexed if the key is not indexed, see WithIndex, or val is not
+// comparable. Sessions removed behind the back of the store are left out
+func (f file) FindByValue(key string, val interface{}) ([]string, error) {
+	IDs, err := f.index.find(f.normalize(key), val)
+	if err != nil {
+		return nil, err
+	}
+	live := IDs[:0]
+	for _, ID := range IDs {
+		if f.Exists(ID) {
+			live = append(live, ID)
+		}
+	}
+	return live, nil
+}
@@ -0,0 +1,130 @@
+// key encrypting store
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var _ SessionStore = new(keyEncrypting)
+
+// keyEncrypting encrypts key names before they reach the inner store, so
+// file names or hash fields do not reveal what a session holds.
+//
+// The encryption is deterministic: the IV is an HMAC of the key name, which
+// lets Get find a key again and lets key listing decrypt back to the original
+// names. The flip side is that equal key names give equal stored names, so an
+// observer can still tell two sessions hold the same key, just not which one.
+// Encrypted names are about 4/3 of (16 + len(key)) bytes, keep keys short
+// enough for the file system name limit
+type keyEncrypting struct {
+	inner  SessionStore
+	block  cipher.Block
+	macKey []byte
+}
+
+// NewKeyEncryptingStore wraps inner, deriving the cipher and HMAC keys from secret
+func NewKeyEncryptingStore(inner SessionStore, secret []byte) *keyEncrypting {
+	block, err := aes.NewCipher(derive(secret, "session key encryption"))
+	if err != nil {
+		panic(err)
+	}
+	return &keyEncrypting{inner, block, derive(secret, "session key authentication")}
+}
+
+func derive(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (k *keyEncrypting) iv(key string) []byte {
+	mac := hmac.New(sha256.New, k.macKey)
+	mac.Write([]byte(key))
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+func (k *keyEncrypting) encrypt(key string) string {
+	iv := k.iv(key)
+	b := make([]byte, aes.BlockSize+len(key))
+	copy(b, iv)
+	cipher.NewCTR(k.block, iv).XORKeyStream(b[aes.BlockSize:], []byte(key))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (k *keyEncrypting) decrypt(name string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(b) < aes.BlockSize {
+		return "", fmt.Errorf("session: %q is not an encrypted key", name)
+	}
+	iv, key := b[:aes.BlockSize], make([]byte, len(b)-aes.BlockSize)
+	cipher.NewCTR(k.block, iv).XORKeyStream(key, b[aes.BlockSize:])
+	if !hmac.Equal(iv, k.iv(string(key))) {
+		return "", fmt.Errorf("session: %q is not an encrypted key", name)
+	}
+	return string(key), nil
+}
+
+func (k *keyEncrypting) GenerateID() string {
+	return k.inner.GenerateID()
+}
+
+func (k *keyEncrypting) Set(ID string, key string, val interface{}) error {
+	return k.inner.Set(ID, k.encrypt(key), val)
+}
+
+func (k *keyEncrypting) Get(ID string, key string) interface{} {
+	return k.inner.Get(ID, k.encrypt(key))
+}
+
+func (k *keyEncrypting) Delete(ID string, key string) error {
+	return k.inner.Delete(ID, k.encrypt(key))
+}
+
+func (k *keyEncrypting) Update(ID string) error {
+	return k.inner.Update(ID)
+}
+
+func (k *keyEncrypting) Expire(ID string) error {
+	return k.inner.Expire(ID)
+}
+
+func (k *keyEncrypting) Flush() error {
+	return k.inner.Flush()
+}
+
+func (k *keyEncrypting) GC(lifeTime time.Duration, timeNow time.Time) {
+	k.inner.GC(lifeTime, timeNow)
+}
+
+// KeysWithPrefix returns the original names of the keys starting with prefix,
+// the inner store must support KeysWithPrefix
+func (k *keyEncrypting) KeysWithPrefix(ID string, prefix string) ([]string, error) {
+	lister, ok := k.inner.(interface {
+		KeysWithPrefix(ID string, prefix string) ([]string, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("session: %T can not list keys", k.inner)
+	}
+	names, err := lister.KeysWithPrefix(ID, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		key, err := k.decrypt(name)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,47 @@
+package session
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_KeyEncryptingStore(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	k := NewKeyEncryptingStore(f, []byte("secret"))
+	sid := k.GenerateID()
+	if err := k.Set(sid, "credit_card_last4", "4242"); err != nil {
+		t.Fatal(err)
+	}
+	if k.Get(sid, "credit_card_last4").(string) != "4242" {
+		t.Fatal("should be 4242")
+	}
+
+	directory, _ := f.directoryPath(sid)
+	fis, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if strings.Contains(fi.Name(), "credit") {
+			t.Fatalf("file name %q leaks the key", fi.Name())
+		}
+	}
+
+	keys, err := k.KeysWithPrefix(sid, "credit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "credit_card_last4" {
+		t.Fatalf("keys should be decrypted but get %v", keys)
+	}
+
+	other := NewKeyEncryptingStore(f, []byte("other"))
+	if other.Get(sid, "credit_card_last4") != nil {
+		t.Fatal("a different secret should not find the key")
+	}
+	if _, err := other.KeysWithPrefix(sid, ""); err == nil {
+		t.Fatal("a different secret should not decrypt the keys")
+	}
+	k.Flush()
+}
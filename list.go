@@ -0,0 +1,280 @@
+// append-only list values
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// A list key file starts with listTag, which no gob message starts with,
+// then the number of items ever appended and the number of items dropped
+// from the front, both big endian, then one record per item. Appending
+// writes the records at the end and rewrites the header only
+const (
+	listTag        = 0
+	listHeaderSize = 17
+)
+
+func isList(b []byte) bool {
+	return len(b) > 0 && b[0] == listTag
+}
+
+func listHeader(appended, dropped int) []byte {
+	b := make([]byte, listHeaderSize)
+	b[0] = listTag
+	binary.BigEndian.PutUint64(b[1:], uint64(appended))
+	binary.BigEndian.PutUint64(b[9:], uint64(dropped))
+	return b
+}
+
+func listRecords(items []interface{}) []byte {
+	var buf bytes.Buffer
+	for _, item := range items {
+		writeRecord(&buf, marshal(item))
+	}
+	return buf.Bytes()
+}
+
+// encodeList encodes a list file holding items
+func encodeList(items []interface{}) []byte {
+	return append(listHeader(len(items), 0), listRecords(items)...)
+}
+
+// decodeList returns the items of a list file not dropped yet, it panics on
+// a corrupt file like decode
+func decodeList(b []byte) []interface{} {
+	if len(b) < listHeaderSize {
+		panic(io.ErrUnexpectedEOF)
+	}
+	dropped := int(binary.BigEndian.Uint64(b[9:]))
+	r := bufio.NewReader(bytes.NewReader(b[listHeaderSize:]))
+	items := []interface{}{}
+	for i := 0; ; i++ {
+		record, err := readRecord(r)
+		if err == io.EOF {
+			return items
+		}
+		if err != nil {
+			panic(err)
+		}
+		if i >= dropped {
+			items = append(items, unmarshal(record))
+		}
+	}
+}
+
+// appendList appends items to the current value of a key, nil when the key
+// is absent, keeping at most max items when max is positive
+func appendList(current interface{}, items []interface{}, max int) ([]interface{}, error) {
+	list, ok := current.([]interface{})
+	if !ok && current != nil {
+		return nil, ErrNotList
+	}
+	list = append(list, items...)
+	if max > 0 && len(list) > max {
+		list = list[len(list)-max:]
+	}
+	return list, nil
+}
+
+// Append adds items at the end of the list held by key, creating it when
+// the key is absent, and returns the new length. The list is trimmed from
+// the front to MaxListLength. A key set to a []interface{} is a list, any
+// other value fails with ErrNotList. Get and GetList return the list as a
+// []interface{}, which must not be modified
+func (m *memory) Append(ID, key string, items ...interface{}) (newLen int, err error) {
+	atomic.AddInt64(&m.metrics.sets, 1)
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return 0, err
+	}
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if err = m.checkKeyLimit(d, key); err != nil {
+			return
+		}
+		var list []interface{}
+		if list, err = appendList(d.data[key], items, m.MaxListLength); err != nil {
+			return
+		}
+		m.put(d, key, list)
+		delete(d.meta, key)
+		newLen = len(list)
+	})
+	if err == nil {
+		m.access(ID)
+		m.grown()
+		m.watchers.notify(ID, key, OpSet)
+	}
+	return
+}
+
+// GetList returns a copy of the list held by key
+func (m *memory) GetList(ID, key string) ([]interface{}, error) {
+	key = m.normalize(key)
+	val, err := m.GetWithError(ID, key)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, ErrNotList
+	}
+	return append([]interface{}(nil), list...), nil
+}
+
+// Append adds items at the end of the list held by key, creating it when
+// the key is absent, and returns the new length. The list is trimmed from
+// the front to MaxListLength. A key set to a []interface{} is a list, any
+// other value fails with ErrNotList.
+//
+// In the per key layout the items are appended to the key file, which is
+// only rewritten once the dropped items outnumber the kept ones, so appends
+// do not read the list. The single file layout rewrites the session
+func (f file) Append(ID, key string, items ...interface{}) (newLen int, err error) {
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return 0, err
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(ID, key)
+	defer func() {
+		if err == nil {
+			f.index.unset(ID, key)
+		}
+	}()
+	if err := f.thaw(ID); err != nil {
+		return 0, err
+	}
+	records := listRecords(items)
+	if err := f.reserve(ID, int64(len(records)+listHeaderSize)); err != nil {
+		return 0, err
+	}
+	if f.singleFile {
+		err = f.modifySession(ID, func(values map[string]interface{}, metas map[string]map[string]string) error {
+			if _, ok := values[key]; !ok && f.MaxKeysPerSession > 0 && len(values) >= f.MaxKeysPerSession {
+				return ErrTooManyKeys
+			}
+			list, err := appendList(values[key], items, f.MaxListLength)
+			if err != nil {
+				return err
+			}
+			values[key] = list
+			delete(metas, key)
+			newLen = len(list)
+			return nil
+		})
+		return
+	}
+	f.locks.withLock(ID, func() {
+		newLen, err = f.appendFile(ID, key, items, records)
+	})
+	if isStorageFull(err) {
+		err = ErrStorageFull
+	}
+	return
+}
+
+// appendFile appends the records of items to the list file of the key,
+// under the lock of the session
+func (f file) appendFile(ID, key string, items []interface{}, records []byte) (int, error) {
+	path, err := f.filePath(ID, key)
+	if err != nil {
+		return 0, err
+	}
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return 0, ErrSessionNotFound
+		}
+		return f.rewriteList(ID, key, nil, items)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	header := make([]byte, listHeaderSize)
+	if _, err := io.ReadFull(fd, header); err != nil || !isList(header) {
+		// a value set by Set, converted if it is a list
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		return f.rewriteList(ID, key, unmarshal(b), items)
+	}
+	appended := int(binary.BigEndian.Uint64(header[1:])) + len(items)
+	dropped := int(binary.BigEndian.Uint64(header[9:]))
+	if max := f.MaxListLength; max > 0 && appended-dropped > max {
+		dropped = appended - max
+	}
+	if dropped > appended-dropped {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		return f.rewriteList(ID, key, decodeList(b), items)
+	}
+	if _, err := fd.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	if _, err := fd.Write(records); err != nil {
+		return 0, err
+	}
+	f.track(int64(len(records)))
+	if _, err := fd.WriteAt(listHeader(appended, dropped), 0); err != nil {
+		return 0, err
+	}
+	if f.Durable {
+		if err := fd.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return appended - dropped, nil
+}
+
+// rewriteList writes a list file holding the current value of the key and
+// items
+func (f file) rewriteList(ID, key string, current interface{}, items []interface{}) (int, error) {
+	list, err := appendList(current, items, f.MaxListLength)
+	if err != nil {
+		return 0, err
+	}
+	if current == nil {
+		if err := f.checkKeyLimit(ID, key); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.clearTTL(ID, key); err != nil {
+		return 0, err
+	}
+	if err := f.writeFile(ID, key, encodeList(list)); err != nil {
+		return 0, err
+	}
+	return len(list), nil
+}
+
+// GetList returns the list held by key
+func (f file) GetList(ID, key string) ([]interface{}, error) {
+	key = f.normalize(key)
+	val, err := f.GetWithError(ID, key)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, ErrNotList
+	}
+	return append([]interface{}(nil), list...), nil
+}
@@ -72,6 +72,39 @@ func (l *lru) remove(ks ...interface{}) {
 	})
 }
 
+// front returns the key of the least recently put item
+//
+func (l *lru) front() (k interface{}, ok bool) {
+	l.withLock(func() {
+		if e := l.l.Front(); e != nil {
+			k, ok = e.Value.(element).key, true
+		}
+	})
+	return
+}
+
+// get returns the value of k and moves it to back
+//
+func (l *lru) get(k interface{}) (v interface{}, ok bool) {
+	l.withLock(func() {
+		var e *list.Element
+		if e, ok = l.cache[k]; ok {
+			v = e.Value.(element).val
+			l.l.MoveToBack(e)
+		}
+	})
+	return
+}
+
+// contains reports whether k is in the lru
+//
+func (l *lru) contains(k interface{}) (ok bool) {
+	l.withLock(func() {
+		_, ok = l.cache[k]
+	})
+	return
+}
+
 // iterate lru, from front to back, find expired items
 //
 func (l *lru) findExpiredItems(isExpired func(value interface{}) bool) []interface{} {
@@ -2,134 +2,1258 @@
 package session
 
 import (
-	"fmt"
+	"context"
+	"hash/fnv"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var _ SessionStore = new(memory)
+var (
+	_ SessionStore = new(memory)
+	_ Pinger       = new(memory)
+	_ BudgetedGC   = new(memory)
+	_ Creator      = new(memory)
+	_ OptionsGC    = new(memory)
+)
 
 type memoryElement struct {
+	// id is the session, for the index of IndexKeys
+	id         string
 	data       map[string]interface{}
+	meta       map[string]map[string]string
 	lastUpdate time.Time
+
+	// modTimes is when each key was last written
+	modTimes map[string]time.Time
+
+	// versions is the version of each key, see GetVersioned
+	versions map[string]uint64
+
+	// bytes is the estimated size of the keys and values
+	bytes int64
+}
+
+// memoryShards is the number of buckets the sessions are spread over, so
+// operations on different sessions rarely contend for the same lock
+const memoryShards = 32
+
+type memoryShard struct {
+	data map[string]*memoryElement
+	rwl  sync.RWMutex
 }
 
 type memory struct {
-	data       map[string]*memoryElement
+	// size is the number of sessions, kept with atomic operations
+	// first in the struct to be 64-bit aligned
+	size int64
+	// bytes is the estimated size of all keys and values, see Stats
+	bytes int64
+	// collisions is the number of generated IDs already taken, see Stats
+	collisions int64
+	// version is the last version given to a written key, see GetVersioned
+	version uint64
+	// drained is set once Drain starts, the store is read-only from then on
+	drained int32
+
+	shards     [memoryShards]*memoryShard
 	generateID func() string
-	rwl        sync.RWMutex
+
+	// Reserver, if set, is asked to reserve every generated ID before it is
+	// used. The default only checks the sessions of this store, so the IDs
+	// are unique within the process only
+	Reserver IDReserver
+
+	// IDValidator, if set, rejects malformed IDs in every method taking an ID
+	IDValidator func(ID string) error
+
+	// MaxKeysPerSession, if positive, caps the number of keys a session holds
+	MaxKeysPerSession int
+
+	// KeyNormalizer, if set, rewrites every key before it is used, to
+	// lowercase keys for instance, so keys spelt differently are the same
+	// key. Key prefixes are rewritten too. It must return the same key for a
+	// key it already rewrote, and should be set before the store is used
+	KeyNormalizer func(key string) string
+
+	// MaxListLength, if positive, caps the lists built by Append, the oldest
+	// items are dropped first
+	MaxListLength int
+
+	// SizeOf, if set, replaces the estimate of the bytes a key and its value
+	// use, it must return the same size for the same key and value
+	SizeOf func(key string, val interface{}) int
+
+	// OnMissingSession tells what Set does on a session that does not exist
+	OnMissingSession MissingSession
+
+	// ExpireGrace, if positive, makes Expire keep the session aside for
+	// ExpireGrace, during which Recover brings it back, before GC drops it.
+	// The memory of the expired sessions is held meanwhile
+	ExpireGrace time.Duration
+	trash       *sessionTrash
+
+	// see GCOnThreshold
+	gcThreshold int64
+	gcLifeTime  time.Duration
+	gcRunning   int32
+
+	// gcCursor is the shard a budgeted GC resumes from
+	gcCursor int
+	gcLock   sync.Mutex
+
+	// see SetMaxSessions and SetMaxBytes
+	maxSessions int64
+	maxBytes    int64
+	eviction    EvictionPolicy
+	evictLock   sync.Mutex
+
+	// OnEvict, if set, gets the data of each session evicted by the caps of
+	// SetMaxSessions and SetMaxBytes, not of those expired or collected. It is called with
+	// no lock held, once the data is no longer in the store
+	OnEvict func(ID string, data map[string]interface{})
+
+	watchers *watchers
+
+	// see Tag
+	tags *tagIndex
+
+	// see IndexKeys
+	index *valueIndex
+
+	// see Metrics
+	metrics *storeCounters
 }
 
 func NewMemoryStore(IDGenerator func() string) *memory {
 	if IDGenerator == nil {
 		IDGenerator = DefaultGenerator
 	}
-	return &memory{make(map[string]*memoryElement), IDGenerator, sync.RWMutex{}}
+	m := &memory{generateID: IDGenerator, watchers: newWatchers(), tags: newTagIndex(), trash: newSessionTrash(), metrics: new(storeCounters)}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{data: make(map[string]*memoryElement)}
+	}
+	return m
 }
 
-func (m *memory) withReadLock(f func()) {
-	m.rwl.RLock()
-	defer m.rwl.RUnlock()
+func shardIndex(ID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(ID))
+	return int(h.Sum32() % memoryShards)
+}
+
+// shard returns the bucket holding the session
+func (m *memory) shard(ID string) *memoryShard {
+	return m.shards[shardIndex(ID)]
+}
+
+// withWriteLocks locks the buckets of both sessions, always in bucket order
+// so concurrent callers can not deadlock
+func (m *memory) withWriteLocks(ID1, ID2 string, f func()) {
+	i, j := shardIndex(ID1), shardIndex(ID2)
+	if i > j {
+		i, j = j, i
+	}
+	m.shards[i].rwl.Lock()
+	defer m.shards[i].rwl.Unlock()
+	if j != i {
+		m.shards[j].rwl.Lock()
+		defer m.shards[j].rwl.Unlock()
+	}
 	f()
 }
 
-func (m *memory) withWriteLock(f func()) {
-	m.rwl.Lock()
-	defer m.rwl.Unlock()
+func (s *memoryShard) withReadLock(f func()) {
+	s.rwl.RLock()
+	defer s.rwl.RUnlock()
+	f()
+}
+
+func (s *memoryShard) withWriteLock(f func()) {
+	s.rwl.Lock()
+	defer s.rwl.Unlock()
 	f()
 }
 
 func (m *memory) Expire(ID string) error {
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
 		return nil
 	}
-	m.withWriteLock(func() {
-		delete(m.data, ID)
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		if d, ok := s.data[ID]; ok {
+			delete(s.data, ID)
+			atomic.AddInt64(&m.size, -1)
+			atomic.AddInt64(&m.bytes, -d.bytes)
+			if m.ExpireGrace > 0 {
+				m.trash.put(ID, d, time.Now())
+			}
+		}
+		m.forget(ID)
 	})
+	m.tags.remove(ID)
+	m.index.remove(ID)
+	m.watchers.notify(ID, "", OpExpire)
 	return nil
 }
 
 func (m *memory) Update(ID string) error {
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
 		return nil
 	}
-	m.withWriteLock(func() {
-		if d, ok := m.data[ID]; ok {
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		if d, ok := s.data[ID]; ok {
 			d.lastUpdate = time.Now()
 		}
 	})
 	return nil
 }
 
-var errSessionFlushed = fmt.Errorf("session flushed")
+// LastUpdate returns when the session was last updated, a renewed session
+// reports its renewed time
+func (m *memory) LastUpdate(ID string) (lastUpdate time.Time, err error) {
+	if err = validateID(m.IDValidator, ID); err != nil {
+		return
+	}
+	s := m.shard(ID)
+	s.withReadLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		lastUpdate = d.lastUpdate
+	})
+	return
+}
+
+// UpdateIfStale updates the session only if it was not updated within
+// threshold, updated tells whether it did
+func (m *memory) UpdateIfStale(ID string, threshold time.Duration) (updated bool, err error) {
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return false, err
+	}
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if now := time.Now(); now.Sub(d.lastUpdate) >= threshold {
+			d.lastUpdate, updated = now, true
+		}
+	})
+	return
+}
+
+// Renew marks the session as updated extend from now, so it outlives a plain
+// Update by extend. A negative extend fails with ErrNegativeExtend
+func (m *memory) Renew(ID string, extend time.Duration) error {
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
+	if m.readOnly() {
+		return ErrReadOnly
+	}
+	if extend < 0 {
+		return ErrNegativeExtend
+	}
+	return m.renewAt(ID, time.Now().Add(extend))
+}
+
+// renewAt sets the last update of the session, in the past too
+func (m *memory) renewAt(ID string, at time.Time) (err error) {
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		d.lastUpdate = at
+	})
+	return
+}
+
+// checkKeyLimit refuses every write once the store is drained, and a new
+// key once the session is full, updates are allowed
+func (m *memory) checkKeyLimit(d *memoryElement, key string) error {
+	if m.readOnly() {
+		return ErrReadOnly
+	}
+	if m.MaxKeysPerSession <= 0 {
+		return nil
+	}
+	if _, ok := d.data[key]; !ok && len(d.data) >= m.MaxKeysPerSession {
+		return ErrTooManyKeys
+	}
+	return nil
+}
 
 func (m *memory) Set(ID string, key string, val interface{}) (err error) {
+	atomic.AddInt64(&m.metrics.sets, 1)
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
 		return nil
 	}
-	m.withWriteLock(func() {
-		if m.data == nil {
-			err = errSessionFlushed
+	m.gcIfThresholdReached()
+	s, set, created := m.shard(ID), false, false
+	s.withWriteLock(func() {
+		if m.readOnly() {
+			err = ErrReadOnly
 			return
 		}
-		if d, ok := m.data[ID]; ok {
-			d.data[key] = val
+		d, ok := s.data[ID]
+		if !ok {
+			if d, err = m.missing(s, ID); d == nil {
+				return
+			}
+			created = true
 		}
+		if err = m.checkKeyLimit(d, key); err != nil {
+			return
+		}
+		m.put(d, key, val)
+		delete(d.meta, key)
+		set = true
 	})
+	m.created(ID, created)
+	m.access(ID)
+	if set {
+		m.watchers.notify(ID, key, OpSet)
+	}
 	return
 }
 
-func (m *memory) Get(ID string, key string) (val interface{}) {
+// SetWithMeta sets value along with its metadata
+func (m *memory) SetWithMeta(ID string, key string, val interface{}, meta map[string]string) (err error) {
+	atomic.AddInt64(&m.metrics.sets, 1)
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
 		return nil
 	}
-	m.withReadLock(func() {
-		if d, ok := m.data[ID]; ok {
+	s, set, created := m.shard(ID), false, false
+	s.withWriteLock(func() {
+		if m.readOnly() {
+			err = ErrReadOnly
+			return
+		}
+		d, ok := s.data[ID]
+		if !ok {
+			if d, err = m.missing(s, ID); d == nil {
+				return
+			}
+			created = true
+		}
+		if err = m.checkKeyLimit(d, key); err != nil {
+			return
+		}
+		m.put(d, key, val)
+		if d.meta == nil {
+			d.meta = make(map[string]map[string]string)
+		}
+		d.meta[key] = meta
+		set = true
+	})
+	m.created(ID, created)
+	if set {
+		m.watchers.notify(ID, key, OpSet)
+	}
+	return
+}
+
+func (m *memory) Get(ID string, key string) (val interface{}) {
+	atomic.AddInt64(&m.metrics.gets, 1)
+	key = m.normalize(key)
+	if validateID(m.IDValidator, ID) != nil || ID == "" {
+		return nil
+	}
+	s := m.shard(ID)
+	s.withReadLock(func() {
+		if d, ok := s.data[ID]; ok {
 			val = d.data[key]
 		}
 	})
+	m.access(ID)
+	return
+}
+
+// GetWithError tells an absent key from a key holding nil
+func (m *memory) GetWithError(ID string, key string) (val interface{}, err error) {
+	atomic.AddInt64(&m.metrics.gets, 1)
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return nil, err
+	}
+	s := m.shard(ID)
+	s.withReadLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if val, ok = d.data[key]; !ok {
+			err = ErrKeyNotFound
+		}
+	})
+	return
+}
+
+// GetWithMeta gets value along with the metadata it was set with
+func (m *memory) GetWithMeta(ID string, key string) (val interface{}, meta map[string]string, err error) {
+	atomic.AddInt64(&m.metrics.gets, 1)
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return nil, nil, err
+	}
+	s := m.shard(ID)
+	s.withReadLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if val, ok = d.data[key]; !ok {
+			err = ErrKeyNotFound
+			return
+		}
+		meta = d.meta[key]
+	})
 	return
 }
 
 func (m *memory) Delete(ID string, key string) error {
+	atomic.AddInt64(&m.metrics.deletes, 1)
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
 	if ID == "" {
 		return nil
 	}
-	m.withWriteLock(func() {
-		if d, ok := m.data[ID]; ok {
-			delete(d.data, key)
+	s, deleted, err := m.shard(ID), false, error(nil)
+	s.withWriteLock(func() {
+		if m.readOnly() {
+			err = ErrReadOnly
+			return
+		}
+		if d, ok := s.data[ID]; ok {
+			deleted = m.remove(d, key)
+			delete(d.meta, key)
 		}
 	})
-	return nil
+	if deleted {
+		m.watchers.notify(ID, key, OpDelete)
+	}
+	return err
 }
 
-func (m *memory) Flush() error {
-	m.withWriteLock(func() {
-		m.data = nil
+// KeyModTime returns when the key was last written
+func (m *memory) KeyModTime(ID string, key string) (modTime time.Time, err error) {
+	key = m.normalize(key)
+	if err = validateID(m.IDValidator, ID); err != nil {
+		return
+	}
+	s := m.shard(ID)
+	s.withReadLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if modTime, ok = d.modTimes[key]; !ok {
+			err = ErrKeyNotFound
+		}
+	})
+	return
+}
+
+// KeysWithPrefix lists the keys of the session starting with prefix
+func (m *memory) KeysWithPrefix(ID string, prefix string) (keys []string, err error) {
+	prefix = m.normalize(prefix)
+	if err = validateID(m.IDValidator, ID); err != nil {
+		return
+	}
+	s := m.shard(ID)
+	s.withReadLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		keys = make([]string, 0)
+		for key := range d.data {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+	})
+	return
+}
+
+// DeleteWithPrefix deletes the keys of the session starting with prefix
+func (m *memory) DeleteWithPrefix(ID string, prefix string) (n int, err error) {
+	prefix = m.normalize(prefix)
+	if err = validateID(m.IDValidator, ID); err != nil {
+		return
+	}
+	s, deleted := m.shard(ID), []string(nil)
+	s.withWriteLock(func() {
+		if m.readOnly() {
+			err = ErrReadOnly
+			return
+		}
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		for key := range d.data {
+			if strings.HasPrefix(key, prefix) {
+				m.remove(d, key)
+				delete(d.meta, key)
+				deleted = append(deleted, key)
+			}
+		}
+	})
+	for _, key := range deleted {
+		m.watchers.notify(ID, key, OpDelete)
+	}
+	return len(deleted), err
+}
+
+// MoveKey atomically moves a value, with its metadata, to another key of the
+// same or another session, overwriting the destination key
+func (m *memory) MoveKey(srcID, srcKey, dstID, dstKey string) (err error) {
+	srcKey, dstKey = m.normalize(srcKey), m.normalize(dstKey)
+	if err := validateID(m.IDValidator, srcID); err != nil {
+		return err
+	}
+	if err := validateID(m.IDValidator, dstID); err != nil {
+		return err
+	}
+	m.withWriteLocks(srcID, dstID, func() {
+		if m.readOnly() {
+			err = ErrReadOnly
+			return
+		}
+		src, ok := m.shard(srcID).data[srcID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		dst, ok := m.shard(dstID).data[dstID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		val, ok := src.data[srcKey]
+		if !ok {
+			err = ErrKeyNotFound
+			return
+		}
+		if srcID != dstID {
+			if err = m.checkKeyLimit(dst, dstKey); err != nil {
+				return
+			}
+		}
+		meta := src.meta[srcKey]
+		m.remove(src, srcKey)
+		delete(src.meta, srcKey)
+		m.put(dst, dstKey, val)
+		delete(dst.meta, dstKey)
+		if meta != nil {
+			if dst.meta == nil {
+				dst.meta = make(map[string]map[string]string)
+			}
+			dst.meta[dstKey] = meta
+		}
+	})
+	if err == nil {
+		m.grown()
+		m.watchers.notify(srcID, srcKey, OpDelete)
+		m.watchers.notify(dstID, dstKey, OpSet)
+	}
+	return
+}
+
+// RenameKey moves a value, with its metadata, to newKey of the same session.
+// It fails with ErrKeyExists when newKey is set, MoveKey overwrites it
+func (m *memory) RenameKey(ID, oldKey, newKey string) (err error) {
+	oldKey, newKey = m.normalize(oldKey), m.normalize(newKey)
+	if err = validateID(m.IDValidator, ID); err != nil {
+		return
+	}
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		if m.readOnly() {
+			err = ErrReadOnly
+			return
+		}
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		val, ok := d.data[oldKey]
+		if !ok {
+			err = ErrKeyNotFound
+			return
+		}
+		if _, ok := d.data[newKey]; ok {
+			err = ErrKeyExists
+			return
+		}
+		meta, hasMeta := d.meta[oldKey]
+		m.remove(d, oldKey)
+		delete(d.meta, oldKey)
+		m.put(d, newKey, val)
+		if hasMeta {
+			d.meta[newKey] = meta
+		}
+	})
+	if err == nil {
+		m.grown()
+		m.watchers.notify(ID, oldKey, OpDelete)
+		m.watchers.notify(ID, newKey, OpSet)
+	}
+	return
+}
+
+// Patch replaces the value of key with what patch returns for the current
+// one, nil when the key is absent, under the write lock of the session so
+// no concurrent write is lost. The metadata of the key is kept. patch runs
+// with the lock held, it must not block nor use the store
+func (m *memory) Patch(ID, key string, patch func(current interface{}) interface{}) (err error) {
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if err = m.checkKeyLimit(d, key); err != nil {
+			return
+		}
+		m.put(d, key, patch(d.data[key]))
 	})
+	if err == nil {
+		m.grown()
+		m.watchers.notify(ID, key, OpSet)
+	}
+	return
+}
+
+// GetOrSet returns the value of key, or stores and returns what compute
+// returns when the key is absent. It runs under the write lock of the
+// session, so compute runs at most once however many callers race; it must
+// not block nor use the store. An error of compute is returned and nothing
+// is stored
+func (m *memory) GetOrSet(ID, key string, compute func() (interface{}, error)) (val interface{}, err error) {
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return nil, err
+	}
+	s, set := m.shard(ID), false
+	s.withWriteLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if val, ok = d.data[key]; ok {
+			return
+		}
+		if err = m.checkKeyLimit(d, key); err != nil {
+			return
+		}
+		if val, err = compute(); err != nil {
+			return
+		}
+		m.put(d, key, val)
+		set = true
+	})
+	if set {
+		m.grown()
+		m.watchers.notify(ID, key, OpSet)
+	}
+	return
+}
+
+// Watch subscribes to the changes of a session: keys set or deleted and the
+// session expiring, through Expire, GC or eviction. Events are sent without
+// blocking the store, a watcher more than 16 events behind misses the next
+// ones. Flush sends no event. The returned func unsubscribes and closes the
+// channel, it must be called once the watcher is done
+func (m *memory) Watch(ID string) (<-chan Event, func()) {
+	return m.watchers.watch(ID)
+}
+
+// Flush removes all sessions at once, with their tags, indexed values and
+// the expired sessions kept for Recover: it waits for the operations in
+// flight by locking every shard, in order, and leaves the store empty and
+// usable. The configuration, the indexed keys and the watchers are kept
+func (m *memory) Flush() error {
+	var IDs []string
+	for _, s := range m.shards {
+		s.rwl.Lock()
+		if m.eviction != nil {
+			for ID := range s.data {
+				IDs = append(IDs, ID)
+			}
+		}
+		s.data = make(map[string]*memoryElement)
+	}
+	atomic.StoreInt64(&m.size, 0)
+	atomic.StoreInt64(&m.bytes, 0)
+	m.tags.reset()
+	m.index.reset()
+	m.trash.reset()
+	m.forget(IDs...)
+	for _, s := range m.shards {
+		s.rwl.Unlock()
+	}
+	m.gcLock.Lock()
+	m.gcCursor = 0
+	m.gcLock.Unlock()
 	return nil
 }
 
 func (m *memory) GC(lifeTime time.Duration, t time.Time) {
-	m.withWriteLock(func() {
-		for ID, d := range m.data {
-			if d.lastUpdate.Add(lifeTime).Before(t) {
-				delete(m.data, ID)
+	m.GCWithBudget(lifeTime, t, 0)
+}
+
+// GCWithBudget sweeps shard by shard, stopping once budget is spent and
+// resuming from the next shard on the following call
+func (m *memory) GCWithBudget(lifeTime time.Duration, t time.Time, budget time.Duration) (collected, remaining int) {
+	return m.GCWithOptions(lifeTime, t, GCOptions{Budget: budget})
+}
+
+// GCWithOptions is GCWithBudget deleting the expired sessions in batches,
+// the shard lock is released during the pauses
+func (m *memory) GCWithOptions(lifeTime time.Duration, t time.Time, options GCOptions) (collected, remaining int) {
+	budget := options.Budget
+	m.gcLock.Lock()
+	defer m.gcLock.Unlock()
+	m.trash.purge(t, m.ExpireGrace)
+
+	start, first, batched := time.Now(), 0, 0
+	defer func() {
+		atomic.AddInt64(&m.metrics.expired, int64(collected))
+		m.metrics.swept(start)
+	}()
+	if budget > 0 {
+		first = m.gcCursor
+	}
+	i := first
+	for ; i < memoryShards; i++ {
+		// always sweep one shard so a tiny budget still makes progress
+		if budget > 0 && i > first && time.Since(start) > budget {
+			break
+		}
+		s, expired := m.shards[i], []string(nil)
+		s.withReadLock(func() {
+			for ID, d := range s.data {
+				if d.lastUpdate.Add(lifeTime).Before(t) {
+					expired = append(expired, ID)
+				}
+			}
+		})
+		for len(expired) > 0 {
+			batch := expired
+			if options.BatchSize > 0 && len(batch) > options.BatchSize-batched {
+				batch = batch[:options.BatchSize-batched]
+			}
+			expired = expired[len(batch):]
+			collected += m.collect(s, batch, lifeTime, t)
+			if batched += len(batch); options.BatchSize > 0 && batched >= options.BatchSize {
+				time.Sleep(options.BatchPause)
+				batched = 0
 			}
 		}
+	}
+	if budget > 0 {
+		m.gcCursor = i % memoryShards
+	}
+	for ; i < memoryShards; i++ {
+		s := m.shards[i]
+		s.withReadLock(func() {
+			remaining += len(s.data)
+		})
+	}
+	return
+}
+
+// collect deletes the sessions of the shard still expired
+func (m *memory) collect(s *memoryShard, IDs []string, lifeTime time.Duration, t time.Time) int {
+	var expired []string
+	s.withWriteLock(func() {
+		for _, ID := range IDs {
+			// the session may have been updated since the sweep saw it
+			if d, ok := s.data[ID]; ok && d.lastUpdate.Add(lifeTime).Before(t) {
+				delete(s.data, ID)
+				atomic.AddInt64(&m.bytes, -d.bytes)
+				expired = append(expired, ID)
+			}
+		}
+		m.forget(expired...)
 	})
+	atomic.AddInt64(&m.size, -int64(len(expired)))
+	m.tags.remove(expired...)
+	m.index.remove(expired...)
+	for _, ID := range expired {
+		m.watchers.notify(ID, "", OpExpire)
+	}
+	return len(expired)
 }
 
-func (m *memory) GenerateID() (id string) {
-	m.withWriteLock(func() {
-		for {
-			id = m.generateID()
-			if _, ok := m.data[id]; ok {
+// GCWhere expires the sessions for which predicate returns true, whatever
+// their age. predicate is called with no lock held on a snapshot of each
+// shard, it should have no side effect
+func (m *memory) GCWhere(predicate func(ID string, lastUpdate time.Time) bool) (removed int, err error) {
+	for _, s := range m.shards {
+		var infos []SessionInfo
+		s.withReadLock(func() {
+			for ID, d := range s.data {
+				infos = append(infos, SessionInfo{ID, d.lastUpdate})
+			}
+		})
+		for _, info := range infos {
+			if !predicate(info.ID, info.LastUpdate) {
 				continue
 			}
-			m.data[id] = &memoryElement{make(map[string]interface{}), time.Now()}
-			break
+			if err := m.Expire(info.ID); err != nil {
+				return removed, err
+			}
+			removed++
 		}
+	}
+	return removed, nil
+}
+
+// ExpireOlderThan expires the sessions last updated before cutoff, whatever
+// the lifetime, and returns how many it removed
+func (m *memory) ExpireOlderThan(cutoff time.Time) (removed int, err error) {
+	return m.GCWhere(func(ID string, lastUpdate time.Time) bool {
+		return lastUpdate.Before(cutoff)
 	})
-	return
+}
+
+// SessionsInAgeRange returns the sessions last updated between max and min
+// before now, min included, most recently updated first
+func (m *memory) SessionsInAgeRange(min, max time.Duration, now time.Time) ([]string, error) {
+	infos, err := m.ListByActivity(0)
+	if err != nil {
+		return nil, err
+	}
+	return inAgeRange(infos, min, max, now), nil
+}
+
+// GCOnThreshold makes GenerateID and Set start an asynchronous GC, removing
+// sessions idle for longer than lifeTime, once the store holds more than
+// count sessions. Only one triggered GC runs at a time, a count <= 0
+// disables it. It should be called before the store is used
+func (m *memory) GCOnThreshold(count int, lifeTime time.Duration) {
+	m.gcThreshold = int64(count)
+	m.gcLifeTime = lifeTime
+}
+
+func (m *memory) gcIfThresholdReached() {
+	if m.gcThreshold <= 0 || atomic.LoadInt64(&m.size) <= m.gcThreshold {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&m.gcRunning, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&m.gcRunning, 0)
+		m.GC(m.gcLifeTime, time.Now())
+	}()
+}
+
+func (m *memory) GenerateID() string {
+	id, _ := m.GenerateIDWithPrefix("")
+	return id
+}
+
+// GenerateIDWithPrefix creates a session whose ID is prefix followed by a
+// generated ID, it fails with ErrTooManyCollisions when maxCollisions IDs in
+// a row are taken
+func (m *memory) GenerateIDWithPrefix(prefix string) (id string, err error) {
+	m.gcIfThresholdReached()
+	for collisions := 1; collisions <= maxCollisions; collisions++ {
+		id = prefix + m.generateID()
+		if ok, err := m.reserve(id); err != nil {
+			return "", err
+		} else if !ok {
+			m.collided(collisions)
+			continue
+		}
+		s, created := m.shard(id), false
+		s.withWriteLock(func() {
+			if m.readOnly() {
+				err = ErrReadOnly
+				return
+			}
+			if _, ok := s.data[id]; ok {
+				return
+			}
+			s.data[id] = &memoryElement{id: id, data: make(map[string]interface{}), lastUpdate: time.Now()}
+			atomic.AddInt64(&m.size, 1)
+			created = true
+		})
+		if err != nil {
+			return "", err
+		}
+		if created {
+			atomic.AddInt64(&m.metrics.created, 1)
+			if m.eviction != nil {
+				m.eviction.Add(id)
+				m.evict()
+			}
+			return
+		}
+		m.collided(collisions)
+	}
+	return "", ErrTooManyCollisions
+}
+
+// reserve asks the Reserver, if any, for the ID
+func (m *memory) reserve(id string) (bool, error) {
+	if m.Reserver == nil {
+		return true, nil
+	}
+	return m.Reserver.Reserve(id)
+}
+
+// collided counts a generated ID already taken
+func (m *memory) collided(collisions int) {
+	atomic.AddInt64(&m.collisions, 1)
+	warnCollisions(collisions)
+}
+
+// Create inserts a session holding a copy of initial
+func (m *memory) Create(initial map[string]interface{}) (id string, err error) {
+	initial = m.normalizeData(initial)
+	if m.MaxKeysPerSession > 0 && len(initial) > m.MaxKeysPerSession {
+		return "", ErrTooManyKeys
+	}
+	m.gcIfThresholdReached()
+	now := time.Now()
+	d := &memoryElement{
+		data:     make(map[string]interface{}, len(initial)),
+		modTimes: make(map[string]time.Time, len(initial)),
+	}
+	for key, val := range initial {
+		d.data[key] = val
+		d.modTimes[key] = now
+		m.stamp(d, key)
+		d.bytes += m.sizeOf(key, val)
+	}
+	for collisions := 1; collisions <= maxCollisions; collisions++ {
+		id = m.generateID()
+		if ok, err := m.reserve(id); err != nil {
+			return "", err
+		} else if !ok {
+			m.collided(collisions)
+			continue
+		}
+		s, created := m.shard(id), false
+		s.withWriteLock(func() {
+			if m.readOnly() {
+				err = ErrReadOnly
+				return
+			}
+			if _, ok := s.data[id]; ok {
+				return
+			}
+			d.id, d.lastUpdate = id, time.Now()
+			s.data[id] = d
+			atomic.AddInt64(&m.size, 1)
+			atomic.AddInt64(&m.bytes, d.bytes)
+			m.resize(d)
+			m.index.setAll(id, d.data)
+			created = true
+		})
+		if err != nil {
+			return "", err
+		}
+		if created {
+			atomic.AddInt64(&m.metrics.created, 1)
+			if m.eviction != nil {
+				m.eviction.Add(id)
+				m.evict()
+			}
+			return
+		}
+		m.collided(collisions)
+	}
+	return "", ErrTooManyCollisions
+}
+
+// missing applies OnMissingSession, under the write lock of the shard, it
+// returns the created session if any
+func (m *memory) missing(s *memoryShard, ID string) (*memoryElement, error) {
+	switch m.OnMissingSession {
+	case MissingSessionError:
+		return nil, ErrSessionNotFound
+	case MissingSessionCreate:
+		d := &memoryElement{id: ID, data: make(map[string]interface{}), lastUpdate: time.Now()}
+		s.data[ID] = d
+		atomic.AddInt64(&m.size, 1)
+		return d, nil
+	}
+	return nil, nil
+}
+
+// created tells the eviction policy about a session created by Set
+func (m *memory) created(ID string, created bool) {
+	if created {
+		atomic.AddInt64(&m.metrics.created, 1)
+	}
+	if created && m.eviction != nil {
+		m.eviction.Add(ID)
+		m.evict()
+		return
+	}
+	m.grown()
+}
+
+// grown evicts once a write takes the store over the cap of SetMaxBytes
+func (m *memory) grown() {
+	if m.maxBytes > 0 && atomic.LoadInt64(&m.bytes) > m.maxBytes {
+		m.evict()
+	}
+}
+
+// SetMaxSessions caps the number of sessions, once a new session goes over
+// max the policy picks the sessions to evict. A nil policy evicts the least
+// recently used session, a max <= 0 removes the cap. It should be called
+// before the store is used
+func (m *memory) SetMaxSessions(max int, policy EvictionPolicy) {
+	if max <= 0 {
+		m.maxSessions = 0
+		if m.maxBytes == 0 {
+			m.eviction = nil
+		}
+		return
+	}
+	if policy == nil {
+		policy = NewLRUPolicy()
+	}
+	m.maxSessions, m.eviction = int64(max), policy
+}
+
+// SetMaxBytes caps the estimated bytes of the keys and values, see Stats,
+// once a write goes over max the policy picks the sessions to evict until
+// the store is back under it, the session written included. A nil policy
+// weighs the sessions by their size, see NewSizedLRUPolicy, a max <= 0
+// removes the cap. A SizedEvictionPolicy is told the size of each session,
+// other policies ignore it. The cap shares its policy with SetMaxSessions,
+// the last one given is used for both. It should be called before the
+// store is used
+func (m *memory) SetMaxBytes(max int64, policy EvictionPolicy) {
+	if max <= 0 {
+		m.maxBytes = 0
+		if m.maxSessions == 0 {
+			m.eviction = nil
+		}
+		return
+	}
+	if policy == nil {
+		policy = NewSizedLRUPolicy()
+	}
+	m.maxBytes, m.eviction = max, policy
+}
+
+// overLimit tells whether the store is over one of its caps
+func (m *memory) overLimit() bool {
+	return m.maxSessions > 0 && atomic.LoadInt64(&m.size) > m.maxSessions ||
+		m.maxBytes > 0 && atomic.LoadInt64(&m.bytes) > m.maxBytes
+}
+
+// access tells the eviction policy the session was used
+func (m *memory) access(ID string) {
+	if m.eviction != nil {
+		m.eviction.Access(ID)
+	}
+}
+
+// forget tells the eviction policy the sessions are gone, under the lock of
+// their shard so a concurrent resize cannot bring them back
+func (m *memory) forget(IDs ...string) {
+	if m.eviction == nil {
+		return
+	}
+	for _, ID := range IDs {
+		m.eviction.Remove(ID)
+	}
+}
+
+// evict removes the victims of the eviction policy until the caps are met,
+// then hands them to OnEvict
+func (m *memory) evict() {
+	var IDs []string
+	var evicted []map[string]interface{}
+	m.evictLock.Lock()
+	for m.overLimit() {
+		ID, ok := m.eviction.Victim()
+		if !ok {
+			break
+		}
+		s := m.shard(ID)
+		s.withWriteLock(func() {
+			m.eviction.Remove(ID)
+			if d, ok := s.data[ID]; ok {
+				delete(s.data, ID)
+				atomic.AddInt64(&m.size, -1)
+				atomic.AddInt64(&m.bytes, -d.bytes)
+				atomic.AddInt64(&m.metrics.evicted, 1)
+				IDs = append(IDs, ID)
+				evicted = append(evicted, d.data)
+			}
+		})
+		m.tags.remove(ID)
+		m.index.remove(ID)
+		m.watchers.notify(ID, "", OpExpire)
+	}
+	m.evictLock.Unlock()
+	if m.OnEvict == nil {
+		return
+	}
+	for i, ID := range IDs {
+		m.OnEvict(ID, evicted[i])
+	}
+}
+
+// ListByActivity returns at most limit sessions, most recently updated first
+func (m *memory) ListByActivity(limit int) (infos []SessionInfo, err error) {
+	infos = make([]SessionInfo, 0)
+	for _, s := range m.shards {
+		s.withReadLock(func() {
+			for ID, d := range s.data {
+				infos = append(infos, SessionInfo{ID, d.lastUpdate})
+			}
+		})
+	}
+	return sortByActivity(infos, limit), nil
+}
+
+// put sets the key, keeping the size estimate up to date
+func (m *memory) put(d *memoryElement, key string, val interface{}) {
+	m.remove(d, key)
+	n := m.sizeOf(key, val)
+	d.data[key] = val
+	m.index.set(d.id, key, val)
+	if d.modTimes == nil {
+		d.modTimes = make(map[string]time.Time)
+	}
+	d.modTimes[key] = time.Now()
+	m.stamp(d, key)
+	d.bytes += n
+	atomic.AddInt64(&m.bytes, n)
+	m.resize(d)
+}
+
+// resize tells a SizedEvictionPolicy the new size of the session, under the
+// session lock
+func (m *memory) resize(d *memoryElement) {
+	if p, ok := m.eviction.(SizedEvictionPolicy); ok {
+		p.Resize(d.id, d.bytes)
+	}
+}
+
+// remove deletes the key, keeping the size estimate up to date
+func (m *memory) remove(d *memoryElement, key string) bool {
+	val, ok := d.data[key]
+	if !ok {
+		return false
+	}
+	n := m.sizeOf(key, val)
+	delete(d.data, key)
+	delete(d.modTimes, key)
+	delete(d.versions, key)
+	m.index.unset(d.id, key)
+	d.bytes -= n
+	atomic.AddInt64(&m.bytes, -n)
+	m.resize(d)
+	return true
+}
+
+func (m *memory) sizeOf(key string, val interface{}) int64 {
+	if m.SizeOf != nil {
+		return int64(m.SizeOf(key, val))
+	}
+	return int64(estimateSize(key, val))
+}
+
+// estimateSize counts the bytes of strings and byte slices, the in memory
+// size of scalars and the gob encoded size of anything else, which misses
+// the overhead of maps and pointers
+func estimateSize(key string, val interface{}) (n int) {
+	n = len(key)
+	switch v := val.(type) {
+	case nil:
+		return
+	case string:
+		return n + len(v)
+	case []byte:
+		return n + len(v)
+	}
+	t := reflect.TypeOf(val)
+	if t.Kind() <= reflect.Complex128 {
+		return n + int(t.Size())
+	}
+	defer func() {
+		// values gob can not encode count for their key only
+		recover()
+	}()
+	return n + len(marshal(val))
+}
+
+// Stats returns the number of sessions and an estimate of the bytes used by
+// their keys and values. The estimate is maintained as keys change, it does
+// not scan the store, see SizeOf to tune it
+func (m *memory) Stats() Stats {
+	return Stats{
+		Sessions:   int(atomic.LoadInt64(&m.size)),
+		Bytes:      atomic.LoadInt64(&m.bytes),
+		Collisions: atomic.LoadInt64(&m.collisions),
+	}
+}
+
+// Count returns the number of live sessions
+func (m *memory) Count() int {
+	return int(atomic.LoadInt64(&m.size))
+}
+
+// Ping always succeeds, the memory store has no backend
+func (m *memory) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// SelfTest sets a value in a throwaway session, reads it back and expires
+// the session
+func (m *memory) SelfTest() error {
+	return selfTest(m)
 }
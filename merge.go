@@ -0,0 +1,234 @@
+// merging a session into another
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Merge copies the keys of srcID, with their metadata, into dstID. Keys set
+// in both are overwritten when overwrite is true, otherwise they are kept and
+// returned sorted. Both sessions are locked for the whole merge, srcID is
+// left as it was, Expire it to drop it
+func (m *memory) Merge(dstID, srcID string, overwrite bool) (skipped []string, err error) {
+	if err := validateID(m.IDValidator, dstID); err != nil {
+		return nil, err
+	}
+	if err := validateID(m.IDValidator, srcID); err != nil {
+		return nil, err
+	}
+	if dstID == srcID {
+		return nil, nil
+	}
+	var merged []string
+	m.withWriteLocks(srcID, dstID, func() {
+		src, ok := m.shard(srcID).data[srcID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		dst, ok := m.shard(dstID).data[dstID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if m.readOnly() {
+			err = ErrReadOnly
+			return
+		}
+		// the key limit is checked before any key is copied
+		var keys []string
+		added := 0
+		for key := range src.data {
+			if _, ok := dst.data[key]; !ok {
+				added++
+			} else if !overwrite {
+				skipped = append(skipped, key)
+				continue
+			}
+			keys = append(keys, key)
+		}
+		if m.MaxKeysPerSession > 0 && added > 0 && len(dst.data)+added > m.MaxKeysPerSession {
+			skipped, err = nil, ErrTooManyKeys
+			return
+		}
+		for _, key := range keys {
+			val := src.data[key]
+			m.put(dst, key, val)
+			delete(dst.meta, key)
+			if meta := src.meta[key]; meta != nil {
+				if dst.meta == nil {
+					dst.meta = make(map[string]map[string]string)
+				}
+				dst.meta[key] = meta
+			}
+			merged = append(merged, key)
+		}
+	})
+	if err == nil {
+		m.grown()
+	}
+	for _, key := range merged {
+		m.watchers.notify(dstID, key, OpSet)
+	}
+	sort.Strings(skipped)
+	return
+}
+
+// Merge copies the keys of srcID, with their metadata, into dstID. Keys set
+// in both are overwritten when overwrite is true, otherwise they are kept and
+// returned sorted. Both sessions are locked for the whole merge, srcID is
+// left as it was, Expire it to drop it
+func (f file) Merge(dstID, srcID string, overwrite bool) (skipped []string, err error) {
+	if err := validateID(f.IDValidator, dstID); err != nil {
+		return nil, err
+	}
+	if err := validateID(f.IDValidator, srcID); err != nil {
+		return nil, err
+	}
+	if dstID == srcID {
+		return nil, nil
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	if err = f.thaw(srcID); err != nil {
+		return
+	}
+	if err = f.thaw(dstID); err != nil {
+		return
+	}
+	var merged []string
+	err = f.withRoom(dstID, func(room func(n int64) error) (err error) {
+		f.locks.withLocks(srcID, dstID, func() {
+			if f.singleFile {
+				merged, skipped, err = f.mergeSessions(dstID, srcID, overwrite, room)
+				return
+			}
+			merged, skipped, err = f.mergeKeys(dstID, srcID, overwrite, room)
+		})
+		return
+	})
+	// reindexKey thaws, taking the locks released here
+	for _, key := range merged {
+		f.reindexKey(dstID, key)
+	}
+	sort.Strings(skipped)
+	return
+}
+
+// mergeSessions merges in the single file layout, the caller holds the locks
+func (f file) mergeSessions(dstID, srcID string, overwrite bool, room func(n int64) error) (merged, skipped []string, err error) {
+	srcValues, srcMetas, err := f.readSession(srcID)
+	if err != nil {
+		return nil, nil, err
+	}
+	dstValues, dstMetas, err := f.readSession(dstID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n int64
+	for key, val := range srcValues {
+		if _, ok := dstValues[key]; ok && !overwrite {
+			skipped = append(skipped, key)
+			continue
+		} else if !ok && f.MaxKeysPerSession > 0 && len(dstValues) >= f.MaxKeysPerSession {
+			return nil, nil, ErrTooManyKeys
+		}
+		n += int64(len(marshal(val)))
+		dstValues[key] = val
+		delete(dstMetas, key)
+		if meta := srcMetas[key]; meta != nil {
+			dstMetas[key] = meta
+		}
+		f.cache.invalidate(dstID, key)
+		merged = append(merged, key)
+	}
+	if err := room(n); err != nil {
+		return nil, nil, err
+	}
+	if err := f.writeSession(dstID, dstValues, dstMetas); err != nil {
+		return nil, skipped, err
+	}
+	return merged, skipped, nil
+}
+
+// mergeKeys merges in the per key layout, the caller holds the locks. The
+// keys to copy are read first, so the key limit and the room are checked
+// before any is written
+func (f file) mergeKeys(dstID, srcID string, overwrite bool, room func(n int64) error) (merged, skipped []string, err error) {
+	if !f.Exists(dstID) {
+		return nil, nil, ErrSessionNotFound
+	}
+	// listKeys would thaw, taking the lock held here
+	directory, err := f.directoryPath(srcID)
+	if err != nil {
+		return nil, nil, err
+	}
+	fis, err := ioutil.ReadDir(directory)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	dstDirectory, err := f.directoryPath(dstID)
+	if err != nil {
+		return nil, nil, err
+	}
+	dstFis, err := ioutil.ReadDir(dstDirectory)
+	if err != nil {
+		return nil, nil, err
+	}
+	existing := make(map[string]bool, len(dstFis))
+	for _, fi := range dstFis {
+		existing[fi.Name()] = true
+	}
+	type copied struct {
+		key string
+		b   []byte
+	}
+	var copies []copied
+	var n int64
+	added := 0
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		key := fileKey(fi.Name())
+		b, err := f.readFile(srcID, key)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := f.readFile(dstID, key); err == nil && !overwrite {
+			skipped = append(skipped, key)
+			continue
+		}
+		if !existing[fi.Name()] {
+			added++
+		}
+		copies = append(copies, copied{key, b})
+		n += int64(len(b))
+	}
+	if f.MaxKeysPerSession > 0 && added > 0 && len(existing)+added > f.MaxKeysPerSession {
+		return nil, nil, ErrTooManyKeys
+	}
+	if err := room(n); err != nil {
+		return nil, nil, err
+	}
+	for _, c := range copies {
+		if err := f.clearTTL(dstID, c.key); err != nil {
+			return merged, skipped, err
+		}
+		err = f.writeFile(dstID, c.key, c.b)
+		f.cache.invalidate(dstID, c.key)
+		if err != nil {
+			return merged, skipped, err
+		}
+		merged = append(merged, c.key)
+	}
+	return merged, skipped, nil
+}
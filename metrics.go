@@ -0,0 +1,97 @@
+// metrics polled as a snapshot
+package session
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// StoreMetrics holds the counters of a store, cumulative since it was
+// created: they are never reset, a scraper polling at any interval takes
+// the difference between two snapshots. A counter the store does not
+// maintain stays 0
+type StoreMetrics struct {
+	// Sets, Gets and Deletes count the calls of Set, Get and Delete and of
+	// their variants, failed calls included
+	Sets    int64
+	Gets    int64
+	Deletes int64
+	// CacheHits and CacheMisses count the reads served by the cache of a
+	// cached or tiered store and those falling through to the backend
+	CacheHits   int64
+	CacheMisses int64
+	// Created counts the sessions created, by GenerateID, Create or Set
+	Created int64
+	// Expired counts the sessions removed by GC for their age
+	Expired int64
+	// Evicted counts the sessions removed by the caps of SetMaxSessions
+	// and SetMaxBytes
+	Evicted int64
+	// GCSweeps counts the GC sweeps, GCDuration is the time they took
+	GCSweeps   int64
+	GCDuration time.Duration
+}
+
+// MetricsReporter is implemented by stores keeping StoreMetrics, callers
+// type-assert for it
+type MetricsReporter interface {
+	Metrics() StoreMetrics
+}
+
+// storeCounters holds the counters of StoreMetrics, updated with atomic
+// operations so the hot path takes no lock
+type storeCounters struct {
+	sets, gets, deletes       int64
+	hits, misses              int64
+	created, expired, evicted int64
+	sweeps                    int64
+	gcDuration                int64
+}
+
+// swept counts a GC sweep started at start
+func (c *storeCounters) swept(start time.Time) {
+	atomic.AddInt64(&c.sweeps, 1)
+	atomic.AddInt64(&c.gcDuration, int64(time.Since(start)))
+}
+
+// snapshot loads every counter, each one atomically but not all of them at
+// once, so a snapshot taken under load may count an operation in one
+// counter and not yet in another
+func (c *storeCounters) snapshot() StoreMetrics {
+	return StoreMetrics{
+		Sets:        atomic.LoadInt64(&c.sets),
+		Gets:        atomic.LoadInt64(&c.gets),
+		Deletes:     atomic.LoadInt64(&c.deletes),
+		CacheHits:   atomic.LoadInt64(&c.hits),
+		CacheMisses: atomic.LoadInt64(&c.misses),
+		Created:     atomic.LoadInt64(&c.created),
+		Expired:     atomic.LoadInt64(&c.expired),
+		Evicted:     atomic.LoadInt64(&c.evicted),
+		GCSweeps:    atomic.LoadInt64(&c.sweeps),
+		GCDuration:  time.Duration(atomic.LoadInt64(&c.gcDuration)),
+	}
+}
+
+// Metrics returns the counters of the store, see StoreMetrics. Sets counts
+// Set, SetWithMeta, SetVersioned and Append, Gets counts Get, GetWithError
+// and GetWithMeta, Deletes counts Delete. Sessions removed by Expire or
+// GCWhere are not counted as expired
+func (m *memory) Metrics() StoreMetrics {
+	return m.metrics.snapshot()
+}
+
+// Metrics returns the counters of the store, see StoreMetrics. Sets counts
+// Set and SetWithMeta, Gets counts Get, GetWithError and GetWithMeta,
+// Deletes counts Delete. CacheHits and CacheMisses count the reads of the
+// read cache, see WithReadCache. Sessions removed by Expire, GCWhere or
+// EvictOnFull are not counted as expired
+func (f file) Metrics() StoreMetrics {
+	return f.metrics.snapshot()
+}
+
+// Metrics returns the counters of the tiered store, see StoreMetrics, a
+// read is a hit when fast holds the key. The counters of the tiers are
+// kept by the tiers
+func (t *tiered) Metrics() StoreMetrics {
+	return t.metrics.snapshot()
+}
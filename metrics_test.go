@@ -0,0 +1,67 @@
+package session
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Metrics(t *testing.T) {
+	m := NewMemoryStore(nil)
+	m.SetMaxSessions(2, nil)
+	old := m.GenerateID()
+	m.Set(old, "key", "value")
+	m.Get(old, "key")
+	m.GetWithError(old, "missing")
+	m.Delete(old, "key")
+	m.GenerateID()
+	m.GenerateID()
+	m.GC(time.Hour, time.Now().Add(2*time.Hour))
+
+	got := m.Metrics()
+	if got.GCDuration <= 0 {
+		t.Fatalf("the sweep should be timed, got %+v", got)
+	}
+	got.GCDuration = 0
+	want := StoreMetrics{Sets: 1, Gets: 2, Deletes: 1, Created: 3, Expired: 2, Evicted: 1, GCSweeps: 1}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	m.Flush()
+	if m.Metrics().Created != 3 {
+		t.Fatal("the counters should be cumulative")
+	}
+
+	var _ MetricsReporter = m
+	fast := NewMemoryStore(nil)
+	fast.OnMissingSession = MissingSessionCreate
+	s := NewTieredStore(fast, NewMemoryStore(nil))
+	ID := s.GenerateID()
+	s.Set(ID, "key", "value")
+	s.Get(ID, "key")
+	fast.Flush()
+	s.Get(ID, "key")
+	s.Get(ID, "missing")
+	if got := s.Metrics(); got.Gets != 3 || got.CacheHits != 1 || got.CacheMisses != 2 || got.Sets != 1 {
+		t.Fatalf("unexpected tiered metrics %+v", got)
+	}
+}
+
+func Test_FileMetrics(t *testing.T) {
+	defer os.RemoveAll("metrics")
+	f := NewFileStore(nil, "metrics", "/").WithReadCache(10)
+	sid := f.GenerateID()
+	f.Set(sid, "key", "value")
+	f.Get(sid, "key")
+	f.Get(sid, "key")
+	f.Delete(sid, "key")
+	f.GenerateID()
+	f.GC(time.Hour, time.Now().Add(2*time.Hour))
+
+	got := f.Metrics()
+	got.GCDuration = 0
+	want := StoreMetrics{Sets: 1, Gets: 2, Deletes: 1, CacheHits: 1, CacheMisses: 1, Created: 2, Expired: 2, GCSweeps: 1}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
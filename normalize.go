@@ -0,0 +1,58 @@
+// key normalization
+package session
+
+// rewriteKeys returns the keys rewritten by normalize, a nil normalize
+// leaves them as they are
+func rewriteKeys(normalize func(string) string, keys []string) []string {
+	if normalize == nil {
+		return keys
+	}
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = normalize(key)
+	}
+	return normalized
+}
+
+// rewriteData returns data with its keys rewritten by normalize, of keys
+// rewritten to the same key one value is kept
+func rewriteData(normalize func(string) string, data map[string]interface{}) map[string]interface{} {
+	if normalize == nil {
+		return data
+	}
+	normalized := make(map[string]interface{}, len(data))
+	for key, val := range data {
+		normalized[normalize(key)] = val
+	}
+	return normalized
+}
+
+func (m *memory) normalize(key string) string {
+	if m.KeyNormalizer == nil {
+		return key
+	}
+	return m.KeyNormalizer(key)
+}
+
+func (m *memory) normalizeAll(keys []string) []string {
+	return rewriteKeys(m.KeyNormalizer, keys)
+}
+
+func (m *memory) normalizeData(data map[string]interface{}) map[string]interface{} {
+	return rewriteData(m.KeyNormalizer, data)
+}
+
+func (f file) normalize(key string) string {
+	if f.KeyNormalizer == nil {
+		return key
+	}
+	return f.KeyNormalizer(key)
+}
+
+func (f file) normalizeAll(keys []string) []string {
+	return rewriteKeys(f.KeyNormalizer, keys)
+}
+
+func (f file) normalizeData(data map[string]interface{}) map[string]interface{} {
+	return rewriteData(f.KeyNormalizer, data)
+}
@@ -0,0 +1,88 @@
+// protobuf codec
+package session
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ProtoRuntime adapts a protobuf runtime to the proto codec. The package
+// does not depend on protobuf, an adapter for google.golang.org/protobuf
+// implements Name with proto.MessageName when v is a proto.Message, Marshal
+// with proto.Marshal, and Unmarshal with
+// protoregistry.GlobalTypes.FindMessageByName followed by proto.Unmarshal
+type ProtoRuntime interface {
+	// Name returns the full name of the message type of v, ok is false
+	// when v is not a message
+	Name(v interface{}) (name string, ok bool)
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(name string, b []byte) (interface{}, error)
+}
+
+// Tags of the proto codec wire format
+const (
+	protoInner   byte = 0x00
+	protoMessage byte = 0x01
+)
+
+// protoCodec encodes protobuf messages with runtime, other values with inner
+type protoCodec struct {
+	runtime ProtoRuntime
+	inner   Codec
+}
+
+// NewProtoCodec encodes the protobuf messages with runtime and the other
+// values with inner, GobCodec if nil. A value is a one byte tag followed by
+// its payload:
+//
+//	0x00 inner   the encoding of inner
+//	0x01 message the uvarint length of the full name of the message type,
+//	             the name, then the protobuf encoding of the message
+//
+// so a message stored through a network store can be read from any
+// language with the message definition
+func NewProtoCodec(runtime ProtoRuntime, inner Codec) *protoCodec {
+	if inner == nil {
+		inner = GobCodec
+	}
+	return &protoCodec{runtime, inner}
+}
+
+func (c *protoCodec) Marshal(v interface{}) ([]byte, error) {
+	name, ok := c.runtime.Name(v)
+	if !ok {
+		b, err := c.inner.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{protoInner}, b...), nil
+	}
+	payload, err := c.runtime.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(name)+len(payload))
+	b[0] = protoMessage
+	b = b[:1+binary.PutUvarint(b[1:], uint64(len(name)))]
+	b = append(b, name...)
+	return append(b, payload...), nil
+}
+
+func (c *protoCodec) Unmarshal(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("session: empty proto codec value")
+	}
+	tag, payload := b[0], b[1:]
+	switch tag {
+	case protoInner:
+		return c.inner.Unmarshal(payload)
+	case protoMessage:
+		n, size := binary.Uvarint(payload)
+		if size <= 0 || uint64(len(payload)-size) < n {
+			return nil, fmt.Errorf("session: malformed proto message name")
+		}
+		name := string(payload[size : size+int(n)])
+		return c.runtime.Unmarshal(name, payload[size+int(n):])
+	}
+	return nil, fmt.Errorf("session: unknown proto codec tag %#x", tag)
+}
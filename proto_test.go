@@ -0,0 +1,63 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// greeting is a message with a single string field, number 1
+type greeting struct {
+	Text string
+}
+
+// greetingRuntime encodes greetings in the protobuf wire format, like the
+// adapter of a real runtime would
+type greetingRuntime struct{}
+
+func (greetingRuntime) Name(v interface{}) (string, bool) {
+	_, ok := v.(*greeting)
+	return "test.Greeting", ok
+}
+
+func (greetingRuntime) Marshal(v interface{}) ([]byte, error) {
+	text := v.(*greeting).Text
+	if len(text) > 127 {
+		return nil, fmt.Errorf("text too long for the test runtime")
+	}
+	return append([]byte{0x0a, byte(len(text))}, text...), nil
+}
+
+func (greetingRuntime) Unmarshal(name string, b []byte) (interface{}, error) {
+	if name != "test.Greeting" {
+		return nil, fmt.Errorf("unknown message %q", name)
+	}
+	if len(b) < 2 || b[0] != 0x0a || int(b[1]) != len(b)-2 {
+		return nil, fmt.Errorf("malformed greeting")
+	}
+	return &greeting{string(b[2:])}, nil
+}
+
+func Test_ProtoCodec(t *testing.T) {
+	codec := NewProtoCodec(greetingRuntime{}, nil)
+	s := NewCodecStore(NewMemoryStore(nil), codec)
+	sid := s.GenerateID()
+	s.Set(sid, "greeting", &greeting{"hello"})
+	s.Set(sid, "count", 3)
+	if val, err := s.GetWithError(sid, "greeting"); err != nil || val.(*greeting).Text != "hello" {
+		t.Fatalf("the message should round-trip, got %v %v", val, err)
+	}
+	if val, err := s.GetWithError(sid, "count"); err != nil || val.(int) != 3 {
+		t.Fatalf("other values should round-trip through gob, got %v %v", val, err)
+	}
+	b, err := codec.Marshal(&greeting{"hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wire := append([]byte{0x01, 13}, "test.Greeting\x0a\x02hi"...); !bytes.Equal(b, wire) {
+		t.Fatalf("expected %x, got %x", wire, b)
+	}
+	if _, err := codec.Unmarshal([]byte{0x01, 20, 't'}); err == nil {
+		t.Fatal("a truncated name should fail")
+	}
+}
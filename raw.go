@@ -0,0 +1,95 @@
+// byte values without a codec
+package session
+
+import (
+	"fmt"
+	"time"
+)
+
+// rawFile stores the bytes given to Set as the key files themselves, with no
+// gob encoding, for callers doing their own serialization. Its Set and Get
+// take and return []byte, so it is not a SessionStore
+type rawFile struct {
+	store file
+}
+
+// NewRawStore turns a file store into a byte store. The values written by
+// the raw store can not be read through the file store and the other way
+// round, nor checked by Verify, so a root must only be used by one of them.
+// The single file layout is not supported
+func NewRawStore(store file) rawFile {
+	return rawFile{store}
+}
+
+func (r rawFile) GenerateID() string {
+	return r.store.GenerateID()
+}
+
+func (r rawFile) Set(ID string, key string, val []byte) error {
+	f := r.store
+	key = f.normalize(key)
+	if f.singleFile {
+		return fmt.Errorf("session: raw values need one file per key")
+	}
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
+	if ID == "" {
+		return ErrInvalidKey
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(ID, key)
+	if err := f.thaw(ID); err != nil {
+		return err
+	}
+	if err := f.missing(ID); err != nil {
+		return err
+	}
+	if err := f.reserve(ID, int64(len(val))); err != nil {
+		return err
+	}
+	if err := f.checkKeyLimit(ID, key); err != nil {
+		return err
+	}
+	if err := f.clearTTL(ID, key); err != nil {
+		return err
+	}
+	return f.writeFile(ID, key, val)
+}
+
+// Get fails with ErrSessionNotFound or ErrKeyNotFound when there is no value
+func (r rawFile) Get(ID string, key string) ([]byte, error) {
+	f := r.store
+	key = f.normalize(key)
+	if f.singleFile {
+		return nil, fmt.Errorf("session: raw values need one file per key")
+	}
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return nil, err
+	}
+	if err := f.thaw(ID); err != nil {
+		return nil, err
+	}
+	return f.readFile(ID, key)
+}
+
+func (r rawFile) Delete(ID string, key string) error {
+	return r.store.Delete(ID, key)
+}
+
+func (r rawFile) Update(ID string) error {
+	return r.store.Update(ID)
+}
+
+func (r rawFile) Expire(ID string) error {
+	return r.store.Expire(ID)
+}
+
+func (r rawFile) Flush() error {
+	return r.store.Flush()
+}
+
+func (r rawFile) GC(lifeTime time.Duration, timeNow time.Time) {
+	r.store.GC(lifeTime, timeNow)
+}
@@ -0,0 +1,35 @@
+package session
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func Test_RawStore(t *testing.T) {
+	r := NewRawStore(NewFileStore(nil, "dir", "/"))
+	sid := r.GenerateID()
+	if err := r.Set(sid, "key", []byte("raw value")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := r.Get(sid, "key"); err != nil || !bytes.Equal(b, []byte("raw value")) {
+		t.Fatalf("the bytes should round-trip, got %q %v", b, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join("dir", sid, "key")); !bytes.Equal(b, []byte("raw value")) {
+		t.Fatalf("the key file should hold the bytes as is, got %q", b)
+	}
+	if _, err := r.Get(sid, "absent"); err != ErrKeyNotFound {
+		t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+	}
+	if err := r.Set("absent", "key", nil); err == nil {
+		t.Fatal("Set should fail on an absent session")
+	}
+	r.Expire(sid)
+	if _, err := r.Get(sid, "key"); err != ErrSessionNotFound {
+		t.Fatalf("error should be ErrSessionNotFound but get %v", err)
+	}
+	if err := NewRawStore(NewSingleFileStore(nil, "dir", "/")).Set(sid, "key", nil); err == nil {
+		t.Fatal("the single file layout should not be supported")
+	}
+}
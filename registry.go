@@ -0,0 +1,40 @@
+// registry of named stores
+package session
+
+import "sync"
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]SessionStore)
+)
+
+// Register makes store available by name to Lookup. The registry is global
+// to the process. Like database/sql.Register, it panics when store is nil or
+// name is already registered
+func Register(name string, store SessionStore) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if store == nil {
+		panic("session: Register store is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("session: Register called twice for store " + name)
+	}
+	registry[name] = store
+}
+
+// Lookup returns the store registered under name
+func Lookup(name string) (SessionStore, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	store, ok := registry[name]
+	return store, ok
+}
+
+// Unregister forgets the store registered under name, if any, so the name
+// can be registered again
+func Unregister(name string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, name)
+}
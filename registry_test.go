@@ -0,0 +1,28 @@
+package session
+
+import "testing"
+
+func Test_Registry(t *testing.T) {
+	store := NewMemoryStore(nil)
+	Register("sessions", store)
+	defer Unregister("sessions")
+	if s, ok := Lookup("sessions"); !ok || s != SessionStore(store) {
+		t.Fatal("the registered store should be found")
+	}
+	if _, ok := Lookup("absent"); ok {
+		t.Fatal("an unregistered name should not be found")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("registering a name twice should panic")
+			}
+		}()
+		Register("sessions", NewMemoryStore(nil))
+	}()
+	Unregister("sessions")
+	if _, ok := Lookup("sessions"); ok {
+		t.Fatal("an unregistered store should not be found")
+	}
+	Register("sessions", store)
+}
@@ -0,0 +1,130 @@
+// ring store
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+var _ SessionStore = new(ring)
+
+// ring keeps the newest sessions in a fixed number of slots, a new session
+// takes the slot of the oldest one, whatever its activity. Expired sessions
+// keep their slot until it is reused
+type ring struct {
+	slots      []string
+	next       int
+	data       map[string]map[string]interface{}
+	generateID func() string
+
+	lock sync.RWMutex
+}
+
+// NewRingStore holds at most capacity sessions, evicting the oldest created
+// first. Its size is bounded without GC, so GC does nothing
+func NewRingStore(capacity int, IDGenerator func() string) *ring {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if IDGenerator == nil {
+		IDGenerator = DefaultGenerator
+	}
+	return &ring{
+		slots:      make([]string, capacity),
+		data:       make(map[string]map[string]interface{}, capacity),
+		generateID: IDGenerator,
+	}
+}
+
+func (r *ring) GenerateID() (id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for collisions := 1; ; collisions++ {
+		if id = r.generateID(); id == "" {
+			return
+		}
+		if _, ok := r.data[id]; !ok {
+			break
+		}
+		warnCollisions(collisions)
+	}
+	if old := r.slots[r.next]; old != "" {
+		delete(r.data, old)
+	}
+	r.slots[r.next] = id
+	r.next = (r.next + 1) % len(r.slots)
+	r.data[id] = make(map[string]interface{})
+	return
+}
+
+// Set fails with ErrSessionNotFound once the session is evicted or expired
+func (r *ring) Set(ID string, key string, val interface{}) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d, ok := r.data[ID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	d[key] = val
+	return nil
+}
+
+func (r *ring) Get(ID string, key string) interface{} {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.data[ID][key]
+}
+
+// GetWithError tells an absent key from a key holding nil
+func (r *ring) GetWithError(ID string, key string) (interface{}, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	d, ok := r.data[ID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	val, ok := d[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+func (r *ring) Delete(ID string, key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.data[ID], key)
+	return nil
+}
+
+// Update does nothing, eviction ignores activity
+func (r *ring) Update(ID string) error {
+	return nil
+}
+
+func (r *ring) Expire(ID string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.data, ID)
+	return nil
+}
+
+func (r *ring) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range r.slots {
+		r.slots[i] = ""
+	}
+	r.next = 0
+	r.data = make(map[string]map[string]interface{}, len(r.slots))
+	return nil
+}
+
+func (r *ring) GC(lifeTime time.Duration, timeNow time.Time) {}
+
+// Count returns the number of live sessions
+func (r *ring) Count() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.data)
+}
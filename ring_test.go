@@ -0,0 +1,42 @@
+package session
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_RingStore(t *testing.T) {
+	n := 0
+	r := NewRingStore(3, func() string {
+		n++
+		return fmt.Sprint(n)
+	})
+	for i := 0; i < 3; i++ {
+		ID := r.GenerateID()
+		r.Set(ID, "key", ID)
+	}
+	if r.Count() != 3 {
+		t.Fatalf("expected 3 sessions, got %d", r.Count())
+	}
+	r.Update("1")
+	r.GenerateID()
+	r.GenerateID()
+	if r.Count() != 3 {
+		t.Fatalf("the ring should stay at capacity, got %d sessions", r.Count())
+	}
+	for ID, live := range map[string]bool{"1": false, "2": false, "3": true, "4": true, "5": true} {
+		if _, err := r.GetWithError(ID, "key"); (err != ErrSessionNotFound) != live {
+			t.Fatalf("session %s should be live: %v, got %v", ID, live, err)
+		}
+	}
+	if err := r.Set("1", "key", "val"); err != ErrSessionNotFound {
+		t.Fatalf("Set on an evicted session should fail, got %v", err)
+	}
+	if r.Get("3", "key").(string) != "3" {
+		t.Fatal("the remaining sessions should keep their values")
+	}
+	r.Flush()
+	if r.Count() != 0 {
+		t.Fatal("Flush should empty the ring")
+	}
+}
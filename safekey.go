@@ -0,0 +1,150 @@
+// storage safe key names
+package session
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var _ SessionStore = new(safeKeys)
+
+// maxNameLength bounds the names encodeKey returns, under 255 bytes, the
+// file name limit of most file systems, and well within Redis field and SQL
+// index limits
+const maxNameLength = 254
+
+// emptyKeyName is the name of the empty key, a lone '%' no other key
+// encodes to
+const emptyKeyName = "%"
+
+// encodeKey maps a key to a storage name of its own, made of ASCII letters,
+// digits, '_', '-', '.' and '%': the other bytes, '%' included, are
+// percent-encoded, as are the dots of "." and "..". The name is safe as a
+// file name, a Redis field or an SQL value, and plain keys are their own
+// name. Keys whose name would be longer than maxNameLength are rejected with
+// ErrInvalidKey. It is the one key encoding of the package, the file store
+// names its key files with it
+func encodeKey(key string) (string, error) {
+	if key == "" {
+		return emptyKeyName, nil
+	}
+	if key == "." || key == ".." {
+		return strings.Repeat("%2E", len(key)), nil
+	}
+	const hex = "0123456789ABCDEF"
+	name := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; plainByte(c) {
+			name = append(name, c)
+		} else {
+			name = append(name, '%', hex[c>>4], hex[c&15])
+		}
+	}
+	if len(name) > maxNameLength {
+		return "", ErrInvalidKey
+	}
+	return string(name), nil
+}
+
+func plainByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-' || c == '.'
+}
+
+// decodeKey returns the key encodeKey mapped to name
+func decodeKey(name string) (string, error) {
+	if name == emptyKeyName {
+		return "", nil
+	}
+	key, err := url.PathUnescape(name)
+	if err != nil {
+		return "", fmt.Errorf("session: %q is not an encoded key", name)
+	}
+	if canonical, err := encodeKey(key); err != nil || canonical != name {
+		return "", fmt.Errorf("session: %q is not an encoded key", name)
+	}
+	return key, nil
+}
+
+// safeKeys encodes key names before they reach the inner store, see encodeKey
+type safeKeys struct {
+	inner SessionStore
+}
+
+// NewSafeKeyStore wraps inner so any key, with slashes, control characters
+// or invalid UTF-8, is stored under a name safe for file names, Redis fields
+// and SQL columns. Get of a key too long to encode returns nil
+func NewSafeKeyStore(inner SessionStore) *safeKeys {
+	return &safeKeys{inner}
+}
+
+func (s *safeKeys) GenerateID() string {
+	return s.inner.GenerateID()
+}
+
+func (s *safeKeys) Set(ID string, key string, val interface{}) error {
+	name, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return s.inner.Set(ID, name, val)
+}
+
+func (s *safeKeys) Get(ID string, key string) interface{} {
+	name, err := encodeKey(key)
+	if err != nil {
+		return nil
+	}
+	return s.inner.Get(ID, name)
+}
+
+func (s *safeKeys) Delete(ID string, key string) error {
+	name, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return s.inner.Delete(ID, name)
+}
+
+func (s *safeKeys) Update(ID string) error {
+	return s.inner.Update(ID)
+}
+
+func (s *safeKeys) Expire(ID string) error {
+	return s.inner.Expire(ID)
+}
+
+func (s *safeKeys) Flush() error {
+	return s.inner.Flush()
+}
+
+func (s *safeKeys) GC(lifeTime time.Duration, timeNow time.Time) {
+	s.inner.GC(lifeTime, timeNow)
+}
+
+// KeysWithPrefix returns the original names of the keys starting with prefix,
+// the inner store must support KeysWithPrefix
+func (s *safeKeys) KeysWithPrefix(ID string, prefix string) ([]string, error) {
+	lister, ok := s.inner.(interface {
+		KeysWithPrefix(ID string, prefix string) ([]string, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("session: %T can not list keys", s.inner)
+	}
+	names, err := lister.KeysWithPrefix(ID, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		key, err := decodeKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,83 @@
+package session
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+var pathologicalKeys = []string{
+	"",
+	"..",
+	"../escape",
+	"a/b\\c",
+	"nul\x00byte",
+	"line\nbreak",
+	"\xff\xfe invalid utf-8",
+	"~looks-encoded",
+	"%",
+	"%2E",
+	"plain_key-1.v2",
+	strings.Repeat("k", maxNameLength),
+}
+
+func Test_EncodeKey(t *testing.T) {
+	seen := make(map[string]string)
+	for _, key := range pathologicalKeys {
+		name, err := encodeKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(name) >= 255 || strings.ContainsAny(name, "/\\\x00\n") || name == ".." || name == "" {
+			t.Fatalf("%q is not a safe name for %q", name, key)
+		}
+		if other, ok := seen[name]; ok {
+			t.Fatalf("%q and %q both encode to %q", key, other, name)
+		}
+		seen[name] = key
+		if decoded, err := decodeKey(name); err != nil || decoded != key {
+			t.Fatalf("%q should decode back to %q, got %q %v", name, key, decoded, err)
+		}
+	}
+	for _, key := range []string{strings.Repeat("k", maxNameLength+1), strings.Repeat("\xff", maxNameLength/3+1)} {
+		if _, err := encodeKey(key); err != ErrInvalidKey {
+			t.Fatalf("error should be ErrInvalidKey but get %v", err)
+		}
+	}
+	for _, name := range []string{"%61", "a b", "%2", "."} {
+		if _, err := decodeKey(name); err == nil {
+			t.Fatalf("%q is not a name encodeKey returns", name)
+		}
+	}
+	if name, _ := encodeKey("plain_key-1.v2"); name != "plain_key-1.v2" {
+		t.Fatalf("a plain key should be its own name, got %q", name)
+	}
+}
+
+func Test_SafeKeyStore(t *testing.T) {
+	for _, inner := range []SessionStore{NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		s := NewSafeKeyStore(inner)
+		sid := s.GenerateID()
+		for i, key := range pathologicalKeys {
+			if err := s.Set(sid, key, i); err != nil {
+				t.Fatalf("%q: %v", key, err)
+			}
+		}
+		for i, key := range pathologicalKeys {
+			if s.Get(sid, key) != i {
+				t.Fatalf("%q should round-trip", key)
+			}
+		}
+		keys, err := s.KeysWithPrefix(sid, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append([]string(nil), pathologicalKeys...)
+		sort.Strings(keys)
+		sort.Strings(want)
+		if strings.Join(keys, "|") != strings.Join(want, "|") {
+			t.Fatalf("keys should be decoded, got %q", keys)
+		}
+		s.Expire(sid)
+	}
+}
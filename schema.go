@@ -0,0 +1,69 @@
+// schema enforcing store
+package session
+
+import "time"
+
+var _ SessionStore = new(schemaStore)
+
+// Schema lists the keys a session may hold, each with an optional validator
+// of its values, a nil validator accepts any value
+type Schema map[string]func(val interface{}) error
+
+// schemaStore rejects the writes of keys and values outside a schema
+type schemaStore struct {
+	inner  SessionStore
+	schema Schema
+}
+
+// NewSchemaStore wraps inner so Set fails with ErrKeyNotAllowed for a key
+// not in schema, or with the error of the validator of the key. Reads and
+// deletions are not checked. It is meant to catch mistakes during
+// development, production can use inner directly
+func NewSchemaStore(inner SessionStore, schema Schema) *schemaStore {
+	return &schemaStore{inner, schema}
+}
+
+func (s *schemaStore) GenerateID() string {
+	return s.inner.GenerateID()
+}
+
+func (s *schemaStore) Set(ID string, key string, val interface{}) error {
+	validate, ok := s.schema[key]
+	if !ok {
+		return ErrKeyNotAllowed
+	}
+	if validate != nil {
+		if err := validate(val); err != nil {
+			return err
+		}
+	}
+	return s.inner.Set(ID, key, val)
+}
+
+func (s *schemaStore) Get(ID string, key string) interface{} {
+	return s.inner.Get(ID, key)
+}
+
+func (s *schemaStore) GetWithError(ID string, key string) (interface{}, error) {
+	return getWithError(s.inner, ID, key)
+}
+
+func (s *schemaStore) Delete(ID string, key string) error {
+	return s.inner.Delete(ID, key)
+}
+
+func (s *schemaStore) Update(ID string) error {
+	return s.inner.Update(ID)
+}
+
+func (s *schemaStore) Expire(ID string) error {
+	return s.inner.Expire(ID)
+}
+
+func (s *schemaStore) Flush() error {
+	return s.inner.Flush()
+}
+
+func (s *schemaStore) GC(lifeTime time.Duration, timeNow time.Time) {
+	s.inner.GC(lifeTime, timeNow)
+}
@@ -0,0 +1,34 @@
+package session
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_SchemaStore(t *testing.T) {
+	s := NewSchemaStore(NewMemoryStore(nil), Schema{
+		"user": nil,
+		"age": func(val interface{}) error {
+			if _, ok := val.(int); !ok {
+				return fmt.Errorf("age should be an int, got %T", val)
+			}
+			return nil
+		},
+	})
+	sid := s.GenerateID()
+	if err := s.Set(sid, "user", "gopher"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(sid, "usr", "gopher"); err != ErrKeyNotAllowed {
+		t.Fatalf("error should be ErrKeyNotAllowed but get %v", err)
+	}
+	if err := s.Set(sid, "age", 12); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(sid, "age", "12"); err == nil {
+		t.Fatal("the validator should reject a string")
+	}
+	if s.Get(sid, "age").(int) != 12 || s.Get(sid, "usr") != nil {
+		t.Fatal("only the valid writes should be stored")
+	}
+}
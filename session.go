@@ -1,9 +1,17 @@
 package session
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	mrand "math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,38 +26,452 @@ type SessionStore interface {
 	GC(lifeTime time.Duration, timeNow time.Time)
 }
 
+// ErrSessionNotFound is returned when operating on an unknown session
+var ErrSessionNotFound = fmt.Errorf("session not found")
+
+// ErrSessionExpired is ErrSessionNotFound: a session expired, collected or
+// never created is gone from the store alike, while GetWithError returns
+// ErrKeyNotFound for a live session lacking the key
+var ErrSessionExpired = ErrSessionNotFound
+
+// ErrKeyNotFound is returned when the session does not hold the key
+var ErrKeyNotFound = fmt.Errorf("key not found")
+
+// ErrKeyExists is returned when renaming a key onto an existing key
+var ErrKeyExists = fmt.Errorf("key exists")
+
+// ErrTooManyKeys is returned when adding a key would exceed MaxKeysPerSession
+var ErrTooManyKeys = fmt.Errorf("too many keys")
+
+// ErrStorageFull is returned when the backend ran out of space
+var ErrStorageFull = fmt.Errorf("storage full")
+
+// ErrIDTooLong is returned when a session ID exceeds the store limit
+var ErrIDTooLong = fmt.Errorf("ID too long")
+
+// ErrInvalidKey is returned for an empty ID once an ID validator is set
+var ErrInvalidKey = fmt.Errorf("invalid key")
+
+// ErrCircuitOpen is returned without calling the store while a circuit
+// breaker is open, see NewCircuitBreakerStore
+var ErrCircuitOpen = fmt.Errorf("circuit open")
+
+// ErrNotIndexed is returned by FindByValue for a key the store does not
+// index or a value that can not be indexed
+var ErrNotIndexed = fmt.Errorf("not indexed")
+
+// ErrNotList is returned by Append and GetList for a key holding a value
+// that is not a list
+var ErrNotList = fmt.Errorf("not a list")
+
+// ErrKeyNotAllowed is returned by a schema store for a key outside its
+// schema, see NewSchemaStore
+var ErrKeyNotAllowed = fmt.Errorf("key not allowed")
+
+// ErrVersionConflict is returned by SetVersioned when the key was written
+// since its version was read
+var ErrVersionConflict = fmt.Errorf("version conflict")
+
+// ErrReadOnly is returned by the writes to a memory store once it is
+// drained, see Drain
+var ErrReadOnly = fmt.Errorf("store is read-only")
+
+// ErrTooManyCollisions is returned when maxCollisions IDs in a row were
+// taken, the generator is broken or the IDs too short
+var ErrTooManyCollisions = fmt.Errorf("too many ID collisions")
+
+// ErrNegativeExtend is returned by Renew for an extend below zero, which
+// would age the session instead of renewing it
+var ErrNegativeExtend = fmt.Errorf("negative extend")
+
+// validateID runs the optional validator, empty IDs are invalid when it is set
+func validateID(validator func(ID string) error, ID string) error {
+	if validator == nil {
+		return nil
+	}
+	if ID == "" {
+		return ErrInvalidKey
+	}
+	return validator(ID)
+}
+
+// MissingSession tells what Set does on a session that does not exist
+type MissingSession int
+
+const (
+	// MissingSessionDefault keeps the store behavior: the memory store drops
+	// the value, the file store fails with the file system error
+	MissingSessionDefault MissingSession = iota
+	// MissingSessionError fails with ErrSessionNotFound
+	MissingSessionError
+	// MissingSessionCreate creates the session
+	MissingSessionCreate
+)
+
+// SessionInfo describes a live session
+type SessionInfo struct {
+	ID         string
+	LastUpdate time.Time
+}
+
+// byActivity sorts SessionInfo most-recent-first
+type byActivity []SessionInfo
+
+func (a byActivity) Len() int           { return len(a) }
+func (a byActivity) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byActivity) Less(i, j int) bool { return a[i].LastUpdate.After(a[j].LastUpdate) }
+
+// sortByActivity sorts infos most-recent-first and caps the result at limit,
+// a limit <= 0 means no cap
+func sortByActivity(infos []SessionInfo, limit int) []SessionInfo {
+	sort.Sort(byActivity(infos))
+	if limit > 0 && len(infos) > limit {
+		infos = infos[:limit]
+	}
+	return infos
+}
+
+// inAgeRange returns the IDs of the sessions whose age at now is within
+// [min, max), in the order of infos
+func inAgeRange(infos []SessionInfo, min, max time.Duration, now time.Time) []string {
+	IDs := make([]string, 0)
+	for _, info := range infos {
+		if age := now.Sub(info.LastUpdate); age >= min && age < max {
+			IDs = append(IDs, info.ID)
+		}
+	}
+	return IDs
+}
+
+// Stats describes the content of a store
+type Stats struct {
+	// Sessions is the number of live sessions
+	Sessions int
+	// Bytes is an estimate of the size of the keys and values
+	Bytes int64
+	// Collisions is the number of generated IDs already taken
+	Collisions int64
+}
+
+// Pinger is implemented by stores able to report whether their backend is
+// reachable, callers type-assert for it
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// SelfTester is implemented by stores able to check they store and return
+// values, beyond Ping, callers type-assert for it
+type SelfTester interface {
+	SelfTest() error
+}
+
+// selfTest round-trips a canary value through a throwaway session of store,
+// which is expired whatever step fails
+func selfTest(store SessionStore) (err error) {
+	ID := store.GenerateID()
+	if ID == "" {
+		return fmt.Errorf("session: self-test: can not generate an ID")
+	}
+	defer func() {
+		if eerr := store.Expire(ID); eerr != nil && err == nil {
+			err = fmt.Errorf("session: self-test: expire: %v", eerr)
+		}
+	}()
+	canary := "canary " + ID
+	if err := store.Set(ID, "canary", canary); err != nil {
+		return fmt.Errorf("session: self-test: set: %v", err)
+	}
+	val, err := getWithError(store, ID, "canary")
+	if err != nil {
+		return fmt.Errorf("session: self-test: get: %v", err)
+	}
+	if s, ok := val.(string); !ok || s != canary {
+		return fmt.Errorf("session: self-test: expected %q back, got %v", canary, val)
+	}
+	return nil
+}
+
+// BudgetedGC is implemented by stores able to stop a GC sweep early and
+// resume it on the next call, collected and remaining report the sessions
+// removed and the sessions left unscanned, a budget <= 0 sweeps everything
+type BudgetedGC interface {
+	GCWithBudget(lifeTime time.Duration, timeNow time.Time, budget time.Duration) (collected, remaining int)
+}
+
+// OptionsGC is implemented by stores able to apply every GCOptions field to
+// a sweep, see BudgetedGC for collected and remaining
+type OptionsGC interface {
+	GCWithOptions(lifeTime time.Duration, timeNow time.Time, options GCOptions) (collected, remaining int)
+}
+
+// Creator is implemented by stores able to create a session already holding
+// its initial keys, so it is never seen empty
+type Creator interface {
+	Create(initial map[string]interface{}) (ID string, err error)
+}
+
+// IDReserver claims generated IDs in a medium shared by several processes,
+// a Redis SETNX or a unique database column, so stores of different
+// processes never hand out the same ID. Reserve reports false when the ID is
+// already taken. Reservations are never released by the store, the reserver
+// should expire them after the session lifetime
+type IDReserver interface {
+	Reserve(ID string) (bool, error)
+}
+
+// GCOptions tunes the gc loop of a Session
+type GCOptions struct {
+	// Budget bounds the time of a single sweep on stores implementing
+	// BudgetedGC, the rest of the sweep is left for the next tick
+	Budget time.Duration
+
+	// Jitter spreads the sweeps of sessions sharing a frequency, each
+	// interval is drawn within Jitter times the frequency around it.
+	// It is capped at maxJitter, 0 keeps a fixed interval, see WithGCJitter
+	Jitter float64
+
+	// BatchSize, if positive, makes stores implementing OptionsGC delete
+	// expired sessions BatchSize at a time, pausing BatchPause in between,
+	// so a large sweep does not saturate the storage
+	BatchSize  int
+	BatchPause time.Duration
+}
+
 type Session struct {
 	SessionStore
 	lifeTime                 time.Duration
 	gcFrequencyInMilliSecond int64
+	gcOptions                GCOptions
+
+	// gcPaused is shared by the copies of the Session, see PauseGC
+	gcPaused *int32
+	// gcJitter holds the bits of the jitter, shared by the copies of the
+	// Session, see WithGCJitter
+	gcJitter *uint64
 }
 
 func NewSession(store SessionStore, sessionLifeTime time.Duration, gcFrequencyInMilliSecond int64) Session {
-	s := Session{store, sessionLifeTime, gcFrequencyInMilliSecond}
+	return NewSessionWithGCOptions(store, sessionLifeTime, gcFrequencyInMilliSecond, GCOptions{})
+}
+
+func NewSessionWithGCOptions(store SessionStore, sessionLifeTime time.Duration, gcFrequencyInMilliSecond int64, gcOptions GCOptions) Session {
+	s := Session{store, sessionLifeTime, gcFrequencyInMilliSecond, gcOptions, new(int32), new(uint64)}
+	s.WithGCJitter(gcOptions.Jitter)
 	go s.gc()
 	return s
 }
 
+// WithGCJitter sets the jitter of the gc loop from the next tick, see
+// GCOptions.Jitter, and returns s. It does nothing on a Session not made by
+// NewSession
+func (s Session) WithGCJitter(fraction float64) Session {
+	if s.gcJitter != nil {
+		atomic.StoreUint64(s.gcJitter, math.Float64bits(fraction))
+	}
+	return s
+}
+
+// PauseGC makes the gc loop skip its sweeps until ResumeGC, so no session
+// is collected meanwhile, during a bulk import for instance. A sweep in
+// progress completes. It does nothing on a Session not made by NewSession
+func (s Session) PauseGC() {
+	if s.gcPaused != nil {
+		atomic.StoreInt32(s.gcPaused, 1)
+	}
+}
+
+// ResumeGC resumes the sweeps paused by PauseGC from the next tick
+func (s Session) ResumeGC() {
+	if s.gcPaused != nil {
+		atomic.StoreInt32(s.gcPaused, 0)
+	}
+}
+
+// GCPaused reports whether the sweeps are paused, see PauseGC
+func (s Session) GCPaused() bool {
+	return s.gcPaused != nil && atomic.LoadInt32(s.gcPaused) == 1
+}
+
 func (s Session) gc() {
 	if s.gcFrequencyInMilliSecond <= 0 {
 		return
 	}
-	ticker := time.NewTicker(time.Duration(s.gcFrequencyInMilliSecond) * time.Millisecond)
-	for {
-		select {
-		case t := <-ticker.C:
-			s.GC(s.lifeTime, t)
+	interval := time.Duration(s.gcFrequencyInMilliSecond) * time.Millisecond
+	next := jittered(interval, s.jitter())
+	ticker := time.NewTicker(next)
+	for t := range ticker.C {
+		s.sweep(t)
+		// without jitter the ticks keep their pace
+		if d := jittered(interval, s.jitter()); d != next {
+			next = d
+			ticker.Reset(d)
 		}
 	}
 }
 
+func (s Session) jitter() float64 {
+	if s.gcJitter == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(s.gcJitter))
+}
+
+// maxJitter caps the jitter, so an interval is at least half the frequency
+const maxJitter = 0.5
+
+// jittered draws an interval within fraction of interval around it
+func jittered(interval time.Duration, fraction float64) time.Duration {
+	if !(fraction > 0) {
+		return interval
+	}
+	if fraction > maxJitter {
+		fraction = maxJitter
+	}
+	return interval + time.Duration(fraction*(2*mrand.Float64()-1)*float64(interval))
+}
+
+func (s Session) sweep(t time.Time) {
+	if s.GCPaused() {
+		return
+	}
+	var collected, remaining int
+	if o, ok := s.SessionStore.(OptionsGC); ok {
+		collected, remaining = o.GCWithOptions(s.lifeTime, t, s.gcOptions)
+	} else if b, ok := s.SessionStore.(BudgetedGC); ok && s.gcOptions.Budget > 0 {
+		collected, remaining = b.GCWithBudget(s.lifeTime, t, s.gcOptions.Budget)
+	} else {
+		s.GC(s.lifeTime, t)
+		return
+	}
+	if remaining > 0 {
+		log.Printf("session: gc budget %v exhausted, collected %d, %d sessions left for the next tick", s.gcOptions.Budget, collected, remaining)
+	}
+}
+
 // DefaultGenerator generate 16 bytes session id
-var DefaultGenerator = func() string {
-	const length = 16
-	b := make([]byte, length)
-	n, err := rand.Read(b)
-	if err != nil && n != length {
-		log.Fatalf("can not rand.Read %v", err)
-	}
-	return hex.EncodeToString(b)
+var DefaultGenerator = NewGeneratorFromReader(rand.Reader, 16)
+
+// NewGeneratorFromReader returns a generator of IDs made of byteLength
+// bytes of r, hex encoded, crypto/rand.Reader and 16 bytes by default. Short
+// reads are retried until the ID is complete, a reader failing before
+// makes the generator exit the process like DefaultGenerator. Reads are
+// serialized, so r need not be safe for concurrent use
+func NewGeneratorFromReader(r io.Reader, byteLength int) func() string {
+	if r == nil {
+		r = rand.Reader
+	}
+	if byteLength <= 0 {
+		byteLength = 16
+	}
+	var lock sync.Mutex
+	return func() string {
+		b := make([]byte, byteLength)
+		lock.Lock()
+		_, err := io.ReadFull(r, b)
+		lock.Unlock()
+		if err != nil {
+			log.Fatalf("can not read %d random bytes %v", byteLength, err)
+		}
+		return hex.EncodeToString(b)
+	}
+}
+
+// collisionWarning is the number of collisions in a single ID generation
+// after which a warning is logged
+const collisionWarning = 3
+
+// maxCollisions bounds the IDs tried while generating a single ID
+const maxCollisions = 64
+
+// warnCollisions logs once collisions reaches collisionWarning, random IDs
+// colliding again and again mean the generator is broken or the IDs too short
+func warnCollisions(collisions int) {
+	if collisions == collisionWarning {
+		log.Printf("session: %d ID collisions while generating a single ID, check the ID generator", collisions)
+	}
+}
+
+// getWithError uses the store's GetWithError when it has one, otherwise a
+// nil value is taken as an absent key
+func (s Session) getWithError(ID string, key string) (interface{}, error) {
+	return getWithError(s.SessionStore, ID, key)
+}
+
+func getWithError(store SessionStore, ID string, key string) (interface{}, error) {
+	if g, ok := store.(interface {
+		GetWithError(ID string, key string) (interface{}, error)
+	}); ok {
+		return g.GetWithError(ID, key)
+	}
+	if val := store.Get(ID, key); val != nil {
+		return val, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// GetOr returns the value of key, or fallback when the key is absent
+// a key holding nil is returned as nil when the store can tell it apart
+func (s Session) GetOr(ID string, key string, fallback interface{}) interface{} {
+	val, err := s.getWithError(ID, key)
+	if err != nil {
+		return fallback
+	}
+	return val
+}
+
+// Peek reads the value of key without affecting the session expiry, stores
+// never refresh a session on read so Peek is safe for background inspection
+func (s Session) Peek(ID string, key string) (interface{}, error) {
+	return s.getWithError(ID, key)
+}
+
+// Create returns a new session holding the initial keys, atomically on
+// stores implementing Creator, otherwise with GenerateID and a Set per key
+func (s Session) Create(initial map[string]interface{}) (string, error) {
+	if c, ok := s.SessionStore.(Creator); ok {
+		return c.Create(initial)
+	}
+	ID := s.GenerateID()
+	for key, val := range initial {
+		if err := s.Set(ID, key, val); err != nil {
+			return "", err
+		}
+	}
+	return ID, nil
+}
+
+// Access reads the value of key and refreshes the session like Update
+func (s Session) Access(ID string, key string) (interface{}, error) {
+	val, err := s.getWithError(ID, key)
+	if err != nil {
+		return nil, err
+	}
+	return val, s.Update(ID)
+}
+
+// GetWithExpiry reads the value of key along with when it expires: the
+// deadline of a key set with a TTL, otherwise the last update of the session
+// plus its lifetime. expiresAt is zero when the store can tell neither, it
+// then needs KeyExpiry or LastUpdate methods
+func (s Session) GetWithExpiry(ID string, key string) (val interface{}, expiresAt time.Time, err error) {
+	if val, err = s.getWithError(ID, key); err != nil {
+		return nil, time.Time{}, err
+	}
+	if k, ok := s.SessionStore.(interface {
+		KeyExpiry(ID string, key string) (time.Time, error)
+	}); ok {
+		if expiresAt, err = k.KeyExpiry(ID, key); err != nil || !expiresAt.IsZero() {
+			return
+		}
+	}
+	if l, ok := s.SessionStore.(interface {
+		LastUpdate(ID string) (time.Time, error)
+	}); ok && s.lifeTime > 0 {
+		var lastUpdate time.Time
+		if lastUpdate, err = l.LastUpdate(ID); err != nil {
+			return
+		}
+		expiresAt = lastUpdate.Add(s.lifeTime)
+	}
+	return
 }
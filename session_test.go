@@ -1,6 +1,18 @@
 package session
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -11,6 +23,7 @@ type specialType struct {
 
 func Test_Session(t *testing.T) {
 	test(t, fileSession())
+	test(t, singleFileSession())
 	test(t, memorySession())
 }
 
@@ -44,8 +57,10 @@ func test(t *testing.T, s Session) {
 		t.Fatal(err)
 	}
 
-	if err := s.Set(nsid, "what", "the"); err == nil {
-		t.Fatal("error should be nil")
+	// the session is gone, the memory store drops the write silently
+	s.Set(nsid, "what", "the")
+	if s.Get(nsid, "what") != nil {
+		t.Fatal("a flushed session should not be written")
 	}
 }
 
@@ -53,6 +68,1982 @@ func fileSession() Session {
 	return NewSession(NewFileStore(nil, "dir", "/"), 1*time.Second, 50)
 }
 
+func singleFileSession() Session {
+	return NewSession(NewSingleFileStore(nil, "dir", "/"), 1*time.Second, 50)
+}
+
 func memorySession() Session {
 	return NewSession(NewMemoryStore(nil), 1*time.Second, 50)
 }
+
+func Test_ListByActivity(t *testing.T) {
+	type activityStore interface {
+		SessionStore
+		ListByActivity(limit int) ([]SessionInfo, error)
+	}
+	defer os.RemoveAll("activity")
+	for _, s := range []activityStore{NewMemoryStore(nil), NewFileStore(nil, "activity", "/")} {
+		first := s.GenerateID()
+		time.Sleep(10 * time.Millisecond)
+		s.GenerateID()
+		time.Sleep(10 * time.Millisecond)
+		third := s.GenerateID()
+		time.Sleep(10 * time.Millisecond)
+		s.Update(first)
+
+		infos, err := s.ListByActivity(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 2 {
+			t.Fatalf("there should be 2 sessions but get %d", len(infos))
+		}
+		if infos[0].ID != first {
+			t.Fatalf("%T: the most recently updated session should come first", s)
+		}
+		if infos[1].ID != third {
+			t.Fatalf("%T: the sessions should be ordered by their last update", s)
+		}
+	}
+}
+
+func Test_Meta(t *testing.T) {
+	type metaStore interface {
+		SessionStore
+		SetWithMeta(ID string, key string, val interface{}, meta map[string]string) error
+		GetWithMeta(ID string, key string) (interface{}, map[string]string, error)
+	}
+	for _, s := range []metaStore{NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		sid := s.GenerateID()
+		if err := s.SetWithMeta(sid, "k", "v", map[string]string{"source": "login"}); err != nil {
+			t.Fatal(err)
+		}
+		val, meta, err := s.GetWithMeta(sid, "k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val.(string) != "v" || meta["source"] != "login" {
+			t.Fatalf("unexpected value %v with meta %v", val, meta)
+		}
+		if s.Get(sid, "k").(string) != "v" {
+			t.Fatal("plain Get should see the value")
+		}
+
+		if err := s.Set(sid, "k", "plain"); err != nil {
+			t.Fatal(err)
+		}
+		if _, meta, _ = s.GetWithMeta(sid, "k"); len(meta) != 0 {
+			t.Fatalf("plain Set should drop meta but get %v", meta)
+		}
+		if _, _, err = s.GetWithMeta(sid, "absent"); err != ErrKeyNotFound {
+			t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+		}
+		s.Flush()
+	}
+}
+
+func Test_FileFlush(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	f.GenerateID()
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	sid := f.GenerateID()
+	if err := f.Set(sid, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Get(sid, "key").(string) != "value" {
+		t.Fatal("should be value")
+	}
+	f.Flush()
+}
+
+func Test_FileDurable(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	f.Durable = true
+	sid := f.GenerateID()
+	if err := f.Set(sid, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Get(sid, "key").(string) != "value" {
+		t.Fatal("should be value")
+	}
+	f.Flush()
+}
+
+func Test_GetOr(t *testing.T) {
+	for _, s := range []Session{fileSession(), memorySession()} {
+		sid := s.GenerateID()
+		if s.GetOr(sid, "absent", "fallback").(string) != "fallback" {
+			t.Fatal("absent key should get the fallback")
+		}
+		s.Set(sid, "nil", nil)
+		if val := s.GetOr(sid, "nil", "fallback"); val != nil {
+			t.Fatalf("key holding nil should get nil but get %v", val)
+		}
+		s.Set(sid, "key", "value")
+		if s.GetOr(sid, "key", "fallback").(string) != "value" {
+			t.Fatal("should be value")
+		}
+		s.Flush()
+	}
+}
+
+func Test_Prefix(t *testing.T) {
+	type prefixStore interface {
+		SessionStore
+		KeysWithPrefix(ID string, prefix string) ([]string, error)
+		DeleteWithPrefix(ID string, prefix string) (int, error)
+	}
+	for _, s := range []prefixStore{NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		sid := s.GenerateID()
+		s.Set(sid, "cache:user:1", 1)
+		s.Set(sid, "cache:user:2", 2)
+		s.Set(sid, "user", 3)
+
+		keys, err := s.KeysWithPrefix(sid, "cache:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 {
+			t.Fatalf("there should be 2 keys but get %v", keys)
+		}
+		if keys, _ = s.KeysWithPrefix(sid, "none"); keys == nil || len(keys) != 0 {
+			t.Fatalf("no match should be an empty slice but get %#v", keys)
+		}
+
+		n, err := s.DeleteWithPrefix(sid, "cache:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 || s.Get(sid, "cache:user:1") != nil || s.Get(sid, "user") == nil {
+			t.Fatal("only the prefixed keys should be deleted")
+		}
+		s.Flush()
+	}
+}
+
+func Test_IDValidator(t *testing.T) {
+	errMalformed := fmt.Errorf("malformed")
+	validator := func(ID string) error {
+		if len(ID) != 32 {
+			return errMalformed
+		}
+		return nil
+	}
+	f := NewFileStore(nil, "dir", "/")
+	f.IDValidator = validator
+	m := NewMemoryStore(nil)
+	m.IDValidator = validator
+
+	for _, s := range []SessionStore{f, m} {
+		if err := s.Set("../escape", "key", "value"); err != errMalformed {
+			t.Fatalf("error should be %v but get %v", errMalformed, err)
+		}
+		if err := s.Expire(""); err != ErrInvalidKey {
+			t.Fatalf("error should be ErrInvalidKey but get %v", err)
+		}
+		sid := s.GenerateID()
+		if err := s.Set(sid, "key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if s.Get(sid, "key").(string) != "value" {
+			t.Fatal("should be value")
+		}
+		s.Flush()
+	}
+
+	type store interface {
+		GetWithError(ID string, key string) (interface{}, error)
+		SetWithMeta(ID string, key string, val interface{}, meta map[string]string) error
+		GetWithMeta(ID string, key string) (interface{}, map[string]string, error)
+		KeyModTime(ID string, key string) (time.Time, error)
+		KeysWithPrefix(ID string, prefix string) ([]string, error)
+		DeleteWithPrefix(ID string, prefix string) (int, error)
+		MoveKey(srcID, srcKey, dstID, dstKey string) error
+		RenameKey(ID, oldKey, newKey string) error
+		Renew(ID string, extend time.Duration) error
+		Merge(dstID, srcID string, overwrite bool) ([]string, error)
+		LastUpdate(ID string) (time.Time, error)
+	}
+	const bad = "../escape"
+	valid := strings.Repeat("a", 32)
+	methods := map[string]func(s store) error{
+		"GetWithError":     func(s store) error { _, err := s.GetWithError(bad, "key"); return err },
+		"SetWithMeta":      func(s store) error { return s.SetWithMeta(bad, "key", "value", nil) },
+		"GetWithMeta":      func(s store) error { _, _, err := s.GetWithMeta(bad, "key"); return err },
+		"KeyModTime":       func(s store) error { _, err := s.KeyModTime(bad, "key"); return err },
+		"KeysWithPrefix":   func(s store) error { _, err := s.KeysWithPrefix(bad, ""); return err },
+		"DeleteWithPrefix": func(s store) error { _, err := s.DeleteWithPrefix(bad, ""); return err },
+		"MoveKey src":      func(s store) error { return s.MoveKey(bad, "key", valid, "key") },
+		"MoveKey dst":      func(s store) error { return s.MoveKey(valid, "key", bad, "key") },
+		"RenameKey":        func(s store) error { return s.RenameKey(bad, "key", "other") },
+		"Renew":            func(s store) error { return s.Renew(bad, time.Hour) },
+		"Merge dst":        func(s store) error { _, err := s.Merge(bad, valid, false); return err },
+		"Merge src":        func(s store) error { _, err := s.Merge(valid, bad, false); return err },
+		"LastUpdate":       func(s store) error { _, err := s.LastUpdate(bad); return err },
+	}
+	for _, s := range []store{f, m} {
+		for name, method := range methods {
+			if err := method(s); err != errMalformed {
+				t.Fatalf("%T: %s should validate the ID, got %v", s, name, err)
+			}
+		}
+	}
+	if _, err := f.KeyExpiry(bad, "key"); err != errMalformed {
+		t.Fatalf("KeyExpiry should validate the ID, got %v", err)
+	}
+	if f.Exists(bad) {
+		t.Fatal("Exists should validate the ID")
+	}
+}
+
+func Benchmark_MemoryParallel(b *testing.B) {
+	m := NewMemoryStore(nil)
+	b.RunParallel(func(pb *testing.PB) {
+		sid := m.GenerateID()
+		for pb.Next() {
+			m.Set(sid, "key", "value")
+			m.Get(sid, "key")
+		}
+	})
+}
+
+func Test_GCOnThreshold(t *testing.T) {
+	m := NewMemoryStore(nil)
+	m.GCOnThreshold(2, 10*time.Millisecond)
+	m.GenerateID()
+	m.GenerateID()
+	m.GenerateID()
+	time.Sleep(20 * time.Millisecond)
+
+	sid := m.GenerateID()
+	time.Sleep(20 * time.Millisecond)
+	if size := atomic.LoadInt64(&m.size); size != 1 {
+		t.Fatalf("expired sessions should be collected but %d sessions left", size)
+	}
+	if err := m.Set(sid, "key", "value"); err != nil || m.Get(sid, "key") == nil {
+		t.Fatal("the new session should survive")
+	}
+}
+
+func Test_MaxKeysPerSession(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	f.MaxKeysPerSession = 2
+	sf := NewSingleFileStore(nil, "dir", "/")
+	sf.MaxKeysPerSession = 2
+	m := NewMemoryStore(nil)
+	m.MaxKeysPerSession = 2
+
+	for _, s := range []SessionStore{f, sf, m} {
+		sid := s.GenerateID()
+		s.Set(sid, "a", 1)
+		s.Set(sid, "b", 2)
+		if err := s.Set(sid, "c", 3); err != ErrTooManyKeys {
+			t.Fatalf("error should be ErrTooManyKeys but get %v", err)
+		}
+		if err := s.Set(sid, "a", 4); err != nil {
+			t.Fatal(err)
+		}
+		s.Flush()
+	}
+}
+
+func Test_Ping(t *testing.T) {
+	for _, p := range []Pinger{NewFileStore(nil, "dir", "/"), NewMemoryStore(nil), NewSwitchableStore(NewMemoryStore(nil))} {
+		if err := p.Ping(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_SelfTest(t *testing.T) {
+	m := NewMemoryStore(nil)
+	for _, st := range []SelfTester{NewFileStore(nil, "selftest", "/"), m} {
+		if err := st.SelfTest(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.Count() != 0 {
+		t.Fatal("the self-test session should be expired")
+	}
+	m.Drain(NewMemoryStore(nil))
+	if err := m.SelfTest(); err == nil {
+		t.Fatal("the self-test of a read-only store should fail")
+	}
+}
+
+func Test_GCWithBudget(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	m := NewMemoryStore(nil)
+	for _, s := range []SessionStore{f, m} {
+		total := 0
+		for i := 0; i < 100; i++ {
+			s.GenerateID()
+		}
+		future := time.Now().Add(time.Second)
+		collected, remaining := s.(BudgetedGC).GCWithBudget(0, future, time.Nanosecond)
+		if remaining == 0 {
+			t.Fatal("a tiny budget should leave sessions for the next call")
+		}
+		for total = collected; remaining > 0; total += collected {
+			collected, remaining = s.(BudgetedGC).GCWithBudget(0, future, time.Nanosecond)
+		}
+		if total != 100 {
+			t.Fatalf("resumed sweeps should collect 100 sessions but collect %d", total)
+		}
+		s.Flush()
+	}
+}
+
+func Test_PeekAccess(t *testing.T) {
+	m := NewMemoryStore(nil)
+	s := Session{SessionStore: m}
+	sid := s.GenerateID()
+	s.Set(sid, "key", "value")
+	infos, _ := m.ListByActivity(1)
+	created := infos[0].LastUpdate
+
+	time.Sleep(time.Millisecond)
+	if val, err := s.Peek(sid, "key"); err != nil || val.(string) != "value" {
+		t.Fatalf("unexpected value %v and error %v", val, err)
+	}
+	if infos, _ = m.ListByActivity(1); !infos[0].LastUpdate.Equal(created) {
+		t.Fatal("Peek should not refresh the session")
+	}
+	if _, err := s.Access(sid, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ = m.ListByActivity(1); !infos[0].LastUpdate.After(created) {
+		t.Fatal("Access should refresh the session")
+	}
+}
+
+func Test_FileSeparator(t *testing.T) {
+	if f := NewFileStore(nil, "dir", ""); f.pathSeparator != string(os.PathSeparator) {
+		t.Fatalf("separator should default to %q but get %q", os.PathSeparator, f.pathSeparator)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("an illegal separator should panic")
+		}
+	}()
+	NewFileStore(nil, "dir", "|")
+}
+
+func Test_FilePath(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	for _, c := range []struct {
+		ID, key, path string
+		err           error
+	}{
+		{"id", "key", "dir/id/key", nil},
+		{"/id/", "/key/", "dir/id/%2Fkey%2F", nil},
+		{"id", "a//b", "dir/id/a%2F%2Fb", nil},
+		{"id", "a/../b", "dir/id/a%2F..%2Fb", nil},
+		{"id", `a\b`, "dir/id/a%5Cb", nil},
+		{"id", "100%", "dir/id/100%25", nil},
+		{"id", "%2F", "dir/id/%252F", nil},
+		{"id", ".", "dir/id/%2E", nil},
+		{"id", "..", "dir/id/%2E%2E", nil},
+		{"id", "...", "dir/id/...", nil},
+		{"id", "../other/key", "dir/id/..%2Fother%2Fkey", nil},
+		{"", "key", "", ErrInvalidKey},
+		{"id", "", "", ErrInvalidKey},
+		{"..", "key", "", ErrInvalidKey},
+		{"../id", "key", "", ErrInvalidKey},
+		{"id/..", "key", "", ErrInvalidKey},
+		{".tags", "key", "", ErrInvalidKey},
+		{"id/../.version", "key", "", ErrInvalidKey},
+	} {
+		path, err := f.filePath(c.ID, c.key)
+		if err != c.err || path != filepath.FromSlash(c.path) {
+			t.Fatalf("filePath(%q, %q) should be %q, %v but get %q, %v", c.ID, c.key, c.path, c.err, path, err)
+		}
+	}
+
+	sid := f.GenerateID()
+	keys := []string{"a/b", "a%2Fb", "a", ".", "..", "../escape", `a\b`, "%"}
+	for _, key := range keys {
+		if err := f.Set(sid, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		if val := f.Get(sid, key); val != key {
+			t.Fatalf("key %q should hold its own value but get %v", key, val)
+		}
+	}
+	listed, err := f.KeysWithPrefix(sid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	sort.Strings(keys)
+	if !reflect.DeepEqual(listed, keys) {
+		t.Fatalf("the keys should be listed unescaped, got %q", listed)
+	}
+	f.Expire(sid)
+}
+
+func Test_MoveKey(t *testing.T) {
+	type moveStore interface {
+		SessionStore
+		MoveKey(srcID, srcKey, dstID, dstKey string) error
+	}
+	for _, s := range []moveStore{NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		guest, user := s.GenerateID(), s.GenerateID()
+		s.Set(guest, "cart", "staged")
+		if err := s.MoveKey(guest, "cart", user, "cart"); err != nil {
+			t.Fatal(err)
+		}
+		if s.Get(guest, "cart") != nil || s.Get(user, "cart").(string) != "staged" {
+			t.Fatal("the value should be moved to the user session")
+		}
+		if err := s.MoveKey(user, "cart", user, "cart_v2"); err != nil {
+			t.Fatal(err)
+		}
+		if s.Get(user, "cart") != nil || s.Get(user, "cart_v2").(string) != "staged" {
+			t.Fatal("the value should be moved within the session")
+		}
+		if err := s.MoveKey(guest, "cart", user, "cart"); err != ErrKeyNotFound {
+			t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+		}
+		if err := s.MoveKey(user, "cart_v2", "absent", "cart"); err != ErrSessionNotFound {
+			t.Fatalf("error should be ErrSessionNotFound but get %v", err)
+		}
+		s.Flush()
+	}
+}
+
+func Test_Merge(t *testing.T) {
+	type mergeStore interface {
+		SessionStore
+		Merge(dstID, srcID string, overwrite bool) ([]string, error)
+	}
+	for _, s := range []mergeStore{NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		guest, user := s.GenerateID(), s.GenerateID()
+		s.Set(guest, "cart", "guest cart")
+		s.Set(guest, "lang", "fr")
+		s.Set(user, "cart", "user cart")
+		skipped, err := s.Merge(user, guest, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(skipped) != 1 || skipped[0] != "cart" {
+			t.Fatalf("cart should be skipped, got %v", skipped)
+		}
+		if s.Get(user, "cart").(string) != "user cart" || s.Get(user, "lang").(string) != "fr" {
+			t.Fatal("the new keys should be merged and the existing ones kept")
+		}
+		if skipped, err := s.Merge(user, guest, true); err != nil || len(skipped) != 0 {
+			t.Fatalf("nothing should be skipped when overwriting, got %v %v", skipped, err)
+		}
+		if s.Get(user, "cart").(string) != "guest cart" || s.Get(guest, "cart").(string) != "guest cart" {
+			t.Fatal("the source should overwrite the destination and be left as it was")
+		}
+		if _, err := s.Merge("absent", guest, true); err != ErrSessionNotFound {
+			t.Fatalf("error should be ErrSessionNotFound but get %v", err)
+		}
+		s.Flush()
+	}
+}
+
+func Test_MergeLimits(t *testing.T) {
+	type mergeStore interface {
+		SessionStore
+		Merge(dstID, srcID string, overwrite bool) ([]string, error)
+	}
+	defer os.RemoveAll("mergelimits")
+	fs, sfs, ms := NewFileStore(nil, "mergelimits", "/"), NewSingleFileStore(nil, "mergelimits", "/"), NewMemoryStore(nil)
+	fs.MaxKeysPerSession, sfs.MaxKeysPerSession, ms.MaxKeysPerSession = 2, 2, 2
+	for _, s := range []mergeStore{fs, sfs, ms} {
+		src, dst := s.GenerateID(), s.GenerateID()
+		s.Set(src, "a", 1)
+		s.Set(src, "b", 2)
+		s.Set(dst, "c", 3)
+		if _, err := s.Merge(dst, src, true); err != ErrTooManyKeys {
+			t.Fatalf("error should be ErrTooManyKeys but get %v", err)
+		}
+		if s.Get(dst, "a") != nil || s.Get(dst, "b") != nil {
+			t.Fatal("a merge over the key limit should copy nothing")
+		}
+		s.Flush()
+	}
+
+	// the memory store evicts once a merge goes over its max bytes
+	ms = NewMemoryStore(nil)
+	ms.SetMaxBytes(1000, nil)
+	old, src, dst := ms.GenerateID(), ms.GenerateID(), ms.GenerateID()
+	ms.Set(old, "k", strings.Repeat("x", 300))
+	ms.Set(src, "k", strings.Repeat("x", 400))
+	ms.Set(dst, "d", 1)
+	if _, err := ms.Merge(dst, src, true); err != nil {
+		t.Fatal(err)
+	}
+	if ms.Get(old, "k") != nil || ms.Stats().Bytes > 1000 {
+		t.Fatalf("the merge should evict the least recently used session, got %+v", ms.Stats())
+	}
+}
+
+func Test_Patch(t *testing.T) {
+	type patchStore interface {
+		SessionStore
+		Patch(ID, key string, patch func(current interface{}) interface{}) error
+	}
+	for _, s := range []patchStore{NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		sid := s.GenerateID()
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := s.Patch(sid, "counts", func(current interface{}) interface{} {
+					counts, _ := current.(map[string]int)
+					if counts == nil {
+						counts = make(map[string]int)
+					}
+					counts["hits"]++
+					return counts
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := s.Get(sid, "counts").(map[string]int)["hits"]; n != 20 {
+			t.Fatalf("no patch should be lost, got %d hits", n)
+		}
+		if err := s.Patch("absent", "counts", func(interface{}) interface{} { return nil }); err != ErrSessionNotFound {
+			t.Fatalf("error should be ErrSessionNotFound but get %v", err)
+		}
+		s.Expire(sid)
+	}
+}
+
+func Test_Tags(t *testing.T) {
+	type tagStore interface {
+		SessionStore
+		Tag(ID string, tags map[string]string) error
+		TagsOf(ID string) (map[string]string, error)
+		FindByTag(key, value string) ([]string, error)
+	}
+	for _, s := range []tagStore{NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		mobile, desktop := s.GenerateID(), s.GenerateID()
+		if err := s.Tag(mobile, map[string]string{"device": "mobile", "user": "42"}); err != nil {
+			t.Fatal(err)
+		}
+		s.Tag(desktop, map[string]string{"device": "desktop", "user": "42"})
+		if IDs, err := s.FindByTag("device", "mobile"); err != nil || len(IDs) != 1 || IDs[0] != mobile {
+			t.Fatalf("expected the mobile session, got %v %v", IDs, err)
+		}
+		if IDs, _ := s.FindByTag("user", "42"); len(IDs) != 2 {
+			t.Fatalf("expected both sessions, got %v", IDs)
+		}
+		s.Tag(mobile, map[string]string{"device": "tablet", "user": ""})
+		if tags, err := s.TagsOf(mobile); err != nil || len(tags) != 1 || tags["device"] != "tablet" {
+			t.Fatalf("tags should be merged and empty values removed, got %v %v", tags, err)
+		}
+		if IDs, _ := s.FindByTag("device", "mobile"); len(IDs) != 0 {
+			t.Fatalf("replaced tags should not be found, got %v", IDs)
+		}
+		s.Expire(desktop)
+		if IDs, _ := s.FindByTag("user", "42"); len(IDs) != 0 {
+			t.Fatalf("expired sessions should be untagged, got %v", IDs)
+		}
+		if err := s.Tag(desktop, map[string]string{"device": "desktop"}); err != ErrSessionNotFound {
+			t.Fatalf("error should be ErrSessionNotFound but get %v", err)
+		}
+		s.GC(0, time.Now().Add(time.Second))
+		if IDs, _ := s.FindByTag("device", "tablet"); len(IDs) != 0 {
+			t.Fatalf("collected sessions should be untagged, got %v", IDs)
+		}
+	}
+}
+
+func Test_GetOrSet(t *testing.T) {
+	type getOrSetStore interface {
+		SessionStore
+		GetOrSet(ID, key string, compute func() (interface{}, error)) (interface{}, error)
+	}
+	for _, s := range []getOrSetStore{NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		sid := s.GenerateID()
+		var computed int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				val, err := s.GetOrSet(sid, "token", func() (interface{}, error) {
+					atomic.AddInt32(&computed, 1)
+					return "computed", nil
+				})
+				if err != nil || val.(string) != "computed" {
+					t.Errorf("unexpected value %v and error %v", val, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if computed != 1 {
+			t.Fatalf("compute should run once, ran %d times", computed)
+		}
+		failure := fmt.Errorf("compute failed")
+		if _, err := s.GetOrSet(sid, "other", func() (interface{}, error) { return nil, failure }); err != failure {
+			t.Fatalf("the error of compute should be returned, got %v", err)
+		}
+		if s.Get(sid, "other") != nil {
+			t.Fatal("nothing should be stored when compute fails")
+		}
+		if _, err := s.GetOrSet("absent", "token", func() (interface{}, error) { return "x", nil }); err == nil {
+			t.Fatal("GetOrSet should fail on an absent session")
+		}
+		s.Expire(sid)
+	}
+}
+
+func Test_GCWhere(t *testing.T) {
+	type gcWhereStore interface {
+		SessionStore
+		GCWhere(predicate func(ID string, lastUpdate time.Time) bool) (int, error)
+	}
+	for _, s := range []gcWhereStore{NewFileStore(nil, "dir", "/"), NewMemoryStore(nil)} {
+		banned, other := s.GenerateID(), s.GenerateID()
+		s.Set(banned, "key", "val")
+		s.Set(other, "key", "val")
+		removed, err := s.GCWhere(func(ID string, lastUpdate time.Time) bool {
+			if lastUpdate.IsZero() {
+				t.Error("the last update should be given")
+			}
+			return ID == banned
+		})
+		if err != nil || removed != 1 {
+			t.Fatalf("expected one session removed, got %d %v", removed, err)
+		}
+		if s.Get(banned, "key") != nil || s.Get(other, "key") == nil {
+			t.Fatal("only the matching session should be expired")
+		}
+		s.Expire(other)
+	}
+}
+
+func Test_GetWithExpiry(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	for _, store := range []SessionStore{f, NewMemoryStore(nil)} {
+		s := Session{SessionStore: store, lifeTime: time.Hour}
+		sid := s.GenerateID()
+		s.Set(sid, "key", "val")
+		before := time.Now()
+		val, expiresAt, err := s.GetWithExpiry(sid, "key")
+		if err != nil || val.(string) != "val" {
+			t.Fatalf("unexpected value %v and error %v", val, err)
+		}
+		if expiresAt.Before(before.Add(time.Hour-time.Minute)) || expiresAt.After(before.Add(time.Hour)) {
+			t.Fatalf("the session deadline should be returned, got %v", expiresAt)
+		}
+		if _, _, err := s.GetWithExpiry(sid, "absent"); err != ErrKeyNotFound {
+			t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+		}
+		s.Expire(sid)
+	}
+	s := Session{SessionStore: f, lifeTime: time.Hour}
+	sid := s.GenerateID()
+	f.SetWithTTL(sid, "short", "val", time.Minute)
+	if _, expiresAt, _ := s.GetWithExpiry(sid, "short"); expiresAt.After(time.Now().Add(time.Minute)) || expiresAt.Before(time.Now()) {
+		t.Fatalf("the key deadline should be returned, got %v", expiresAt)
+	}
+	if _, expiresAt, _ := (Session{SessionStore: NewSwitchableStore(f)}).GetWithExpiry(sid, "short"); !expiresAt.IsZero() {
+		t.Fatal("expiresAt should be zero when the store can not tell")
+	}
+	s.Expire(sid)
+}
+
+func Test_ExpireOlderThan(t *testing.T) {
+	defer os.RemoveAll("retention")
+	f := NewFileStore(nil, "retention", "/")
+	m := NewMemoryStore(nil)
+	type retentionStore interface {
+		SessionStore
+		ExpireOlderThan(cutoff time.Time) (int, error)
+	}
+	for i, s := range []retentionStore{f, m} {
+		stale, active := s.GenerateID(), s.GenerateID()
+		s.Set(stale, "key", "val")
+		s.Set(active, "key", "val")
+		old := time.Now().Add(-48 * time.Hour)
+		if i == 0 {
+			os.Chtimes(filepath.Join("retention", stale), old, old)
+		} else {
+			m.shard(stale).data[stale].lastUpdate = old
+		}
+		removed, err := s.ExpireOlderThan(time.Now().Add(-24 * time.Hour))
+		if err != nil || removed != 1 {
+			t.Fatalf("expected one session removed, got %d %v", removed, err)
+		}
+		if s.Get(stale, "key") != nil || s.Get(active, "key") == nil {
+			t.Fatal("only the session inactive since the cutoff should be expired")
+		}
+		s.Expire(active)
+	}
+}
+
+func Test_SessionsInAgeRange(t *testing.T) {
+	defer os.RemoveAll("ages")
+	f := NewFileStore(nil, "ages", "/")
+	m := NewMemoryStore(nil)
+	type ageStore interface {
+		SessionStore
+		SessionsInAgeRange(min, max time.Duration, now time.Time) ([]string, error)
+	}
+	for i, s := range []ageStore{f, m} {
+		now := time.Now()
+		var IDs []string
+		for _, age := range []time.Duration{0, time.Hour, 2 * time.Hour} {
+			ID := s.GenerateID()
+			if i == 0 {
+				os.Chtimes(filepath.Join("ages", ID), now.Add(-age), now.Add(-age))
+			} else {
+				m.shard(ID).data[ID].lastUpdate = now.Add(-age)
+			}
+			IDs = append(IDs, ID)
+		}
+		if got, err := s.SessionsInAgeRange(time.Hour, 2*time.Hour, now); err != nil || len(got) != 1 || got[0] != IDs[1] {
+			t.Fatalf("expected the session an hour old, got %v %v", got, err)
+		}
+		if got, _ := s.SessionsInAgeRange(0, 3*time.Hour, now); len(got) != 3 || got[0] != IDs[0] {
+			t.Fatalf("expected every session, youngest first, got %v", got)
+		}
+		if got, _ := s.SessionsInAgeRange(3*time.Hour, 4*time.Hour, now); got == nil || len(got) != 0 {
+			t.Fatalf("expected an empty slice, got %#v", got)
+		}
+	}
+}
+
+func Test_KeyNormalizer(t *testing.T) {
+	fs, sfs, ms := NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)
+	fs.KeyNormalizer, sfs.KeyNormalizer, ms.KeyNormalizer = strings.ToLower, strings.ToLower, strings.ToLower
+	type prefixStore interface {
+		SessionStore
+		KeysWithPrefix(ID string, prefix string) ([]string, error)
+	}
+	for _, s := range []prefixStore{fs, sfs, ms} {
+		sid := s.GenerateID()
+		s.Set(sid, "UserID", 42)
+		if s.Get(sid, "userid").(int) != 42 || s.Get(sid, "userID").(int) != 42 {
+			t.Fatal("keys spelt differently should be the same key")
+		}
+		if keys, err := s.KeysWithPrefix(sid, "User"); err != nil || len(keys) != 1 || keys[0] != "userid" {
+			t.Fatalf("expected the normalized key, got %v %v", keys, err)
+		}
+		s.Delete(sid, "USERID")
+		if s.Get(sid, "UserID") != nil {
+			t.Fatal("the key should be deleted whatever its spelling")
+		}
+		s.Expire(sid)
+	}
+}
+
+func Test_FindByValue(t *testing.T) {
+	type indexStore interface {
+		SessionStore
+		FindByValue(key string, val interface{}) ([]string, error)
+		Merge(dstID, srcID string, overwrite bool) ([]string, error)
+	}
+	defer os.RemoveAll("index")
+	memory := NewMemoryStore(nil)
+	memory.IndexKeys("user_id")
+	for _, s := range []indexStore{NewFileStore(nil, "index", "/").WithIndex("user_id"), NewSingleFileStore(nil, "index", "/").WithIndex("user_id"), memory} {
+		a, b, c := s.GenerateID(), s.GenerateID(), s.GenerateID()
+		s.Set(a, "user_id", 42)
+		s.Set(b, "user_id", 42)
+		s.Set(c, "user_id", 7)
+		if IDs, err := s.FindByValue("user_id", 42); err != nil || len(IDs) != 2 {
+			t.Fatalf("expected two sessions, got %v %v", IDs, err)
+		}
+		s.Set(b, "user_id", 7)
+		if IDs, _ := s.FindByValue("user_id", 42); len(IDs) != 1 || IDs[0] != a {
+			t.Fatalf("a replaced value should not be found, got %v", IDs)
+		}
+		s.Delete(a, "user_id")
+		if IDs, _ := s.FindByValue("user_id", 42); len(IDs) != 0 {
+			t.Fatalf("a deleted value should not be found, got %v", IDs)
+		}
+		s.Expire(c)
+		if IDs, _ := s.FindByValue("user_id", 7); len(IDs) != 1 || IDs[0] != b {
+			t.Fatalf("an expired session should not be found, got %v", IDs)
+		}
+		if _, err := s.FindByValue("name", "x"); err != ErrNotIndexed {
+			t.Fatalf("error should be ErrNotIndexed but get %v", err)
+		}
+		if _, err := s.FindByValue("user_id", []int{7}); err != ErrNotIndexed {
+			t.Fatalf("error should be ErrNotIndexed but get %v", err)
+		}
+		d := s.GenerateID()
+		s.Set(d, "user_id", 9)
+		if _, err := s.Merge(b, d, true); err != nil {
+			t.Fatal(err)
+		}
+		if IDs, _ := s.FindByValue("user_id", 9); len(IDs) != 2 {
+			t.Fatalf("a merged value should be found, got %v", IDs)
+		}
+	}
+	// a comparable type holding a slice is not indexed
+	held := struct{ v interface{} }{[]int{7}}
+	if indexable(held) {
+		t.Fatal("a value holding a slice should not be indexable")
+	}
+	ID := memory.GenerateID()
+	memory.Set(ID, "user_id", held)
+	if _, err := memory.FindByValue("user_id", held); err != ErrNotIndexed {
+		t.Fatalf("error should be ErrNotIndexed but get %v", err)
+	}
+	// the file store rebuilds its index from the root
+	s := NewFileStore(nil, "index", "/")
+	s.Flush()
+	ID = s.GenerateID()
+	s.Set(ID, "user_id", "u1")
+	if IDs, err := s.WithIndex("user_id").FindByValue("user_id", "u1"); err != nil || len(IDs) != 1 || IDs[0] != ID {
+		t.Fatalf("the index should be rebuilt, got %v %v", IDs, err)
+	}
+}
+
+func Test_Append(t *testing.T) {
+	type listStore interface {
+		SessionStore
+		Append(ID, key string, items ...interface{}) (int, error)
+		GetList(ID, key string) ([]interface{}, error)
+	}
+	fs, sfs, ms := NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/"), NewMemoryStore(nil)
+	fs.MaxListLength, sfs.MaxListLength, ms.MaxListLength = 3, 3, 3
+	for _, s := range []listStore{fs, sfs, ms} {
+		sid := s.GenerateID()
+		if n, err := s.Append(sid, "trail", "a", "b"); err != nil || n != 2 {
+			t.Fatalf("expected a list of 2, got %v %v", n, err)
+		}
+		if n, err := s.Append(sid, "trail", "c", "d", "e"); err != nil || n != 3 {
+			t.Fatalf("the list should be capped to 3, got %v %v", n, err)
+		}
+		if list, err := s.GetList(sid, "trail"); err != nil || fmt.Sprint(list) != "[c d e]" {
+			t.Fatalf("the oldest items should be dropped, got %v %v", list, err)
+		}
+		// enough dropped items to rewrite the file
+		for _, item := range []string{"f", "g", "h", "i"} {
+			s.Append(sid, "trail", item)
+		}
+		if list, ok := s.Get(sid, "trail").([]interface{}); !ok || fmt.Sprint(list) != "[g h i]" {
+			t.Fatalf("Get should return the list, got %v", s.Get(sid, "trail"))
+		}
+		s.Set(sid, "viewed", []interface{}{1})
+		if n, err := s.Append(sid, "viewed", 2); err != nil || n != 2 {
+			t.Fatalf("a []interface{} should be a list, got %v %v", n, err)
+		}
+		s.Set(sid, "name", "x")
+		if _, err := s.Append(sid, "name", "y"); err != ErrNotList {
+			t.Fatalf("error should be ErrNotList but get %v", err)
+		}
+		if _, err := s.GetList(sid, "name"); err != ErrNotList {
+			t.Fatalf("error should be ErrNotList but get %v", err)
+		}
+		if _, err := s.GetList(sid, "missing"); err != ErrKeyNotFound {
+			t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+		}
+		s.Expire(sid)
+		if _, err := s.Append(sid, "trail", "j"); err != ErrSessionNotFound {
+			t.Fatalf("error should be ErrSessionNotFound but get %v", err)
+		}
+	}
+}
+
+func Test_SessionExpired(t *testing.T) {
+	defer os.RemoveAll("expired")
+	for _, s := range []SessionStore{NewFileStore(nil, "expired", "/"), NewSingleFileStore(nil, "expired", "/"), NewMemoryStore(nil)} {
+		sid := s.GenerateID()
+		if _, err := getWithError(s, sid, "user"); err != ErrKeyNotFound {
+			t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+		}
+		s.Expire(sid)
+		if _, err := getWithError(s, sid, "user"); err != ErrSessionExpired {
+			t.Fatalf("error should be ErrSessionExpired but get %v", err)
+		}
+		sid = s.GenerateID()
+		s.GC(0, time.Now().Add(time.Second))
+		if _, err := getWithError(s, sid, "user"); err != ErrSessionExpired {
+			t.Fatalf("error should be ErrSessionExpired once collected but get %v", err)
+		}
+	}
+}
+
+func Test_FlushIndexes(t *testing.T) {
+	defer os.RemoveAll("flushed")
+	type indexedStore interface {
+		SessionStore
+		Tag(ID string, tags map[string]string) error
+		FindByTag(key, value string) ([]string, error)
+		FindByValue(key string, val interface{}) ([]string, error)
+	}
+	m := NewMemoryStore(nil)
+	m.IndexKeys("user")
+	for _, s := range []indexedStore{NewFileStore(nil, "flushed", "/").WithIndex("user"), m} {
+		sid := s.GenerateID()
+		s.Set(sid, "user", "gopher")
+		s.Tag(sid, map[string]string{"plan": "pro"})
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if IDs, err := s.FindByTag("plan", "pro"); err != nil || len(IDs) != 0 {
+			t.Fatalf("%T: Flush should clear the tags, got %v %v", s, IDs, err)
+		}
+		if IDs, err := s.FindByValue("user", "gopher"); err != nil || len(IDs) != 0 {
+			t.Fatalf("%T: Flush should clear the value index, got %v %v", s, IDs, err)
+		}
+		sid = s.GenerateID()
+		s.Set(sid, "user", "gopher")
+		if err := s.Tag(sid, map[string]string{"plan": "pro"}); err != nil {
+			t.Fatal(err)
+		}
+		if IDs, _ := s.FindByTag("plan", "pro"); len(IDs) != 1 || IDs[0] != sid {
+			t.Fatalf("%T: a flushed store should tag new sessions, got %v", s, IDs)
+		}
+		if IDs, _ := s.FindByValue("user", "gopher"); len(IDs) != 1 || IDs[0] != sid {
+			t.Fatalf("%T: a flushed store should index new sessions, got %v", s, IDs)
+		}
+	}
+}
+
+func Test_ExpireGrace(t *testing.T) {
+	defer os.RemoveAll("trash")
+	type recoverStore interface {
+		SessionStore
+		GetWithError(ID string, key string) (interface{}, error)
+		Recover(ID string) error
+	}
+	f, m := NewFileStore(nil, "trash", "/"), NewMemoryStore(nil)
+	f.ExpireGrace, m.ExpireGrace = time.Hour, time.Hour
+	for _, s := range []recoverStore{f, m} {
+		sid := s.GenerateID()
+		s.Set(sid, "draft", "unsaved")
+		if err := s.Recover(sid); err != ErrSessionNotFound {
+			t.Fatalf("%T: a live session should not be recovered, got %v", s, err)
+		}
+		s.Expire(sid)
+		if _, err := s.GetWithError(sid, "draft"); err != ErrSessionExpired {
+			t.Fatalf("%T: error should be ErrSessionExpired but get %v", s, err)
+		}
+		s.GC(time.Hour, time.Now())
+		if err := s.Recover(sid); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := s.GetWithError(sid, "draft"); err != nil || val.(string) != "unsaved" {
+			t.Fatalf("%T: the recovered session should keep its values, got %v %v", s, val, err)
+		}
+		s.Expire(sid)
+		s.GC(time.Hour, time.Now().Add(2*time.Hour))
+		if err := s.Recover(sid); err != ErrSessionNotFound {
+			t.Fatalf("%T: a session past its grace period should be gone, got %v", s, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("trash", trashDirectory)); err != nil {
+		t.Fatal("the file store should keep expired sessions in its trash directory")
+	}
+}
+
+func Test_ConcurrentFlush(t *testing.T) {
+	defer os.RemoveAll("flush")
+	for _, s := range []SessionStore{NewFileStore(nil, "flush", "/"), NewSingleFileStore(nil, "flush", "/"), NewMemoryStore(nil)} {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					sid := s.GenerateID()
+					s.Set(sid, "key", j)
+					s.Get(sid, "key")
+				}
+			}()
+		}
+		for i := 0; i < 5; i++ {
+			if err := s.Flush(); err != nil {
+				t.Fatalf("Flush should wait for the writes in flight, got %v", err)
+			}
+		}
+		wg.Wait()
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		sid := s.GenerateID()
+		if err := s.Set(sid, "key", "val"); err != nil || s.Get(sid, "key").(string) != "val" {
+			t.Fatalf("the store should be usable after Flush, got %v", err)
+		}
+	}
+}
+
+func Test_FlushWaitsForEveryWrite(t *testing.T) {
+	defer os.RemoveAll("flushwait")
+	f := NewFileStore(nil, "flushwait", "/")
+	sid, other := f.GenerateID(), f.GenerateID()
+	f.Set(sid, "a", 1)
+	f.Set(other, "x", 1)
+	ops := []struct {
+		name string
+		op   func() error
+	}{
+		{"MoveKey", func() error { return f.MoveKey(sid, "a", sid, "b") }},
+		{"RenameKey", func() error { return f.RenameKey(sid, "b", "c") }},
+		{"Patch", func() error { return f.Patch(sid, "c", func(interface{}) interface{} { return 2 }) }},
+		{"GetOrSet", func() error {
+			_, err := f.GetOrSet(sid, "d", func() (interface{}, error) { return 3, nil })
+			return err
+		}},
+		{"Update", func() error { return f.Update(sid) }},
+		{"Merge", func() error {
+			_, err := f.Merge(sid, other, true)
+			return err
+		}},
+		{"raw Set", func() error { return NewRawStore(f).Set(other, "raw", []byte("v")) }},
+		{"Expire", func() error { return f.Expire(other) }},
+	}
+	for _, o := range ops {
+		// a Flush in progress
+		f.flushing.Lock()
+		done := make(chan error, 1)
+		go func() {
+			done <- o.op()
+		}()
+		select {
+		case <-done:
+			t.Fatalf("%s should wait for Flush", o.name)
+		case <-time.After(20 * time.Millisecond):
+		}
+		f.flushing.Unlock()
+		if err := <-done; err != nil {
+			t.Fatalf("%s: %v", o.name, err)
+		}
+	}
+}
+
+func Test_MemoryStats(t *testing.T) {
+	m := NewMemoryStore(nil)
+	sid := m.GenerateID()
+	m.Set(sid, "key", "value")
+	m.Set(sid, "n", int64(1))
+	if stats := m.Stats(); stats.Sessions != 1 || stats.Bytes != 3+5+1+8 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	m.Set(sid, "key", "v")
+	m.Delete(sid, "n")
+	if stats := m.Stats(); stats.Bytes != 3+1 {
+		t.Fatalf("overwrites and deletes should be accounted, got %+v", stats)
+	}
+	m.Set(sid, "map", map[string]interface{}{"a": 1})
+	if stats := m.Stats(); stats.Bytes <= 3+1+3 {
+		t.Fatalf("other values should be estimated from their encoding, got %+v", stats)
+	}
+	m.Expire(sid)
+	if stats := m.Stats(); stats.Sessions != 0 || stats.Bytes != 0 {
+		t.Fatalf("expired sessions should be accounted, got %+v", stats)
+	}
+
+	m.SizeOf = func(key string, val interface{}) int { return 100 }
+	sid = m.GenerateID()
+	m.Set(sid, "key", "value")
+	if stats := m.Stats(); stats.Bytes != 100 {
+		t.Fatalf("SizeOf should replace the estimate, got %+v", stats)
+	}
+}
+
+func Test_GenerateIDWithPrefix(t *testing.T) {
+	m := NewMemoryStore(nil)
+	f := NewFileStore(nil, "dir", "/")
+	for _, store := range []interface {
+		SessionStore
+		GenerateIDWithPrefix(prefix string) (string, error)
+	}{m, f} {
+		sid, err := store.GenerateIDWithPrefix("t42_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(sid, "t42_") || len(sid) <= len("t42_") {
+			t.Fatalf("unexpected ID %q", sid)
+		}
+		if err := store.Set(sid, "key", "val"); err != nil {
+			t.Fatal(err)
+		}
+		if store.Get(sid, "key").(string) != "val" {
+			t.Fatal("the prefixed session should be usable")
+		}
+	}
+	for _, prefix := range []string{"../", "a/b", "a\\b"} {
+		if _, err := f.GenerateIDWithPrefix(prefix); err != ErrInvalidKey {
+			t.Fatalf("prefix %q should be rejected, got %v", prefix, err)
+		}
+	}
+}
+
+func Test_GenerateIDCollisions(t *testing.T) {
+	defer os.RemoveAll("collisions")
+	constant := func() string { return "same" }
+	m, f := NewMemoryStore(constant), NewFileStore(constant, "collisions", "/")
+	for _, store := range []interface {
+		SessionStore
+		GenerateIDWithPrefix(prefix string) (string, error)
+		Create(initial map[string]interface{}) (string, error)
+	}{m, f} {
+		if sid, err := store.GenerateIDWithPrefix(""); err != nil || sid != "same" {
+			t.Fatalf("%T: unexpected ID %q %v", store, sid, err)
+		}
+		if _, err := store.GenerateIDWithPrefix(""); err != ErrTooManyCollisions {
+			t.Fatalf("%T: expected ErrTooManyCollisions, got %v", store, err)
+		}
+		if _, err := store.Create(map[string]interface{}{"key": "val"}); err != ErrTooManyCollisions {
+			t.Fatalf("%T: expected ErrTooManyCollisions from Create, got %v", store, err)
+		}
+	}
+
+	// a root replaced by a file can not hold sessions
+	f = NewFileStore(nil, "collisions/root", "/")
+	os.RemoveAll("collisions/root")
+	ioutil.WriteFile("collisions/root", nil, permission)
+	if _, err := f.GenerateIDWithError(); err == nil {
+		t.Fatal("an unwritable root should fail")
+	}
+}
+
+func Test_Create(t *testing.T) {
+	initial := map[string]interface{}{"a": "1", "b": 2}
+	for _, s := range []Session{memorySession(), fileSession(), singleFileSession(), NewSession(NewCodecStore(NewMemoryStore(nil), GobCodec), time.Second, 0)} {
+		sid, err := s.Create(initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Get(sid, "a").(string) != "1" || s.Get(sid, "b").(int) != 2 {
+			t.Fatalf("%T: the session should hold the initial keys", s.SessionStore)
+		}
+		if err := s.Set(sid, "c", "3"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := NewFileStore(nil, "dir", "/")
+	f.MaxKeysPerSession = 1
+	if _, err := f.Create(initial); err != ErrTooManyKeys {
+		t.Fatalf("expected ErrTooManyKeys, got %v", err)
+	}
+	entries, _ := ioutil.ReadDir("dir")
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".create") {
+			t.Fatalf("staging directory %s left behind", e.Name())
+		}
+	}
+}
+
+func Test_KeyModTime(t *testing.T) {
+	for _, store := range []interface {
+		SessionStore
+		KeyModTime(ID string, key string) (time.Time, error)
+	}{NewMemoryStore(nil), NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/")} {
+		sid := store.GenerateID()
+		before := time.Now().Add(-time.Second)
+		store.Set(sid, "key", "val")
+		if modTime, err := store.KeyModTime(sid, "key"); err != nil || modTime.Before(before) {
+			t.Fatalf("%T: unexpected mod time %v %v", store, modTime, err)
+		}
+		if _, err := store.KeyModTime(sid, "absent"); err != ErrKeyNotFound {
+			t.Fatalf("%T: expected ErrKeyNotFound, got %v", store, err)
+		}
+		store.Delete(sid, "key")
+		if _, err := store.KeyModTime(sid, "key"); err != ErrKeyNotFound {
+			t.Fatalf("%T: expected ErrKeyNotFound after Delete, got %v", store, err)
+		}
+		if _, err := store.KeyModTime("unknown", "key"); err != ErrSessionNotFound {
+			t.Fatalf("%T: expected ErrSessionNotFound, got %v", store, err)
+		}
+	}
+}
+
+func Test_MissingSession(t *testing.T) {
+	m, f := NewMemoryStore(nil), NewFileStore(nil, "dir", "/")
+	if err := m.Set("missing", "key", "val"); err != nil || m.Get("missing", "key") != nil {
+		t.Fatal("the memory store should drop the value by default")
+	}
+	m.OnMissingSession, f.OnMissingSession = MissingSessionError, MissingSessionError
+	for _, store := range []SessionStore{m, f} {
+		if err := store.Set("missing", "key", "val"); err != ErrSessionNotFound {
+			t.Fatalf("%T: expected ErrSessionNotFound, got %v", store, err)
+		}
+	}
+	m.OnMissingSession, f.OnMissingSession = MissingSessionCreate, MissingSessionCreate
+	for _, store := range []SessionStore{m, f} {
+		ID := fmt.Sprintf("created%d", time.Now().UnixNano())
+		if err := store.Set(ID, "key", "val"); err != nil {
+			t.Fatal(err)
+		}
+		if store.Get(ID, "key").(string) != "val" {
+			t.Fatalf("%T: Set should create the session", store)
+		}
+		store.Expire(ID)
+	}
+	if m.Count() != 0 {
+		t.Fatal("created sessions should be counted")
+	}
+}
+
+func Test_RenameKey(t *testing.T) {
+	for _, store := range []interface {
+		SessionStore
+		SetWithMeta(ID string, key string, val interface{}, meta map[string]string) error
+		GetWithMeta(ID string, key string) (interface{}, map[string]string, error)
+		RenameKey(ID, oldKey, newKey string) error
+	}{NewMemoryStore(nil), NewFileStore(nil, "dir", "/"), NewSingleFileStore(nil, "dir", "/")} {
+		sid := store.GenerateID()
+		store.SetWithMeta(sid, "cart_v1", "items", map[string]string{"version": "1"})
+		store.Set(sid, "taken", "val")
+		if err := store.RenameKey(sid, "cart_v1", "taken"); err != ErrKeyExists {
+			t.Fatalf("%T: expected ErrKeyExists, got %v", store, err)
+		}
+		if err := store.RenameKey(sid, "cart_v1", "cart_v2"); err != nil {
+			t.Fatal(err)
+		}
+		val, meta, err := store.GetWithMeta(sid, "cart_v2")
+		if err != nil || val.(string) != "items" || meta["version"] != "1" {
+			t.Fatalf("%T: the value and its metadata should move, got %v %v %v", store, val, meta, err)
+		}
+		if store.Get(sid, "cart_v1") != nil {
+			t.Fatalf("%T: the old key should be gone", store)
+		}
+		if err := store.RenameKey(sid, "cart_v1", "cart_v3"); err != ErrKeyNotFound {
+			t.Fatalf("%T: expected ErrKeyNotFound, got %v", store, err)
+		}
+	}
+}
+
+func Test_Collisions(t *testing.T) {
+	ids := []string{"a", "a", "a", "b"}
+	m := NewMemoryStore(func() string {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	})
+	m.GenerateID()
+	if id := m.GenerateID(); id != "b" {
+		t.Fatalf("GenerateID should retry until the ID is free, got %q", id)
+	}
+	if collisions := m.Stats().Collisions; collisions != 2 {
+		t.Fatalf("expected 2 collisions, got %d", collisions)
+	}
+}
+
+func Test_FileArchive(t *testing.T) {
+	// a root of its own, the GC of the sessions on dir would collect the
+	// idle sessions
+	defer os.RemoveAll("cold")
+	for _, f := range []file{NewFileStore(nil, "cold", "/"), NewSingleFileStore(nil, "cold", "/")} {
+		f.ArchiveAfter = time.Minute
+		sid := f.GenerateID()
+		f.Set(sid, "key", "val")
+		idle := time.Now().Add(-time.Hour)
+		os.Chtimes(filepath.Join("cold", sid), idle, idle)
+
+		f.GC(24*time.Hour, time.Now())
+		if _, err := os.Stat(filepath.Join("cold", sid)); !os.IsNotExist(err) {
+			t.Fatal("a cold session should be archived")
+		}
+		if !f.Exists(sid) {
+			t.Fatal("an archived session should exist")
+		}
+		if f.Get(sid, "key").(string) != "val" {
+			t.Fatal("an archived session should be readable")
+		}
+		if f.archived(sid) {
+			t.Fatal("reading should extract the archive")
+		}
+		if info, err := os.Stat(filepath.Join("cold", sid)); err != nil || !info.ModTime().Equal(idle) {
+			t.Fatal("extracting should keep the idle time")
+		}
+
+		f.GC(24*time.Hour, time.Now())
+		f.GC(30*time.Minute, time.Now())
+		if f.Exists(sid) || f.archived(sid) {
+			t.Fatal("an expired archive should be collected")
+		}
+	}
+}
+
+func Test_GCJitter(t *testing.T) {
+	interval := time.Second
+	for i := 0; i < 100; i++ {
+		if d := jittered(interval, 0.2); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("%v is out of the jitter window", d)
+		}
+		if d := jittered(interval, 5); d < interval/2 || d > 3*interval/2 {
+			t.Fatalf("%v is out of the capped jitter window", d)
+		}
+	}
+	if d := jittered(interval, -1); d != interval {
+		t.Fatalf("a negative jitter should keep the interval, got %v", d)
+	}
+
+	m := NewMemoryStore(nil)
+	s := NewSession(m, time.Hour, 10).WithGCJitter(0.5)
+	if s.jitter() != 0.5 {
+		t.Fatalf("WithGCJitter should set the jitter, got %v", s.jitter())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := m.Metrics().GCSweeps; n == 0 || n > 20 {
+		t.Fatalf("the jittered gc loop should sweep every 5 to 15ms, got %d sweeps", n)
+	}
+}
+
+// trickle returns one byte per Read
+type trickle struct {
+	r io.Reader
+}
+
+func (t trickle) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return t.r.Read(b[:1])
+}
+
+func Test_NewGeneratorFromReader(t *testing.T) {
+	generate := NewGeneratorFromReader(trickle{bytes.NewReader([]byte{0, 1, 2, 3, 0xfe, 0xff})}, 3)
+	if ID := generate(); ID != "000102" {
+		t.Fatalf("short reads should be completed, got %q", ID)
+	}
+	if ID := generate(); ID != "03feff" {
+		t.Fatalf("expected the next bytes of the reader, got %q", ID)
+	}
+	if ID := NewGeneratorFromReader(nil, 0)(); len(ID) != 32 {
+		t.Fatalf("the default should be 16 random bytes, got %q", ID)
+	}
+}
+
+func Test_PauseGC(t *testing.T) {
+	m := NewMemoryStore(nil)
+	s := NewSession(m, time.Millisecond, 5)
+	s.PauseGC()
+	if !s.GCPaused() {
+		t.Fatal("the gc should be paused")
+	}
+	sid := s.GenerateID()
+	time.Sleep(30 * time.Millisecond)
+	if m.Count() != 1 {
+		t.Fatal("a paused gc should not collect sessions")
+	}
+	s.ResumeGC()
+	time.Sleep(30 * time.Millisecond)
+	if s.GCPaused() || m.Count() != 0 {
+		t.Fatalf("a resumed gc should collect %s", sid)
+	}
+	if (Session{SessionStore: m}).GCPaused() {
+		t.Fatal("a Session not made by NewSession has no gc to pause")
+	}
+}
+
+func Test_FileReservedIDs(t *testing.T) {
+	defer os.RemoveAll("reserved")
+	f := NewFileStore(nil, "reserved", "/")
+	f.ExpireGrace = time.Minute
+	sid := f.GenerateID()
+	f.Set(sid, "key", "100%")
+	f.Tag(sid, map[string]string{"plan": "pro"})
+	other := f.GenerateID()
+	f.Expire(other)
+
+	for _, ID := range []string{tagsDirectory, versionFile, trashDirectory} {
+		if err := f.Expire(ID); err != ErrInvalidKey {
+			t.Fatalf("Expire(%q) should fail with ErrInvalidKey, got %v", ID, err)
+		}
+		if err := f.Set(ID, "key", "value"); err != ErrInvalidKey {
+			t.Fatalf("Set(%q) should fail with ErrInvalidKey, got %v", ID, err)
+		}
+		if err := f.Recover(ID); err != ErrInvalidKey {
+			t.Fatalf("Recover(%q) should fail with ErrInvalidKey, got %v", ID, err)
+		}
+	}
+	if IDs, err := f.FindByTag("plan", "pro"); err != nil || len(IDs) != 1 {
+		t.Fatalf("the tags should be kept, got %v %v", IDs, err)
+	}
+	if err := f.Recover(other); err != nil {
+		t.Fatalf("the trash should be kept, got %v", err)
+	}
+	f = NewFileStore(nil, "reserved", "/")
+	if f.Get(sid, "key") != "100%" {
+		t.Fatal("the format version should be kept")
+	}
+}
+
+func Test_FileSetWithTTL(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/")
+	f.SweepExpiredKeys = true
+	sid := f.GenerateID()
+	f.SetWithTTL(sid, "short", "val", -time.Second)
+	f.SetWithTTL(sid, "long", "val", time.Hour)
+	f.SetWithTTL(sid, "reset", "val", -time.Second)
+	f.Set(sid, "reset", "val")
+
+	if f.Get(sid, "short") != nil {
+		t.Fatal("an expired key should be absent")
+	}
+	if f.Get(sid, "long").(string) != "val" || f.Get(sid, "reset").(string) != "val" {
+		t.Fatal("live keys should be readable")
+	}
+	if _, err := f.GetWithError(sid, "short"); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	f.GC(time.Hour, time.Now())
+	if _, err := os.Stat(filepath.Join("dir", sid, "short")); !os.IsNotExist(err) {
+		t.Fatal("GC should remove expired key files")
+	}
+	if _, err := os.Stat(filepath.Join("dir", sid, "long")); err != nil {
+		t.Fatal("GC should keep live key files")
+	}
+	if err := NewSingleFileStore(nil, "dir", "/").SetWithTTL(sid, "key", "val", time.Hour); err == nil {
+		t.Fatal("the single file layout should not support SetWithTTL")
+	}
+
+	// the key appears with its deadline
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			f.SetWithTTL(sid, "racy", "val", -time.Second)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if matches, _ := filepath.Glob(filepath.Join("dir", ".ttl*")); len(matches) != 0 {
+				t.Fatalf("no temporary file should be left, got %v", matches)
+			}
+			return
+		default:
+		}
+		if f.Get(sid, "racy") != nil {
+			t.Fatal("an expired key should never be seen")
+		}
+	}
+}
+
+func Test_FileCompact(t *testing.T) {
+	// see Test_FileArchive
+	defer os.RemoveAll("compact")
+	f := NewFileStore(nil, "compact", "/")
+	sid := f.GenerateID()
+	f.SetWithTTL(sid, "short", "val", -time.Second)
+	f.Set(sid, "long", "val")
+	single := NewSingleFileStore(nil, "compact", "/")
+	ssid := single.GenerateID()
+	single.Set(ssid, "key", "val")
+	ioutil.WriteFile(filepath.Join("compact", ssid, sessionFile+".tmp"), []byte("partial"), permission)
+	old := time.Now().Add(-time.Hour)
+	for _, ID := range []string{sid, ssid} {
+		os.Chtimes(filepath.Join("compact", ID), old, old)
+	}
+	leftover, inUse := filepath.Join("compact", ".create-leftover"), filepath.Join("compact", ".create-in-use")
+	os.Mkdir(leftover, permission)
+	os.Mkdir(inUse, permission)
+	os.Chtimes(leftover, old.Add(-time.Minute), old.Add(-time.Minute))
+
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := single.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join("compact", sid, "short")); !os.IsNotExist(err) {
+		t.Fatal("Compact should remove expired key files")
+	}
+	if _, err := os.Stat(filepath.Join("compact", ssid, sessionFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatal("Compact should remove the temporary session file")
+	}
+	if f.Get(sid, "long").(string) != "val" || single.Get(ssid, "key").(string) != "val" {
+		t.Fatal("Compact should keep live values")
+	}
+	for _, ID := range []string{sid, ssid} {
+		if info, err := os.Stat(filepath.Join("compact", ID)); err != nil || !info.ModTime().Equal(old) {
+			t.Fatal("Compact should keep the modification time of sessions")
+		}
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatal("Compact should remove old temporary entries")
+	}
+	if _, err := os.Stat(inUse); err != nil {
+		t.Fatal("Compact should keep recent temporary entries")
+	}
+}
+
+func Test_FileMaxTotalBytes(t *testing.T) {
+	defer os.RemoveAll("quota")
+	f := NewFileStore(nil, "quota", "/")
+	val := strings.Repeat("v", 100)
+	n := int64(len(marshalVersioned(val, nil, newVersion())))
+	f.MaxTotalBytes = 2*n + n/2
+	s1, s2, s3 := f.GenerateID(), f.GenerateID(), f.GenerateID()
+	f.Set(s1, "key", val)
+	f.Set(s2, "key", val)
+	if err := f.Set(s3, "key", val); err != ErrStorageFull {
+		t.Fatalf("error should be ErrStorageFull but get %v", err)
+	}
+	if stats := f.Stats(); stats.Sessions != 3 || stats.Bytes != 2*n {
+		t.Fatalf("unexpected stats %+v, values are %d bytes", stats, n)
+	}
+	f.Delete(s2, "key")
+	if f.Stats().Bytes != n {
+		t.Fatalf("deletes should be accounted, got %d", f.Stats().Bytes)
+	}
+	f.Set(s2, "key", val)
+
+	f.EvictOnFull = true
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(filepath.Join("quota", s1), old, old)
+	if err := f.Set(s3, "key", val); err != nil {
+		t.Fatal(err)
+	}
+	if f.Exists(s1) || !f.Exists(s2) || f.Stats().Bytes != 2*n {
+		t.Fatalf("the least recently updated session should be evicted, got %+v", f.Stats())
+	}
+	f.Expire(s3)
+	if f.Stats().Bytes != n {
+		t.Fatalf("expired sessions should be accounted, got %d", f.Stats().Bytes)
+	}
+	f.Flush()
+	if f.Stats().Bytes != 0 {
+		t.Fatal("Flush should reset the usage")
+	}
+}
+
+func Test_FileMaxTotalBytesMerge(t *testing.T) {
+	defer os.RemoveAll("quotamerge")
+	val := strings.Repeat("v", 100)
+	for _, f := range []file{NewFileStore(nil, "quotamerge", "/"), NewSingleFileStore(nil, "quotamerge", "/")} {
+		f.Flush()
+		src, dst := f.GenerateID(), f.GenerateID()
+		f.Set(src, "a", val)
+		f.Set(src, "b", val)
+		f.MaxTotalBytes = f.Stats().Bytes + 50
+		if _, err := f.Merge(dst, src, false); err != ErrStorageFull {
+			t.Fatalf("a merge past MaxTotalBytes should fail with ErrStorageFull, got %v", err)
+		}
+		if keys, _ := f.KeysWithPrefix(dst, ""); len(keys) != 0 {
+			t.Fatalf("a merge with no room should write nothing, got %v", keys)
+		}
+		f.MaxTotalBytes = 0
+		old := time.Now().Add(-time.Minute)
+		other := f.GenerateID()
+		f.Set(other, "key", strings.Repeat("v", 1000))
+		os.Chtimes(filepath.Join("quotamerge", other), old, old)
+		f.MaxTotalBytes, f.EvictOnFull = f.Stats().Bytes+50, true
+		if _, err := f.Merge(dst, src, false); err != nil {
+			t.Fatal(err)
+		}
+		if f.Exists(other) || f.Get(dst, "a") != val {
+			t.Fatal("a merge should evict to make room")
+		}
+	}
+
+	f := NewFileStore(nil, "quotamerge", "/")
+	f.Flush()
+	raw := NewRawStore(f)
+	sid := raw.GenerateID()
+	raw.store.MaxTotalBytes = 150
+	if err := raw.Set(sid, "a", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.Set(sid, "b", []byte(val)); err != ErrStorageFull {
+		t.Fatalf("a raw Set past MaxTotalBytes should fail with ErrStorageFull, got %v", err)
+	}
+	if raw.store.Stats().Bytes != 100 {
+		t.Fatalf("raw values should be accounted, got %d", raw.store.Stats().Bytes)
+	}
+}
+
+func Test_FileKeyRewrites(t *testing.T) {
+	defer os.RemoveAll("rewrites")
+	for _, f := range []file{NewFileStore(nil, "rewrites", "/"), NewSingleFileStore(nil, "rewrites", "/")} {
+		f = f.WithIndex("user_id", "owner")
+		sid := f.GenerateID()
+		find := func(key string, val interface{}) []string {
+			IDs, err := f.FindByValue(key, val)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return IDs
+		}
+		f.Patch(sid, "user_id", func(interface{}) interface{} { return 1 })
+		if IDs := find("user_id", 1); len(IDs) != 1 {
+			t.Fatalf("Patch should be indexed, got %v", IDs)
+		}
+		f.RenameKey(sid, "user_id", "owner")
+		if len(find("user_id", 1)) != 0 || len(find("owner", 1)) != 1 {
+			t.Fatal("RenameKey should be indexed")
+		}
+		f.MoveKey(sid, "owner", sid, "user_id")
+		if len(find("owner", 1)) != 0 || len(find("user_id", 1)) != 1 {
+			t.Fatal("MoveKey should be indexed")
+		}
+		f.GetOrSet(sid, "owner", func() (interface{}, error) { return 2, nil })
+		if len(find("owner", 2)) != 1 {
+			t.Fatal("GetOrSet should be indexed")
+		}
+		f.Flush()
+	}
+
+	f := NewFileStore(nil, "rewrites", "/")
+	val := strings.Repeat("v", 100)
+	n := int64(len(marshalVersioned(val, nil, newVersion())))
+	f.MaxTotalBytes = 2*n + n/2
+	sid := f.GenerateID()
+	f.Set(sid, "a", val)
+	f.Set(sid, "b", val)
+	if err := f.Patch(sid, "c", func(interface{}) interface{} { return val }); err != ErrStorageFull {
+		t.Fatalf("Patch should respect MaxTotalBytes, got %v", err)
+	}
+	if _, err := f.GetOrSet(sid, "c", func() (interface{}, error) { return val, nil }); err != ErrStorageFull {
+		t.Fatalf("GetOrSet should respect MaxTotalBytes, got %v", err)
+	}
+	if err := f.MoveKey(sid, "a", sid, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Stats().Bytes != n {
+		t.Fatalf("the overwritten key should be accounted, got %d", f.Stats().Bytes)
+	}
+
+	// room is made for the patched value
+	f.EvictOnFull = true
+	other := f.GenerateID()
+	f.Set(other, "a", val)
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(filepath.Join("rewrites", other), old, old)
+	if err := f.Patch(sid, "c", func(interface{}) interface{} { return val }); err != nil {
+		t.Fatal(err)
+	}
+	if f.Exists(other) || f.Get(sid, "c") != val {
+		t.Fatal("Patch should evict to make room")
+	}
+	f.Flush()
+}
+
+func Test_GCBatches(t *testing.T) {
+	m := NewMemoryStore(nil)
+	for i := 0; i < 10; i++ {
+		m.GenerateID()
+	}
+	start := time.Now()
+	collected, _ := m.GCWithOptions(0, time.Now().Add(time.Second), GCOptions{BatchSize: 3, BatchPause: 10 * time.Millisecond})
+	if collected != 10 || m.Count() != 0 {
+		t.Fatalf("every session should be collected, got %d", collected)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("the sweep should pause between batches, took %v", elapsed)
+	}
+
+	os.RemoveAll("batchdir")
+	defer os.RemoveAll("batchdir")
+	f := NewFileStore(nil, "batchdir", "/")
+	for i := 0; i < 4; i++ {
+		f.GenerateID()
+	}
+	start = time.Now()
+	if collected, _ := f.GCWithOptions(0, time.Now().Add(time.Second), GCOptions{BatchSize: 2, BatchPause: 10 * time.Millisecond}); collected != 4 {
+		t.Fatalf("every session should be collected, got %d", collected)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("the sweep should pause between batches, took %v", elapsed)
+	}
+}
+
+func Test_FileGCConcurrentExpire(t *testing.T) {
+	defer os.RemoveAll("gcexpire")
+	f := NewFileStore(nil, "gcexpire", "/").WithBloomFilter(1)
+	f.MaxTotalBytes = 1 << 30
+	kept := f.GenerateID()
+	f.Set(kept, "key", "val")
+	used := f.Stats().Bytes
+	old := time.Now().Add(-time.Hour)
+	var sids []string
+	for i := 0; i < 50; i++ {
+		sid := f.GenerateID()
+		f.Set(sid, "key", "val")
+		os.Chtimes(filepath.Join("gcexpire", sid), old, old)
+		sids = append(sids, sid)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		f.GC(time.Minute, time.Now())
+	}()
+	go func() {
+		defer wg.Done()
+		for _, sid := range sids {
+			f.Expire(sid)
+		}
+	}()
+	wg.Wait()
+	if !f.Exists(kept) || f.Stats().Bytes != used {
+		t.Fatalf("each session should be removed and accounted once, got %+v", f.Stats())
+	}
+
+	// a session refreshed since the root was read is not collected
+	if f.collect(kept, filepath.Join("gcexpire", kept), time.Minute, time.Now()) || !f.Exists(kept) {
+		t.Fatal("GC should not collect a fresh session")
+	}
+}
+
+func Test_FileVerify(t *testing.T) {
+	os.RemoveAll("verifydir")
+	defer os.RemoveAll("verifydir")
+	defer os.RemoveAll("quarantine")
+	for _, f := range []file{NewFileStore(nil, "verifydir", "/"), NewSingleFileStore(nil, "verifydir", "/")} {
+		sid := f.GenerateID()
+		f.Set(sid, "good", "val")
+		f.Set(sid, "bad", "val")
+		if corrupt, err := f.Verify(); err != nil || len(corrupt) != 0 {
+			t.Fatalf("unexpected corrupt files %v %v", corrupt, err)
+		}
+		bad := filepath.Join("verifydir", sid, "bad")
+		if f.singleFile {
+			bad = filepath.Join("verifydir", sid, sessionFile)
+		}
+		ioutil.WriteFile(bad, []byte("truncated"), permission)
+
+		corrupt, err := f.Verify()
+		if err != nil || len(corrupt) != 1 || corrupt[0] != bad {
+			t.Fatalf("expected %s to be corrupt, got %v %v", bad, corrupt, err)
+		}
+		if err := f.Repair(corrupt, "quarantine"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join("quarantine", sid, filepath.Base(bad))); err != nil {
+			t.Fatal("the corrupt file should be quarantined")
+		}
+		if corrupt, _ := f.Verify(); len(corrupt) != 0 {
+			t.Fatalf("no corrupt file should be left, got %v", corrupt)
+		}
+		if err := f.Repair([]string{"/etc/passwd"}, ""); err != ErrInvalidKey {
+			t.Fatalf("paths outside the root should be rejected, got %v", err)
+		}
+	}
+}
+
+func Test_FileIDLength(t *testing.T) {
+	id := strings.Repeat("a", 300)
+	f := NewFileStore(func() string { return id }, "dir", "/")
+	if _, err := f.GenerateIDWithError(); err != ErrIDTooLong {
+		t.Fatalf("expected ErrIDTooLong, got %v", err)
+	}
+	f.MaxIDLength = 8
+	id = "123456789"
+	if _, err := f.Create(nil); err != ErrIDTooLong {
+		t.Fatalf("expected ErrIDTooLong from Create, got %v", err)
+	}
+	id = ""
+	if _, err := f.GenerateIDWithError(); err != ErrInvalidKey {
+		t.Fatalf("expected ErrInvalidKey for an empty ID, got %v", err)
+	}
+	if f.GenerateID() != "" {
+		t.Fatal("GenerateID should give up on an empty ID")
+	}
+	if err := f.Set("", "key", "val"); err != ErrInvalidKey {
+		t.Fatalf("Set should reject an empty ID, got %v", err)
+	}
+}
+
+func Test_FileReadCache(t *testing.T) {
+	f := NewFileStore(nil, "dir", "/").WithReadCache(2)
+	sid := f.GenerateID()
+	f.Set(sid, "key", "val")
+	f.Get(sid, "key")
+	// a write behind the store is not seen while the key is cached
+	ioutil.WriteFile(filepath.Join("dir", sid, "key"), marshal("behind"), permission)
+	if f.Get(sid, "key").(string) != "val" {
+		t.Fatal("the value should be served from the cache")
+	}
+	f.Set(sid, "key", "new")
+	if f.Get(sid, "key").(string) != "new" {
+		t.Fatal("Set should invalidate the key")
+	}
+	f.Delete(sid, "key")
+	if f.Get(sid, "key") != nil {
+		t.Fatal("Delete should invalidate the key")
+	}
+	f.Set(sid, "key", "val")
+	f.Get(sid, "key")
+	f.Expire(sid)
+	if f.Get(sid, "key") != nil {
+		t.Fatal("Expire should invalidate the session")
+	}
+
+	sid = f.GenerateID()
+	for _, key := range []string{"a", "b", "c"} {
+		f.Set(sid, key, key)
+		f.Get(sid, key)
+	}
+	if f.cache.entries.contains(cacheKey{sid, "a"}) || !f.cache.entries.contains(cacheKey{sid, "c"}) {
+		t.Fatal("the least recently read key should be evicted")
+	}
+}
+
+func benchmarkFileGet(b *testing.B, f file) {
+	sid := f.GenerateID()
+	f.Set(sid, "key", "value")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Get(sid, "key")
+	}
+}
+
+func Benchmark_FileGet(b *testing.B) {
+	benchmarkFileGet(b, NewFileStore(nil, "dir", "/"))
+}
+
+func Benchmark_FileGetCached(b *testing.B) {
+	benchmarkFileGet(b, NewFileStore(nil, "dir", "/").WithReadCache(1024))
+}
+
+func Test_UpdateIfStale(t *testing.T) {
+	for _, store := range []interface {
+		SessionStore
+		UpdateIfStale(ID string, threshold time.Duration) (bool, error)
+	}{NewMemoryStore(nil), NewFileStore(nil, "dir", "/")} {
+		sid := store.GenerateID()
+		if updated, err := store.UpdateIfStale(sid, time.Hour); err != nil || updated {
+			t.Fatalf("%T: a fresh session should not be updated, got %v %v", store, updated, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if updated, err := store.UpdateIfStale(sid, 10*time.Millisecond); err != nil || !updated {
+			t.Fatalf("%T: a stale session should be updated, got %v %v", store, updated, err)
+		}
+		if updated, _ := store.UpdateIfStale(sid, 10*time.Millisecond); updated {
+			t.Fatalf("%T: the session was just updated", store)
+		}
+		if _, err := store.UpdateIfStale("unknown", 0); err != ErrSessionNotFound {
+			t.Fatalf("%T: expected ErrSessionNotFound, got %v", store, err)
+		}
+	}
+}
+
+func Test_Renew(t *testing.T) {
+	m, f := NewMemoryStore(nil), NewFileStore(nil, "dir", "/")
+	for _, store := range []interface {
+		SessionStore
+		Renew(ID string, extend time.Duration) error
+		UpdateIfStale(ID string, threshold time.Duration) (bool, error)
+	}{m, f} {
+		sid := store.GenerateID()
+		if err := store.Renew(sid, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if updated, err := store.UpdateIfStale(sid, 0); err != nil || updated {
+			t.Fatalf("%T: a renewed session should not be stale, got %v %v", store, updated, err)
+		}
+		if err := store.Renew(sid, -time.Hour); err != ErrNegativeExtend {
+			t.Fatalf("%T: expected ErrNegativeExtend, got %v", store, err)
+		}
+		if err := store.Renew("unknown", time.Hour); err != ErrSessionNotFound {
+			t.Fatalf("%T: expected ErrSessionNotFound, got %v", store, err)
+		}
+		store.Expire(sid)
+	}
+	m.IDValidator, f.IDValidator = func(string) error { return ErrInvalidKey }, func(string) error { return ErrInvalidKey }
+	for _, store := range []interface {
+		Renew(ID string, extend time.Duration) error
+	}{m, f} {
+		if err := store.Renew("any", time.Hour); err != ErrInvalidKey {
+			t.Fatalf("%T: the validator should reject the ID, got %v", store, err)
+		}
+	}
+	m.IDValidator = nil
+	sid := m.GenerateID()
+	m.Set(sid, "key", "val")
+	m.Drain(NewMemoryStore(nil))
+	if err := m.Renew(sid, time.Hour); err != ErrReadOnly {
+		t.Fatalf("a drained store should not renew, got %v", err)
+	}
+}
+
+func Test_MemorySnapshot(t *testing.T) {
+	m := NewMemoryStore(nil)
+	fresh, stale := m.GenerateID(), m.GenerateID()
+	m.Set(fresh, "key", specialType{})
+	m.SetWithMeta(fresh, "n", 1, map[string]string{"type": "counter"})
+	m.Set(stale, "key", "value")
+	m.shard(stale).data[stale].lastUpdate = time.Now().Add(-time.Hour)
+	var buf bytes.Buffer
+	if err := m.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMemoryStore(nil)
+	if err := restored.LoadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Count() != 2 || restored.Stats().Bytes != m.Stats().Bytes {
+		t.Fatalf("the sessions should be restored, got %+v", restored.Stats())
+	}
+	if restored.Get(fresh, "key").(specialType) != (specialType{}) {
+		t.Fatal("values should be restored")
+	}
+	if _, meta, err := restored.GetWithMeta(fresh, "n"); err != nil || meta["type"] != "counter" {
+		t.Fatalf("metadata should be restored, got %v %v", meta, err)
+	}
+	restored.GC(time.Minute, time.Now())
+	if restored.Get(stale, "key") != nil || restored.Get(fresh, "key") == nil {
+		t.Fatal("sessions should keep their last update")
+	}
+	if err := NewMemoryStore(nil).LoadFrom(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("a truncated snapshot should fail with io.ErrUnexpectedEOF, got %v", err)
+	}
+	// a length far beyond the data
+	corrupt := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	if err := NewMemoryStore(nil).LoadFrom(bytes.NewReader(corrupt)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("a corrupt snapshot should fail with io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+type mapReserver struct {
+	taken map[string]bool
+	err   error
+}
+
+func (r *mapReserver) Reserve(ID string) (bool, error) {
+	if r.err != nil || r.taken[ID] {
+		return false, r.err
+	}
+	r.taken[ID] = true
+	return true, nil
+}
+
+func Test_IDReserver(t *testing.T) {
+	shared := &mapReserver{taken: make(map[string]bool)}
+	newStore := func() *memory {
+		ids := []string{"a", "a", "b"}
+		m := NewMemoryStore(func() string {
+			id := ids[0]
+			ids = ids[1:]
+			return id
+		})
+		m.Reserver = shared
+		return m
+	}
+	first, second := newStore(), newStore()
+	if id := first.GenerateID(); id != "a" {
+		t.Fatalf("expected a, got %s", id)
+	}
+	if id := second.GenerateID(); id != "b" {
+		t.Fatalf("an ID reserved by another store should be skipped, got %s", id)
+	}
+	shared.err = fmt.Errorf("unreachable")
+	if _, err := NewMemoryStore(nil).GenerateIDWithPrefix(""); err != nil {
+		t.Fatal("stores with no reserver should not be affected")
+	}
+	m := newStore()
+	if _, err := m.GenerateIDWithPrefix(""); err != shared.err {
+		t.Fatalf("reserver errors should be returned, got %v", err)
+	}
+	if m.Count() != 0 {
+		t.Fatal("no session should be created when the reservation fails")
+	}
+}
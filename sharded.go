@@ -0,0 +1,150 @@
+// sharded store
+package session
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+var _ SessionStore = new(sharded)
+
+// sharded routes each session to one of several stores by the hash of its ID
+type sharded struct {
+	shards []SessionStore
+	hash   func(ID string) int
+	next   uint32
+}
+
+// NewShardedStore spreads the sessions over shards, a session lives in
+// shards[hash(ID) % len(shards)]. A nil hash defaults to FNV-1a. GC, Flush,
+// ForEach and Count run on every shard.
+//
+// Routing depends on the number of shards: adding or removing a shard
+// routes most existing sessions to a shard that does not hold them, they
+// are lost unless moved beforehand. Keep the shards and hash unchanged for
+// the lifetime of the sessions. It panics if shards is empty
+func NewShardedStore(shards []SessionStore, hash func(ID string) int) *sharded {
+	if len(shards) == 0 {
+		panic("session: no shard")
+	}
+	if hash == nil {
+		hash = func(ID string) int {
+			h := fnv.New32a()
+			h.Write([]byte(ID))
+			return int(h.Sum32())
+		}
+	}
+	return &sharded{shards: shards, hash: hash}
+}
+
+// index is the shard holding the session
+func (s *sharded) index(ID string) int {
+	i := s.hash(ID) % len(s.shards)
+	if i < 0 {
+		i += len(s.shards)
+	}
+	return i
+}
+
+func (s *sharded) shard(ID string) SessionStore {
+	return s.shards[s.index(ID)]
+}
+
+// generateTries bounds the IDs generated per shard by GenerateID
+const generateTries = 16
+
+// GenerateID generates on the shards in turn. An ID the hash routes to
+// another shard is expired and generated again, so this costs about as
+// many tries as there are shards. It returns an empty ID when the shard
+// does, or when no ID routing to the shard came out of generateTries times
+// the number of shards, with a hash never picking it for instance
+func (s *sharded) GenerateID() string {
+	i := int(atomic.AddUint32(&s.next, 1) % uint32(len(s.shards)))
+	for try := 0; try < generateTries*len(s.shards); try++ {
+		ID := s.shards[i].GenerateID()
+		if ID == "" {
+			return ""
+		}
+		if s.index(ID) == i {
+			return ID
+		}
+		s.shards[i].Expire(ID)
+	}
+	return ""
+}
+
+func (s *sharded) Set(ID string, key string, val interface{}) error {
+	return s.shard(ID).Set(ID, key, val)
+}
+
+func (s *sharded) Get(ID string, key string) interface{} {
+	return s.shard(ID).Get(ID, key)
+}
+
+func (s *sharded) GetWithError(ID string, key string) (interface{}, error) {
+	return getWithError(s.shard(ID), ID, key)
+}
+
+func (s *sharded) Delete(ID string, key string) error {
+	return s.shard(ID).Delete(ID, key)
+}
+
+func (s *sharded) Update(ID string) error {
+	return s.shard(ID).Update(ID)
+}
+
+func (s *sharded) Expire(ID string) error {
+	return s.shard(ID).Expire(ID)
+}
+
+// Flush flushes every shard, returning the first error
+func (s *sharded) Flush() (err error) {
+	for _, shard := range s.shards {
+		if ferr := shard.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	return
+}
+
+func (s *sharded) GC(lifeTime time.Duration, timeNow time.Time) {
+	for _, shard := range s.shards {
+		shard.GC(lifeTime, timeNow)
+	}
+}
+
+// ForEach calls fn with the ID of every session of the shards able to list
+// them, such as the memory and file stores, shard after shard. It stops at
+// the first error of a shard or of fn and returns it
+func (s *sharded) ForEach(fn func(ID string) error) error {
+	for _, shard := range s.shards {
+		lister, ok := shard.(interface {
+			ListByActivity(limit int) ([]SessionInfo, error)
+		})
+		if !ok {
+			continue
+		}
+		infos, err := lister.ListByActivity(0)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if err := fn(info.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Count sums the sessions of the shards that count them, such as the memory
+// store
+func (s *sharded) Count() (n int) {
+	for _, shard := range s.shards {
+		if c, ok := shard.(interface{ Count() int }); ok {
+			n += c.Count()
+		}
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ShardedStore(t *testing.T) {
+	shards := []*memory{NewMemoryStore(nil), NewMemoryStore(nil), NewMemoryStore(nil)}
+	s := NewShardedStore([]SessionStore{shards[0], shards[1], shards[2]}, nil)
+	var IDs []string
+	for i := 0; i < 30; i++ {
+		ID := s.GenerateID()
+		if err := s.Set(ID, "n", i); err != nil {
+			t.Fatal(err)
+		}
+		IDs = append(IDs, ID)
+	}
+	for i, ID := range IDs {
+		if s.Get(ID, "n").(int) != i {
+			t.Fatalf("session %v should route to the shard it was generated on", ID)
+		}
+	}
+	if s.Count() != 30 {
+		t.Fatalf("expected 30 sessions, got %v", s.Count())
+	}
+	for i, shard := range shards {
+		if shard.Count() != 10 {
+			t.Fatalf("shard %v should hold a third of the sessions, got %v", i, shard.Count())
+		}
+	}
+	seen := make(map[string]bool)
+	if err := s.ForEach(func(ID string) error {
+		seen[ID] = true
+		return nil
+	}); err != nil || len(seen) != 30 {
+		t.Fatalf("ForEach should visit every session, got %v %v", len(seen), err)
+	}
+	s.Expire(IDs[0])
+	if _, err := s.GetWithError(IDs[0], "n"); err != ErrSessionNotFound {
+		t.Fatalf("error should be ErrSessionNotFound but get %v", err)
+	}
+	s.GC(0, time.Now().Add(time.Second))
+	if s.Count() != 0 {
+		t.Fatalf("GC should run on every shard, %v sessions left", s.Count())
+	}
+}
+
+func Test_ShardedGenerateID(t *testing.T) {
+	// a hash never routing to the second shard
+	s := NewShardedStore([]SessionStore{NewMemoryStore(nil), NewMemoryStore(nil)}, func(string) int { return 0 })
+	if ID := s.GenerateID(); ID != "" {
+		t.Fatalf("no ID can route to the second shard, got %v", ID)
+	}
+	if ID := s.GenerateID(); ID == "" {
+		t.Fatal("the first shard should generate")
+	}
+	s = NewShardedStore([]SessionStore{NewMemoryStore(func() string { return "" })}, nil)
+	if ID := s.GenerateID(); ID != "" {
+		t.Fatalf("a shard failing to generate should give an empty ID, got %v", ID)
+	}
+}
@@ -0,0 +1,39 @@
+// session ID signing
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// SignID appends an HMAC-SHA256 of id to it, for example to put it in a
+// cookie the client can not forge
+func SignID(id string, secret []byte) string {
+	return id + "." + base64.RawURLEncoding.EncodeToString(signature(id, secret))
+}
+
+// VerifyID returns the ID signed by SignID with the same secret, ok is false
+// when signed was not produced by SignID or was tampered with
+func VerifyID(signed string, secret []byte) (id string, ok bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil {
+		return "", false
+	}
+	id = signed[:i]
+	if !hmac.Equal(sig, signature(id, secret)) {
+		return "", false
+	}
+	return id, true
+}
+
+func signature(id string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,29 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_SignID(t *testing.T) {
+	secret := []byte("secret")
+	signed := SignID("some.id", secret)
+	if id, ok := VerifyID(signed, secret); !ok || id != "some.id" {
+		t.Fatalf("VerifyID should return the signed ID, got %q %v", id, ok)
+	}
+	if _, ok := VerifyID(signed, []byte("other")); ok {
+		t.Fatal("another secret should not verify")
+	}
+	for _, forged := range []string{
+		"",
+		"some.id",
+		strings.Replace(signed, "some", "same", 1),
+		signed[:len(signed)-1],
+		signed + "A",
+		"other." + signed[strings.LastIndex(signed, ".")+1:],
+	} {
+		if _, ok := VerifyID(forged, secret); ok {
+			t.Fatalf("%q should not verify", forged)
+		}
+	}
+}
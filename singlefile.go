@@ -0,0 +1,182 @@
+// single file layout of the file store
+package session
+
+import (
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sessionFile holds the whole session in the single file layout
+const sessionFile = "session.gob"
+
+// NewSingleFileStore is a file store keeping each session in a single file
+// root/<id>/session.gob instead of one file per key.
+//
+// Set and Delete read, modify and rewrite the whole session under a
+// per-session lock, so writes cost more as a session grows, while reading
+// or listing every key of a session is a single read and a session uses a
+// single inode. The file is replaced atomically by renaming a temporary file
+func NewSingleFileStore(IDGenerator func() string, rootPath string, pathSeparator string) file {
+	f := NewFileStore(IDGenerator, rootPath, pathSeparator)
+	f.singleFile = true
+	return f
+}
+
+// sessionLocks serializes operations on a session with a fixed set of
+// mutexes, sessions hashing to the same mutex share it
+type sessionLocks [64]sync.Mutex
+
+func (l *sessionLocks) index(ID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(ID))
+	return int(h.Sum32() % uint32(len(l)))
+}
+
+func (l *sessionLocks) withLock(ID string, f func()) {
+	mu := &l[l.index(ID)]
+	mu.Lock()
+	defer mu.Unlock()
+	f()
+}
+
+// withLocks locks both sessions, always in the same order so concurrent
+// callers can not deadlock
+func (l *sessionLocks) withLocks(ID1, ID2 string, f func()) {
+	i, j := l.index(ID1), l.index(ID2)
+	if i > j {
+		i, j = j, i
+	}
+	l[i].Lock()
+	defer l[i].Unlock()
+	if j != i {
+		l[j].Lock()
+		defer l[j].Unlock()
+	}
+	f()
+}
+
+// readSession loads the values and metadata of a session, a session with no
+// file yet is empty
+func (f file) readSession(ID string) (map[string]interface{}, map[string]map[string]string, error) {
+	values, metas, _, err := f.readVersionedSession(ID)
+	return values, metas, err
+}
+
+// readVersionedSession is readSession also returning the version of the
+// session, 0 for a session with no file yet
+func (f file) readVersionedSession(ID string) (map[string]interface{}, map[string]map[string]string, uint64, error) {
+	if ID == "" || !f.mayExist(ID) {
+		return nil, nil, 0, ErrSessionNotFound
+	}
+	path, err := f.filePath(ID, sessionFile)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return nil, nil, 0, ErrSessionNotFound
+		}
+		return make(map[string]interface{}), make(map[string]map[string]string), 0, nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	values, metas, version := unmarshalVersionedSession(b)
+	return values, metas, version, nil
+}
+
+// writeSession atomically replaces the session file, under a new version
+func (f file) writeSession(ID string, values map[string]interface{}, metas map[string]map[string]string) error {
+	return f.writeVersionedSession(ID, values, metas, newVersion())
+}
+
+func (f file) writeVersionedSession(ID string, values map[string]interface{}, metas map[string]map[string]string, version uint64) error {
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return err
+	}
+	if err := f.writeSessionIn(directory, values, metas, version); err != nil {
+		return err
+	}
+	f.churn.add(ID)
+	return nil
+}
+
+// writeSessionIn writes the session file in directory, the directory of a
+// session or a staging directory
+func (f file) writeSessionIn(directory string, values map[string]interface{}, metas map[string]map[string]string, version uint64) error {
+	tmp := sessionFile + ".tmp"
+	if err := f.writeFileIn(directory, tmp, marshalSession(values, metas, version)); err != nil {
+		return err
+	}
+	size := fileSize(filepath.Join(directory, sessionFile))
+	if err := os.Rename(filepath.Join(directory, tmp), filepath.Join(directory, sessionFile)); err != nil {
+		return err
+	}
+	f.track(-size)
+	if f.Durable {
+		return syncDir(directory)
+	}
+	return nil
+}
+
+// modifySession runs a read-modify-write of the session under its lock
+func (f file) modifySession(ID string, modify func(values map[string]interface{}, metas map[string]map[string]string) error) (err error) {
+	f.locks.withLock(ID, func() {
+		var values map[string]interface{}
+		var metas map[string]map[string]string
+		if values, metas, err = f.readSession(ID); err != nil {
+			return
+		}
+		if err = modify(values, metas); err != nil {
+			return
+		}
+		err = f.writeSession(ID, values, metas)
+	})
+	return
+}
+
+// moveSessionKey moves a key between sessions of the single file layout.
+// The destination is written first, so a crash in between leaves the value
+// in both sessions rather than in none
+func (f file) moveSessionKey(srcID, srcKey, dstID, dstKey string) (err error) {
+	f.locks.withLocks(srcID, dstID, func() {
+		var srcValues map[string]interface{}
+		var srcMetas map[string]map[string]string
+		if srcValues, srcMetas, err = f.readSession(srcID); err != nil {
+			return
+		}
+		dstValues, dstMetas := srcValues, srcMetas
+		if dstID != srcID {
+			if dstValues, dstMetas, err = f.readSession(dstID); err != nil {
+				return
+			}
+		}
+		val, ok := srcValues[srcKey]
+		if !ok {
+			err = ErrKeyNotFound
+			return
+		}
+		if _, ok := dstValues[dstKey]; !ok && dstID != srcID && f.MaxKeysPerSession > 0 && len(dstValues) >= f.MaxKeysPerSession {
+			err = ErrTooManyKeys
+			return
+		}
+		meta := srcMetas[srcKey]
+		delete(srcValues, srcKey)
+		delete(srcMetas, srcKey)
+		dstValues[dstKey] = val
+		delete(dstMetas, dstKey)
+		if meta != nil {
+			dstMetas[dstKey] = meta
+		}
+		if err = f.writeSession(dstID, dstValues, dstMetas); err != nil || dstID == srcID {
+			return
+		}
+		err = f.writeSession(srcID, srcValues, srcMetas)
+	})
+	return
+}
@@ -0,0 +1,131 @@
+// snapshots of the memory store
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// SaveTo writes every session, with its values, metadata and last update,
+// to w so LoadFrom can restore them after a restart. Values are gob
+// encoded, a value gob can not encode fails the save. Each shard is
+// encoded under its read lock, the snapshot is not atomic across shards
+func (m *memory) SaveTo(w io.Writer) error {
+	for _, s := range m.shards {
+		var buf bytes.Buffer
+		var err error
+		s.withReadLock(func() {
+			for ID, d := range s.data {
+				if err = writeSnapshot(&buf, ID, d); err != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSnapshot writes a header record with the ID and last update of the
+// session followed by a record of its values and metadata
+func writeSnapshot(buf *bytes.Buffer, ID string, d *memoryElement) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("session: snapshot of %s: %v", ID, r)
+		}
+	}()
+	lastUpdate, err := d.lastUpdate.MarshalText()
+	if err != nil {
+		return err
+	}
+	header := marshalWithMeta(nil, map[string]string{"id": ID, "lastUpdate": string(lastUpdate)})
+	body := marshalSession(d.data, d.meta, 0)
+	writeRecord(buf, header)
+	writeRecord(buf, body)
+	return nil
+}
+
+// LoadFrom restores the sessions saved by SaveTo, replacing the sessions
+// with the same ID. Sessions keep their last update, those expired while
+// the store was down are left to GC. A snapshot cut short fails with
+// io.ErrUnexpectedEOF, the sessions read so far are kept
+func (m *memory) LoadFrom(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		header, err := readRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		body, err := readRecord(br)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		ID, d, err := readSnapshot(header, body)
+		if err != nil {
+			return err
+		}
+		m.restore(ID, d)
+	}
+}
+
+func readSnapshot(header, body []byte) (ID string, d *memoryElement, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("session: corrupt snapshot: %v", r)
+		}
+	}()
+	_, meta := unmarshalWithMeta(header)
+	d = &memoryElement{}
+	if err = d.lastUpdate.UnmarshalText([]byte(meta["lastUpdate"])); err != nil {
+		return
+	}
+	d.data, d.meta = unmarshalSession(body)
+	return meta["id"], d, nil
+}
+
+// restore inserts a loaded session, its keys are considered written at its
+// last update
+func (m *memory) restore(ID string, d *memoryElement) {
+	d.modTimes = make(map[string]time.Time, len(d.data))
+	for key, val := range d.data {
+		d.modTimes[key] = d.lastUpdate
+		m.stamp(d, key)
+		d.bytes += m.sizeOf(key, val)
+	}
+	s, added := m.shard(ID), false
+	s.withWriteLock(func() {
+		if old, ok := s.data[ID]; ok {
+			atomic.AddInt64(&m.bytes, -old.bytes)
+			m.index.remove(ID)
+		} else {
+			atomic.AddInt64(&m.size, 1)
+			added = true
+		}
+		d.id = ID
+		s.data[ID] = d
+		atomic.AddInt64(&m.bytes, d.bytes)
+		m.resize(d)
+		m.index.setAll(ID, d.data)
+	})
+	if added && m.eviction != nil {
+		m.eviction.Add(ID)
+		m.evict()
+		return
+	}
+	m.grown()
+}
@@ -0,0 +1,101 @@
+// serving stale values during outages
+package session
+
+import "time"
+
+var _ SessionStore = new(staleOnError)
+
+// staleOnError reads through inner, keeping the values read in cache so
+// they can still be served while inner fails
+type staleOnError struct {
+	inner SessionStore
+	cache SessionStore
+
+	// OnStale, if set, is called when a value of cache is served because
+	// inner failed with err
+	OnStale func(ID, key string, err error)
+}
+
+// NewStaleOnErrorStore serves from cache the last value read or written
+// through it when a Get on inner fails. Mutations go to inner first and
+// fail when it fails. IDs come from inner, so cache must create sessions on
+// Set, see MissingSessionCreate
+func NewStaleOnErrorStore(inner SessionStore, cache SessionStore) *staleOnError {
+	return &staleOnError{inner: inner, cache: cache}
+}
+
+func (s *staleOnError) GenerateID() string {
+	return s.inner.GenerateID()
+}
+
+func (s *staleOnError) Set(ID string, key string, val interface{}) error {
+	if err := s.inner.Set(ID, key, val); err != nil {
+		return err
+	}
+	s.cache.Set(ID, key, val)
+	return nil
+}
+
+func (s *staleOnError) Get(ID string, key string) interface{} {
+	val, _ := s.GetWithError(ID, key)
+	return val
+}
+
+// GetWithError returns the error of inner only when cache has no value to
+// serve instead. Absent keys and sessions are not failures, they are
+// dropped from cache
+func (s *staleOnError) GetWithError(ID string, key string) (interface{}, error) {
+	val, err := getWithError(s.inner, ID, key)
+	switch err {
+	case nil:
+		s.cache.Set(ID, key, val)
+		return val, nil
+	case ErrKeyNotFound:
+		s.cache.Delete(ID, key)
+		return nil, err
+	case ErrSessionNotFound:
+		s.cache.Expire(ID)
+		return nil, err
+	}
+	stale, cerr := getWithError(s.cache, ID, key)
+	if cerr != nil {
+		return nil, err
+	}
+	if s.OnStale != nil {
+		s.OnStale(ID, key, err)
+	}
+	return stale, nil
+}
+
+func (s *staleOnError) Delete(ID string, key string) error {
+	if err := s.inner.Delete(ID, key); err != nil {
+		return err
+	}
+	return s.cache.Delete(ID, key)
+}
+
+func (s *staleOnError) Update(ID string) error {
+	if err := s.inner.Update(ID); err != nil {
+		return err
+	}
+	return s.cache.Update(ID)
+}
+
+func (s *staleOnError) Expire(ID string) error {
+	if err := s.inner.Expire(ID); err != nil {
+		return err
+	}
+	return s.cache.Expire(ID)
+}
+
+func (s *staleOnError) Flush() error {
+	if err := s.inner.Flush(); err != nil {
+		return err
+	}
+	return s.cache.Flush()
+}
+
+func (s *staleOnError) GC(lifeTime time.Duration, timeNow time.Time) {
+	s.inner.GC(lifeTime, timeNow)
+	s.cache.GC(lifeTime, timeNow)
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"errors"
+	"testing"
+)
+
+var errOutage = errors.New("backend unreachable")
+
+// flaky fails every read while down
+type flaky struct {
+	*memory
+	down bool
+}
+
+func (f *flaky) GetWithError(ID string, key string) (interface{}, error) {
+	if f.down {
+		return nil, errOutage
+	}
+	return f.memory.GetWithError(ID, key)
+}
+
+func Test_StaleOnErrorStore(t *testing.T) {
+	inner := &flaky{memory: NewMemoryStore(nil)}
+	cache := NewMemoryStore(nil)
+	cache.OnMissingSession = MissingSessionCreate
+	s := NewStaleOnErrorStore(inner, cache)
+	var served []string
+	s.OnStale = func(ID, key string, err error) {
+		if err != errOutage {
+			t.Fatalf("the error of inner should be reported, got %v", err)
+		}
+		served = append(served, key)
+	}
+	sid := s.GenerateID()
+	s.Set(sid, "user", "alice")
+	inner.Set(sid, "lang", "fr")
+	if s.Get(sid, "lang").(string) != "fr" {
+		t.Fatal("reads should go to inner")
+	}
+
+	inner.down = true
+	if s.Get(sid, "user").(string) != "alice" || s.Get(sid, "lang").(string) != "fr" {
+		t.Fatal("the last known values should be served during the outage")
+	}
+	if len(served) != 2 {
+		t.Fatalf("OnStale should be called for each stale value, got %v", served)
+	}
+	if _, err := s.GetWithError(sid, "absent"); err != errOutage {
+		t.Fatalf("the error should be returned when there is no stale value, got %v", err)
+	}
+
+	inner.down = false
+	s.Delete(sid, "lang")
+	inner.down = true
+	if s.Get(sid, "lang") != nil {
+		t.Fatal("deleted keys should not be served")
+	}
+}
@@ -0,0 +1,88 @@
+// switchable store
+package session
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ SessionStore = new(switchable)
+	_ Pinger       = new(switchable)
+)
+
+// switchable delegates to a store that can be replaced at runtime
+type switchable struct {
+	current atomic.Value
+
+	// serializes Switch so each caller gets back the store it replaced
+	lock sync.Mutex
+}
+
+// holder keeps atomic.Value's concrete type the same whatever the store is
+type holder struct {
+	SessionStore
+}
+
+func NewSwitchableStore(store SessionStore) *switchable {
+	s := new(switchable)
+	s.current.Store(holder{store})
+	return s
+}
+
+func (s *switchable) store() SessionStore {
+	return s.current.Load().(holder).SessionStore
+}
+
+// Switch atomically replaces the delegate and returns the previous one.
+// Operations already running finish on the previous store, so it should be
+// drained before being flushed or closed
+func (s *switchable) Switch(store SessionStore) SessionStore {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old := s.store()
+	s.current.Store(holder{store})
+	return old
+}
+
+func (s *switchable) GenerateID() string {
+	return s.store().GenerateID()
+}
+
+func (s *switchable) Set(ID string, key string, val interface{}) error {
+	return s.store().Set(ID, key, val)
+}
+
+func (s *switchable) Get(ID string, key string) interface{} {
+	return s.store().Get(ID, key)
+}
+
+func (s *switchable) Delete(ID string, key string) error {
+	return s.store().Delete(ID, key)
+}
+
+func (s *switchable) Update(ID string) error {
+	return s.store().Update(ID)
+}
+
+func (s *switchable) Expire(ID string) error {
+	return s.store().Expire(ID)
+}
+
+func (s *switchable) Flush() error {
+	return s.store().Flush()
+}
+
+func (s *switchable) GC(lifeTime time.Duration, timeNow time.Time) {
+	s.store().GC(lifeTime, timeNow)
+}
+
+// Ping pings the current store if it is a Pinger
+func (s *switchable) Ping(ctx context.Context) error {
+	if p, ok := s.store().(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package session
+
+import (
+	"sync"
+	"testing"
+)
+
+func Test_SwitchableStore(t *testing.T) {
+	first := NewMemoryStore(nil)
+	s := NewSwitchableStore(first)
+	sid := s.GenerateID()
+	s.Set(sid, "key", "first")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Get(sid, "key")
+			}
+		}()
+	}
+	second := NewMemoryStore(nil)
+	if old := s.Switch(second); old != SessionStore(first) {
+		t.Fatal("Switch should return the replaced store")
+	}
+	wg.Wait()
+
+	if s.Get(sid, "key") != nil {
+		t.Fatal("reads should go to the new store")
+	}
+	nsid := s.GenerateID()
+	s.Set(nsid, "key", "second")
+	if second.Get(nsid, "key").(string) != "second" {
+		t.Fatal("writes should go to the new store")
+	}
+	if first.Get(sid, "key").(string) != "first" {
+		t.Fatal("the old store should be left untouched")
+	}
+}
@@ -0,0 +1,291 @@
+// session tags
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tag is a key and value pair labelling sessions
+type tag struct {
+	key, value string
+}
+
+// tagIndex maps the tags of the memory store to their sessions and back
+type tagIndex struct {
+	ids  map[tag]map[string]struct{}
+	of   map[string]map[string]string
+	lock sync.RWMutex
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{ids: make(map[tag]map[string]struct{}), of: make(map[string]map[string]string)}
+}
+
+// set merges tags into those of the session, an empty value removes the tag
+func (x *tagIndex) set(ID string, tags map[string]string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	current := x.of[ID]
+	if current == nil {
+		current = make(map[string]string)
+		x.of[ID] = current
+	}
+	for key, value := range tags {
+		if old, ok := current[key]; ok {
+			x.unindex(ID, tag{key, old})
+			delete(current, key)
+		}
+		if value == "" {
+			continue
+		}
+		current[key] = value
+		t := tag{key, value}
+		if x.ids[t] == nil {
+			x.ids[t] = make(map[string]struct{})
+		}
+		x.ids[t][ID] = struct{}{}
+	}
+	if len(current) == 0 {
+		delete(x.of, ID)
+	}
+}
+
+func (x *tagIndex) unindex(ID string, t tag) {
+	delete(x.ids[t], ID)
+	if len(x.ids[t]) == 0 {
+		delete(x.ids, t)
+	}
+}
+
+func (x *tagIndex) tagsOf(ID string) map[string]string {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	tags := make(map[string]string, len(x.of[ID]))
+	for key, value := range x.of[ID] {
+		tags[key] = value
+	}
+	return tags
+}
+
+func (x *tagIndex) find(key, value string) []string {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	IDs := make([]string, 0, len(x.ids[tag{key, value}]))
+	for ID := range x.ids[tag{key, value}] {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+	return IDs
+}
+
+// remove drops the tags of the sessions
+func (x *tagIndex) remove(IDs ...string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for _, ID := range IDs {
+		for key, value := range x.of[ID] {
+			x.unindex(ID, tag{key, value})
+		}
+		delete(x.of, ID)
+	}
+}
+
+func (x *tagIndex) reset() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.ids = make(map[tag]map[string]struct{})
+	x.of = make(map[string]map[string]string)
+}
+
+// Tag merges tags into those of the session, an empty value removes the
+// tag. Tags are dropped with the session
+func (m *memory) Tag(ID string, tags map[string]string) (err error) {
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
+	s := m.shard(ID)
+	// under the session lock, so a session expiring meanwhile is either
+	// untagged after or never tagged
+	s.withWriteLock(func() {
+		if _, ok := s.data[ID]; !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		m.tags.set(ID, tags)
+	})
+	return
+}
+
+// TagsOf returns a copy of the tags of the session
+func (m *memory) TagsOf(ID string) (tags map[string]string, err error) {
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return nil, err
+	}
+	s := m.shard(ID)
+	s.withReadLock(func() {
+		if _, ok := s.data[ID]; !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		tags = m.tags.tagsOf(ID)
+	})
+	return
+}
+
+// FindByTag returns the sessions tagged key=value, sorted
+func (m *memory) FindByTag(key, value string) ([]string, error) {
+	return m.tags.find(key, value), nil
+}
+
+// tagsDirectory holds a file per tagged session of the file store
+const tagsDirectory = ".tags"
+
+func (f file) tagsPath(ID string) (string, error) {
+	if _, err := f.directoryPath(ID); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.root, tagsDirectory, ID), nil
+}
+
+func readTags(path string) (tags map[string]string, err error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if recover() != nil {
+			err = &os.PathError{Op: "decode", Path: path, Err: ErrInvalidKey}
+		}
+	}()
+	tags, _ = unmarshal(b).(map[string]string)
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	return tags, nil
+}
+
+// Tag merges tags into those of the session, an empty value removes the
+// tag. The tags of a session are kept in root/.tags/<ID> and removed with
+// the session
+func (f file) Tag(ID string, tags map[string]string) (err error) {
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
+	path, err := f.tagsPath(ID)
+	if err != nil {
+		return err
+	}
+	// under the session lock, so a session expiring meanwhile is either
+	// untagged after or never tagged
+	f.locks.withLock(ID, func() {
+		if !f.Exists(ID) {
+			err = ErrSessionNotFound
+			return
+		}
+		var current map[string]string
+		if current, err = readTags(path); err != nil {
+			return
+		}
+		for key, value := range tags {
+			if value == "" {
+				delete(current, key)
+			} else {
+				current[key] = value
+			}
+		}
+		if len(current) == 0 {
+			if err = os.Remove(path); os.IsNotExist(err) {
+				err = nil
+			}
+			return
+		}
+		err = writeTags(path, current)
+	})
+	if isStorageFull(err) {
+		err = ErrStorageFull
+	}
+	return
+}
+
+// writeTags replaces the tags file through a temporary file, so FindByTag
+// never reads it half written
+func writeTags(path string, tags map[string]string) error {
+	directory := filepath.Dir(path)
+	if err := os.MkdirAll(directory, permission); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(directory, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(marshal(tags))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// untag removes the tags of a removed session
+func (f file) untag(ID string) {
+	path, err := f.tagsPath(ID)
+	if err != nil {
+		return
+	}
+	f.locks.withLock(ID, func() {
+		os.Remove(path)
+	})
+}
+
+// TagsOf returns the tags of the session
+func (f file) TagsOf(ID string) (map[string]string, error) {
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return nil, err
+	}
+	if !f.Exists(ID) {
+		return nil, ErrSessionNotFound
+	}
+	path, err := f.tagsPath(ID)
+	if err != nil {
+		return nil, err
+	}
+	return readTags(path)
+}
+
+// FindByTag returns the sessions tagged key=value, sorted. It reads the
+// tags of every tagged session
+func (f file) FindByTag(key, value string) ([]string, error) {
+	IDs := make([]string, 0)
+	fis, err := ioutil.ReadDir(filepath.Join(f.root, tagsDirectory))
+	if os.IsNotExist(err) {
+		return IDs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		tags, err := readTags(filepath.Join(f.root, tagsDirectory, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		// a crash may leave the tags of a removed session behind
+		if tags[key] == value && f.Exists(fi.Name()) {
+			IDs = append(IDs, fi.Name())
+		}
+	}
+	return IDs, nil
+}
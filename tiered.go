@@ -0,0 +1,131 @@
+// tiered store
+package session
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var _ SessionStore = new(tiered)
+
+// tiered keeps the values of a slow, usually shared, store in a fast one
+type tiered struct {
+	fast SessionStore
+	slow SessionStore
+
+	// see Metrics
+	metrics *storeCounters
+
+	// serialize the writes of a session with the fills of fast, so a value
+	// read from slow before a write is not put in fast after it
+	locks sessionLocks
+}
+
+// NewTieredStore reads from fast first, falling back to slow and filling
+// fast with what it read. Writes go to slow then, synchronously, to fast,
+// so a Get following a Set in the same process sees the new value, and a
+// fill never overwrites a value written meanwhile. A fast tier of another
+// process is not told, it serves its copy until the key is written through
+// it or the session is collected; use GetConsistent when the authoritative
+// value is needed. IDs come from slow, so fast must create sessions on Set,
+// see MissingSessionCreate
+func NewTieredStore(fast, slow SessionStore) *tiered {
+	return &tiered{fast: fast, slow: slow, metrics: new(storeCounters)}
+}
+
+func (t *tiered) GenerateID() string {
+	return t.slow.GenerateID()
+}
+
+// Set fails when slow fails, fast is then left as it was
+func (t *tiered) Set(ID string, key string, val interface{}) (err error) {
+	atomic.AddInt64(&t.metrics.sets, 1)
+	t.locks.withLock(ID, func() {
+		if err = t.slow.Set(ID, key, val); err == nil {
+			err = t.fast.Set(ID, key, val)
+		}
+	})
+	return
+}
+
+func (t *tiered) Get(ID string, key string) interface{} {
+	val, _ := t.GetWithError(ID, key)
+	return val
+}
+
+func (t *tiered) GetWithError(ID string, key string) (interface{}, error) {
+	atomic.AddInt64(&t.metrics.gets, 1)
+	if val, err := getWithError(t.fast, ID, key); err == nil {
+		atomic.AddInt64(&t.metrics.hits, 1)
+		return val, nil
+	}
+	atomic.AddInt64(&t.metrics.misses, 1)
+	var val interface{}
+	var err error
+	t.locks.withLock(ID, func() {
+		if val, err = getWithError(t.slow, ID, key); err == nil {
+			t.fast.Set(ID, key, val)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// GetConsistent reads slow, bypassing fast, and refreshes fast with the
+// value read
+func (t *tiered) GetConsistent(ID string, key string) (val interface{}, err error) {
+	atomic.AddInt64(&t.metrics.gets, 1)
+	t.locks.withLock(ID, func() {
+		val, err = getWithError(t.slow, ID, key)
+		switch err {
+		case nil:
+			t.fast.Set(ID, key, val)
+		case ErrKeyNotFound:
+			t.fast.Delete(ID, key)
+		case ErrSessionNotFound:
+			t.fast.Expire(ID)
+		}
+	})
+	return
+}
+
+func (t *tiered) Delete(ID string, key string) (err error) {
+	atomic.AddInt64(&t.metrics.deletes, 1)
+	t.locks.withLock(ID, func() {
+		if err = t.slow.Delete(ID, key); err == nil {
+			err = t.fast.Delete(ID, key)
+		}
+	})
+	return
+}
+
+func (t *tiered) Update(ID string) error {
+	if err := t.slow.Update(ID); err != nil {
+		return err
+	}
+	return t.fast.Update(ID)
+}
+
+func (t *tiered) Expire(ID string) (err error) {
+	t.locks.withLock(ID, func() {
+		if err = t.slow.Expire(ID); err == nil {
+			err = t.fast.Expire(ID)
+		}
+	})
+	return
+}
+
+func (t *tiered) Flush() error {
+	if err := t.slow.Flush(); err != nil {
+		return err
+	}
+	return t.fast.Flush()
+}
+
+func (t *tiered) GC(lifeTime time.Duration, timeNow time.Time) {
+	defer t.metrics.swept(time.Now())
+	t.slow.GC(lifeTime, timeNow)
+	t.fast.GC(lifeTime, timeNow)
+}
@@ -0,0 +1,74 @@
+package session
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_TieredStore(t *testing.T) {
+	slow := NewMemoryStore(nil)
+	newFast := func() *memory {
+		fast := NewMemoryStore(nil)
+		fast.OnMissingSession = MissingSessionCreate
+		return fast
+	}
+	fast := newFast()
+	s := NewTieredStore(fast, slow)
+	sid := s.GenerateID()
+	s.Set(sid, "key", "first")
+	if fast.Get(sid, "key").(string) != "first" || s.Get(sid, "key").(string) != "first" {
+		t.Fatal("a Set should be read back from the fast tier")
+	}
+
+	// another process sharing slow
+	other := NewTieredStore(newFast(), slow)
+	if other.Get(sid, "key").(string) != "first" {
+		t.Fatal("a miss should fall back to slow")
+	}
+	s.Set(sid, "key", "second")
+	if other.Get(sid, "key").(string) != "first" {
+		t.Fatal("the fast tier of another process keeps its copy")
+	}
+	if val, err := other.GetConsistent(sid, "key"); err != nil || val.(string) != "second" {
+		t.Fatalf("GetConsistent should read slow, got %v %v", val, err)
+	}
+	if other.Get(sid, "key").(string) != "second" {
+		t.Fatal("GetConsistent should refresh the fast tier")
+	}
+	slow.Delete(sid, "key")
+	if _, err := other.GetConsistent(sid, "key"); err != ErrKeyNotFound || other.Get(sid, "key") != nil {
+		t.Fatalf("a key deleted from slow should be dropped from fast, got %v", err)
+	}
+}
+
+// slowReads returns late from its reads, once the value is read
+type slowReads struct {
+	*memory
+}
+
+func (s slowReads) GetWithError(ID string, key string) (interface{}, error) {
+	val, err := s.memory.GetWithError(ID, key)
+	time.Sleep(50 * time.Millisecond)
+	return val, err
+}
+
+func Test_TieredFillRace(t *testing.T) {
+	slow, fast := NewMemoryStore(nil), NewMemoryStore(nil)
+	fast.OnMissingSession = MissingSessionCreate
+	s := NewTieredStore(fast, slowReads{slow})
+	sid := s.GenerateID()
+	slow.Set(sid, "key", "old")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Get(sid, "key")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Set(sid, "key", "new")
+	wg.Wait()
+	if fast.Get(sid, "key") != "new" {
+		t.Fatalf("a fill should not overwrite a later Set, fast holds %v", fast.Get(sid, "key"))
+	}
+}
@@ -0,0 +1,104 @@
+// tracing of store operations
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+var _ SessionStore = new(tracedStore)
+
+// Tracer starts a span for a store operation and returns the func ending
+// it with the error of the operation, if any. The package does not depend
+// on OpenTelemetry, an adapter calls trace.Tracer.Start with the operation
+// as span name and the attributes, and span.RecordError and span.End in the
+// returned func
+type Tracer interface {
+	Start(op string, attributes map[string]string) (end func(err error))
+}
+
+// tracedStore runs each operation of inner in a span
+type tracedStore struct {
+	inner  SessionStore
+	tracer Tracer
+}
+
+// NewTracedStore wraps inner so each operation is traced by tracer. Spans
+// are named after the operation, "session.set" for Set, and carry the key
+// and a hash of the session ID, never the ID itself
+func NewTracedStore(inner SessionStore, tracer Tracer) *tracedStore {
+	return &tracedStore{inner, tracer}
+}
+
+// hashID identifies a session in traces without revealing its ID
+func hashID(ID string) string {
+	sum := sha256.Sum256([]byte(ID))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (t *tracedStore) start(op, ID, key string) func(error) {
+	attributes := make(map[string]string, 2)
+	if ID != "" {
+		attributes["session.id_hash"] = hashID(ID)
+	}
+	if key != "" {
+		attributes["session.key"] = key
+	}
+	return t.tracer.Start("session."+op, attributes)
+}
+
+func (t *tracedStore) GenerateID() string {
+	end := t.start("generate", "", "")
+	ID := t.inner.GenerateID()
+	end(nil)
+	return ID
+}
+
+func (t *tracedStore) Set(ID string, key string, val interface{}) error {
+	end := t.start("set", ID, key)
+	err := t.inner.Set(ID, key, val)
+	end(err)
+	return err
+}
+
+func (t *tracedStore) Get(ID string, key string) interface{} {
+	end := t.start("get", ID, key)
+	val := t.inner.Get(ID, key)
+	end(nil)
+	return val
+}
+
+func (t *tracedStore) Delete(ID string, key string) error {
+	end := t.start("delete", ID, key)
+	err := t.inner.Delete(ID, key)
+	end(err)
+	return err
+}
+
+func (t *tracedStore) Update(ID string) error {
+	end := t.start("update", ID, "")
+	err := t.inner.Update(ID)
+	end(err)
+	return err
+}
+
+func (t *tracedStore) Expire(ID string) error {
+	end := t.start("expire", ID, "")
+	err := t.inner.Expire(ID)
+	end(err)
+	return err
+}
+
+func (t *tracedStore) Flush() error {
+	end := t.start("flush", "", "")
+	err := t.inner.Flush()
+	end(err)
+	return err
+}
+
+func (t *tracedStore) GC(lifeTime time.Duration, timeNow time.Time) {
+	end := t.start("gc", "", "")
+	t.inner.GC(lifeTime, timeNow)
+	end(nil)
+}
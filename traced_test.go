@@ -0,0 +1,65 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+type recordedSpan struct {
+	op         string
+	attributes map[string]string
+	err        error
+	ended      bool
+}
+
+// spanRecorder keeps the spans in memory
+type spanRecorder struct {
+	spans []*recordedSpan
+}
+
+func (r *spanRecorder) Start(op string, attributes map[string]string) func(error) {
+	span := &recordedSpan{op: op, attributes: attributes}
+	r.spans = append(r.spans, span)
+	return func(err error) {
+		span.err, span.ended = err, true
+	}
+}
+
+func Test_TracedStore(t *testing.T) {
+	recorder := new(spanRecorder)
+	inner := NewMemoryStore(nil)
+	inner.IDValidator = func(ID string) error {
+		if ID == "" {
+			return ErrInvalidKey
+		}
+		return nil
+	}
+	s := NewTracedStore(inner, recorder)
+	sid := s.GenerateID()
+	s.Set(sid, "key", "val")
+	s.Get(sid, "key")
+	s.Update("")
+
+	var ops []string
+	for _, span := range recorder.spans {
+		if !span.ended {
+			t.Fatalf("span %s should be ended", span.op)
+		}
+		ops = append(ops, span.op)
+	}
+	if strings.Join(ops, " ") != "session.generate session.set session.get session.update" {
+		t.Fatalf("expected a span per operation, got %v", ops)
+	}
+	set := recorder.spans[1]
+	if set.attributes["session.key"] != "key" || set.attributes["session.id_hash"] != hashID(sid) {
+		t.Fatalf("unexpected attributes %v", set.attributes)
+	}
+	for _, value := range set.attributes {
+		if value == sid {
+			t.Fatal("the session ID should not be recorded")
+		}
+	}
+	if recorder.spans[3].err != ErrInvalidKey {
+		t.Fatalf("the error should be recorded, got %v", recorder.spans[3].err)
+	}
+}
@@ -0,0 +1,206 @@
+// soft-deleted sessions
+package session
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trashed is a session of the memory store expired at at
+type trashed struct {
+	d  *memoryElement
+	at time.Time
+}
+
+// sessionTrash keeps the sessions of the memory store expired within their
+// grace period, see ExpireGrace
+type sessionTrash struct {
+	sessions map[string]trashed
+	lock     sync.Mutex
+}
+
+func newSessionTrash() *sessionTrash {
+	return &sessionTrash{sessions: make(map[string]trashed)}
+}
+
+func (t *sessionTrash) put(ID string, d *memoryElement, at time.Time) {
+	t.lock.Lock()
+	t.sessions[ID] = trashed{d, at}
+	t.lock.Unlock()
+}
+
+// take removes the session from the trash, ok is false when it is absent
+// or its grace period is over
+func (t *sessionTrash) take(ID string, now time.Time, grace time.Duration) (d *memoryElement, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.sessions[ID]
+	delete(t.sessions, ID)
+	if !ok || s.at.Add(grace).Before(now) {
+		return nil, false
+	}
+	return s.d, true
+}
+
+// purge drops the sessions whose grace period is over
+func (t *sessionTrash) purge(now time.Time, grace time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for ID, s := range t.sessions {
+		if s.at.Add(grace).Before(now) {
+			delete(t.sessions, ID)
+		}
+	}
+}
+
+func (t *sessionTrash) reset() {
+	t.lock.Lock()
+	t.sessions = make(map[string]trashed)
+	t.lock.Unlock()
+}
+
+// Recover brings back a session expired less than ExpireGrace ago, with its
+// values and metadata but without its tags, as if just updated. It fails
+// with ErrSessionNotFound once the grace period is over, and with
+// ErrKeyExists when a new session took the ID meanwhile, the expired one
+// being dropped
+func (m *memory) Recover(ID string) (err error) {
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return err
+	}
+	d, ok := m.trash.take(ID, time.Now(), m.ExpireGrace)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		if m.readOnly() {
+			err = ErrReadOnly
+			return
+		}
+		if _, ok := s.data[ID]; ok {
+			err = ErrKeyExists
+			return
+		}
+		d.lastUpdate = time.Now()
+		s.data[ID] = d
+		atomic.AddInt64(&m.size, 1)
+		atomic.AddInt64(&m.bytes, d.bytes)
+		m.resize(d)
+		m.index.setAll(ID, d.data)
+	})
+	if err == nil && m.eviction != nil {
+		m.eviction.Add(ID)
+		m.evict()
+	}
+	return
+}
+
+// trashDirectory holds the sessions of the file store expired within their
+// grace period, see ExpireGrace
+const trashDirectory = ".trash"
+
+func (f file) trashPath(ID string) (string, error) {
+	if _, err := f.directoryPath(ID); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.root, trashDirectory, ID), nil
+}
+
+// moveToTrash moves the directory of an expired session to the trash, its
+// modification time marking when it expired
+func (f file) moveToTrash(ID, directory string) error {
+	path, err := f.trashPath(ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), permission); err != nil {
+		return err
+	}
+	// a session expired earlier under the same ID
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	if err := os.Rename(directory, path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// purgeTrash removes the sessions whose grace period is over
+func (f file) purgeTrash(t time.Time) {
+	directory := filepath.Join(f.root, trashDirectory)
+	fis, err := ioutil.ReadDir(directory)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+	for _, fi := range fis {
+		if fi.ModTime().Add(f.ExpireGrace).Before(t) {
+			if err := os.RemoveAll(filepath.Join(directory, fi.Name())); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// Recover brings back a session expired less than ExpireGrace ago, with its
+// values and metadata but without its tags, as if just updated. It fails
+// with ErrSessionNotFound once the grace period is over, and with
+// ErrKeyExists when a new session took the ID meanwhile
+func (f file) Recover(ID string) error {
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return err
+	}
+	path, err := f.trashPath(ID)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Add(f.ExpireGrace).Before(time.Now()) {
+		return ErrSessionNotFound
+	}
+	if f.Exists(ID) {
+		return ErrKeyExists
+	}
+	if err := os.Rename(path, directory); err != nil {
+		if os.IsNotExist(err) {
+			// purged meanwhile
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	now := time.Now()
+	if err := os.Chtimes(directory, now, now); err != nil {
+		return err
+	}
+	if f.filter != nil {
+		f.filter.add(ID)
+	}
+	if f.tracking() {
+		f.track(du(directory))
+	}
+	f.reindex(ID)
+	return nil
+}
@@ -0,0 +1,173 @@
+// per key TTL of the file store
+package session
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ttlMode marks the key files whose modification time is their deadline
+const ttlMode = permission | os.ModeSticky
+
+// expiredKey reports whether a key file has a TTL which ran out before t
+func expiredKey(info os.FileInfo, t time.Time) bool {
+	return info.Mode()&os.ModeSticky != 0 && info.ModTime().Before(t)
+}
+
+// SetWithTTL sets a key expiring after ttl, independently of its session.
+// The key file gets the sticky bit and its deadline as modification time,
+// so `ls -l` shows both. Reads treat the key as absent once the deadline is
+// past and GC removes it if SweepExpiredKeys is set. A key never outlives
+// its session: the session expires on the modification time of its
+// directory, which key deadlines do not change. KeyModTime returns the
+// deadline of such a key. A later Set drops the TTL. The single file layout
+// does not support it.
+//
+// It needs a file system keeping the sticky bit of files, as Linux does:
+// Windows drops it and the BSDs refuse it, SetWithTTL fails there
+func (f file) SetWithTTL(ID string, key string, val interface{}, ttl time.Duration) error {
+	key = f.normalize(key)
+	if f.singleFile {
+		return fmt.Errorf("session: SetWithTTL needs one file per key")
+	}
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return err
+	}
+	if ID == "" {
+		return ErrInvalidKey
+	}
+	return f.storeValueUntil(ID, key, val, nil, time.Now().Add(ttl))
+}
+
+// writeFileUntil writes the key file with its TTL mode and deadline under a
+// temporary name in the root, then renames it over the key, so no read sees
+// the value without its deadline
+func (f file) writeFileUntil(ID, key string, b []byte, deadline time.Time) (err error) {
+	defer func() {
+		if isStorageFull(err) {
+			err = ErrStorageFull
+		}
+	}()
+	path, err := f.filePath(ID, key)
+	if err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(f.root, ".ttl")
+	if err != nil {
+		return err
+	}
+	tmp := fd.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if _, err = fd.Write(b); err == nil && f.Durable {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, ttlMode); err != nil {
+		return err
+	}
+	info, err := os.Lstat(tmp)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("session: SetWithTTL needs a file system keeping the sticky bit of files")
+	}
+	if err = os.Chtimes(tmp, deadline, deadline); err != nil {
+		return err
+	}
+	old := fileSize(path)
+	if err = os.Rename(tmp, path); err != nil {
+		if _, serr := os.Stat(filepath.Dir(path)); os.IsNotExist(serr) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	f.track(int64(len(b)) - old)
+	if f.Durable {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// clearTTL drops the TTL of a key about to be overwritten, its modification
+// time would otherwise make it expire right away
+func (f file) clearTTL(ID, key string) error {
+	path, err := f.filePath(ID, key)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSticky == 0 {
+		return nil
+	}
+	return os.Chmod(path, permission)
+}
+
+// KeyExpiry returns the deadline of a key set with SetWithTTL, zero for
+// other keys
+func (f file) KeyExpiry(ID string, key string) (time.Time, error) {
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return time.Time{}, err
+	}
+	if f.singleFile {
+		return time.Time{}, nil
+	}
+	if err := f.thaw(ID); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := f.readFile(ID, key); err != nil {
+		return time.Time{}, err
+	}
+	path, err := f.filePath(ID, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, ErrKeyNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info.Mode()&os.ModeSticky == 0 {
+		return time.Time{}, nil
+	}
+	return info.ModTime(), nil
+}
+
+// sweepKeys removes the key files of a session expired by their TTL
+func (f file) sweepKeys(ID string, t time.Time) {
+	directory, err := f.directoryPath(ID)
+	if err != nil {
+		return
+	}
+	fis, err := ioutil.ReadDir(directory)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, info := range fis {
+		if expiredKey(info, t) {
+			if err := os.Remove(filepath.Join(directory, info.Name())); err != nil {
+				log.Println(err)
+				continue
+			}
+			f.track(-info.Size())
+			f.index.unset(ID, fileKey(info.Name()))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+//go:build go1.18
+// +build go1.18
+
+// typed session
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// typedKey holds the value of a TypedSession
+const typedKey = "typed"
+
+// TypedSession keeps a single value of type T per session, gob encoded with
+// its concrete type so it needs no registration and comes back as a T
+type TypedSession[T any] struct {
+	store SessionStore
+}
+
+// NewTypedSession stores the values of sessions in store, under a fixed key
+func NewTypedSession[T any](store SessionStore) TypedSession[T] {
+	return TypedSession[T]{store}
+}
+
+// Get returns the value of the session, ok is false when none was set
+func (s TypedSession[T]) Get(ID string) (v T, ok bool, err error) {
+	val, err := Session{SessionStore: s.store}.getWithError(ID, typedKey)
+	if err == ErrKeyNotFound {
+		return v, false, nil
+	}
+	if err != nil {
+		return v, false, err
+	}
+	b, isBytes := val.([]byte)
+	if !isBytes {
+		return v, false, fmt.Errorf("session: key %q holds %T, not encoded bytes", typedKey, val)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v); err != nil {
+		return v, false, err
+	}
+	return v, true, nil
+}
+
+// Set replaces the value of the session
+func (s TypedSession[T]) Set(ID string, v T) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return err
+	}
+	return s.store.Set(ID, typedKey, buf.Bytes())
+}
+
+// Delete removes the value of the session
+func (s TypedSession[T]) Delete(ID string) error {
+	return s.store.Delete(ID, typedKey)
+}
+
+// GetMapValue returns the value of subkey in the map held by key, stored as
+// a map[string]T or a map[string]interface{}. ok is false when the key or
+// the subkey is absent, a value that is not a map or a subkey holding
+// another type than T is an error
+func GetMapValue[T any](s Session, ID, key, subkey string) (v T, ok bool, err error) {
+	val, err := s.getWithError(ID, key)
+	if err == ErrKeyNotFound {
+		return v, false, nil
+	}
+	if err != nil {
+		return v, false, err
+	}
+	switch m := val.(type) {
+	case map[string]T:
+		v, ok = m[subkey]
+		return v, ok, nil
+	case map[string]interface{}:
+		item, ok := m[subkey]
+		if !ok {
+			return v, false, nil
+		}
+		if v, ok = item.(T); !ok {
+			return v, false, fmt.Errorf("session: subkey %q of key %q holds %T, not %T", subkey, key, item, v)
+		}
+		return v, true, nil
+	}
+	return v, false, fmt.Errorf("session: key %q holds %T, not a map", key, val)
+}
@@ -0,0 +1,63 @@
+//go:build go1.18
+// +build go1.18
+
+package session
+
+import "testing"
+
+type typedCart struct {
+	User  string
+	Items []string
+	Total float64
+}
+
+func Test_TypedSession(t *testing.T) {
+	for _, store := range []SessionStore{NewMemoryStore(nil), NewFileStore(nil, "dir", "/")} {
+		s := NewTypedSession[typedCart](store)
+		sid := store.GenerateID()
+		if _, ok, err := s.Get(sid); ok || err != nil {
+			t.Fatalf("%T: an empty session should hold no value, got %v %v", store, ok, err)
+		}
+		cart := typedCart{"gopher", []string{"book", "pen"}, 12.5}
+		if err := s.Set(sid, cart); err != nil {
+			t.Fatal(err)
+		}
+		got, ok, err := s.Get(sid)
+		if err != nil || !ok || got.User != cart.User || len(got.Items) != 2 || got.Total != cart.Total {
+			t.Fatalf("%T: unexpected value %+v %v %v", store, got, ok, err)
+		}
+		s.Delete(sid)
+		if _, ok, _ := s.Get(sid); ok {
+			t.Fatalf("%T: the value should be deleted", store)
+		}
+	}
+}
+
+func Test_GetMapValue(t *testing.T) {
+	for _, store := range []SessionStore{NewMemoryStore(nil), NewFileStore(nil, "dir", "/")} {
+		s := Session{SessionStore: store}
+		sid := store.GenerateID()
+		s.Set(sid, "scores", map[string]int{"alice": 3})
+		s.Set(sid, "profile", map[string]interface{}{"name": "gopher", "age": 12})
+		s.Set(sid, "name", "gopher")
+		if v, ok, err := GetMapValue[int](s, sid, "scores", "alice"); err != nil || !ok || v != 3 {
+			t.Fatalf("%T: expected 3, got %v %v %v", store, v, ok, err)
+		}
+		if v, ok, err := GetMapValue[string](s, sid, "profile", "name"); err != nil || !ok || v != "gopher" {
+			t.Fatalf("%T: expected gopher, got %v %v %v", store, v, ok, err)
+		}
+		if _, ok, err := GetMapValue[int](s, sid, "scores", "bob"); ok || err != nil {
+			t.Fatalf("%T: an absent subkey should not be found, got %v %v", store, ok, err)
+		}
+		if _, ok, err := GetMapValue[int](s, sid, "absent", "bob"); ok || err != nil {
+			t.Fatalf("%T: an absent key should not be found, got %v %v", store, ok, err)
+		}
+		if _, _, err := GetMapValue[int](s, sid, "profile", "name"); err == nil {
+			t.Fatalf("%T: a subkey of another type should fail", store)
+		}
+		if _, _, err := GetMapValue[string](s, sid, "name", "first"); err == nil {
+			t.Fatalf("%T: a value that is not a map should fail", store)
+		}
+		store.Expire(sid)
+	}
+}
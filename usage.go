@@ -0,0 +1,161 @@
+// disk usage of the file store
+package session
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// fileUsage tracks the bytes of the session files and archives of a root.
+// It starts with a scan of the root on first use and is kept up to date by
+// the writes and removals of the store from then on
+type fileUsage struct {
+	// bytes is first in the struct to be 64-bit aligned
+	bytes   int64
+	tracked int32
+	once    sync.Once
+}
+
+// startUsage scans the root once, then the changes are tracked
+func (f file) startUsage() {
+	f.usage.once.Do(func() {
+		var total int64
+		if fis, err := ioutil.ReadDir(f.root); err == nil {
+			for _, fi := range fis {
+				if !strings.HasPrefix(fi.Name(), ".") {
+					total += du(filepath.Join(f.root, fi.Name()))
+				}
+			}
+		}
+		atomic.StoreInt64(&f.usage.bytes, total)
+		atomic.StoreInt32(&f.usage.tracked, 1)
+	})
+}
+
+// track adds n bytes to the usage, once it is tracked
+func (f file) track(n int64) {
+	if n != 0 && atomic.LoadInt32(&f.usage.tracked) == 1 {
+		atomic.AddInt64(&f.usage.bytes, n)
+	}
+}
+
+// resetUsage empties the usage once the root is flushed
+func (f file) resetUsage() {
+	if f.tracking() {
+		atomic.StoreInt64(&f.usage.bytes, 0)
+	}
+}
+
+// tracking reports whether the changes of the usage must be measured
+func (f file) tracking() bool {
+	return atomic.LoadInt32(&f.usage.tracked) == 1
+}
+
+// du returns the bytes of the regular files under path, path included
+func du(path string) (total int64) {
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// fileSize returns the size of a file, 0 if it does not exist
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// reserve makes room for n more bytes under MaxTotalBytes, evicting the
+// least recently updated sessions other than ID when EvictOnFull is set,
+// otherwise failing with ErrStorageFull. Concurrent writes may overshoot
+// the cap by the size of their values. The caller holds f.flushing
+func (f file) reserve(ID string, n int64) error {
+	if f.MaxTotalBytes <= 0 {
+		return nil
+	}
+	f.startUsage()
+	if atomic.LoadInt64(&f.usage.bytes)+n <= f.MaxTotalBytes {
+		return nil
+	}
+	if !f.EvictOnFull {
+		return ErrStorageFull
+	}
+	infos, err := f.ListByActivity(0)
+	if err != nil {
+		return err
+	}
+	for i := len(infos) - 1; i >= 0; i-- {
+		if infos[i].ID == ID {
+			continue
+		}
+		if err := f.expire(infos[i].ID); err != nil {
+			return err
+		}
+		if atomic.LoadInt64(&f.usage.bytes)+n <= f.MaxTotalBytes {
+			return nil
+		}
+	}
+	return ErrStorageFull
+}
+
+// errNoRoom tells withRoom a write does not fit under MaxTotalBytes
+var errNoRoom = fmt.Errorf("session: no room under MaxTotalBytes")
+
+// withRoom runs write, which calls room with the bytes it is about to add
+// once it knows them, under the lock of the session for instance, and
+// returns what room returns without writing when it is not nil. When the
+// bytes do not fit write is run again once reserve made room for them,
+// room then lets it write without checking again
+func (f file) withRoom(ID string, write func(room func(n int64) error) error) error {
+	var need int64
+	err := write(func(n int64) error {
+		if f.MaxTotalBytes <= 0 {
+			return nil
+		}
+		f.startUsage()
+		if atomic.LoadInt64(&f.usage.bytes)+n <= f.MaxTotalBytes {
+			return nil
+		}
+		need = n
+		return errNoRoom
+	})
+	if err != errNoRoom {
+		return err
+	}
+	// reserve may expire sessions, which takes their locks, so room is made
+	// with no lock held
+	if err := f.reserve(ID, need); err != nil {
+		return err
+	}
+	return write(func(int64) error { return nil })
+}
+
+// Stats returns the number of sessions, archived ones included, and the
+// bytes of their files. The file store does not count collisions
+func (f file) Stats() Stats {
+	f.startUsage()
+	stats := Stats{Bytes: atomic.LoadInt64(&f.usage.bytes)}
+	fis, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return stats
+	}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if _, archived := archivedID(fi.Name()); fi.IsDir() || archived {
+			stats.Sessions++
+		}
+	}
+	return stats
+}
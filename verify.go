@@ -0,0 +1,91 @@
+// integrity check of the file store
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Verify decodes every value of the store and returns the paths of the
+// files that do not decode, for example written halfway before a crash.
+// Archived sessions are not checked
+func (f file) Verify() (corrupt []string, err error) {
+	fis, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		err := filepath.Walk(filepath.Join(f.root, fi.Name()), func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				// expired meanwhile
+				return nil
+			}
+			if err != nil || info.IsDir() {
+				return err
+			}
+			b, err := ioutil.ReadFile(path)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !decodes(b) {
+				corrupt = append(corrupt, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return corrupt, err
+		}
+	}
+	return corrupt, nil
+}
+
+// decodes reports whether b is a value or a session the store can decode
+func decodes(b []byte) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	unmarshal(b)
+	return true
+}
+
+// Repair moves the corrupt files returned by Verify to the quarantine
+// directory, keeping their path relative to the root, or removes them when
+// quarantine is empty. Paths outside the root are rejected with ErrInvalidKey
+func (f file) Repair(corrupt []string, quarantine string) error {
+	for _, path := range corrupt {
+		if !within(f.root, path) {
+			return ErrInvalidKey
+		}
+		size := fileSize(path)
+		if quarantine == "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			f.track(-size)
+			continue
+		}
+		rel, err := filepath.Rel(f.root, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(quarantine, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), permission); err != nil {
+			return err
+		}
+		if err := os.Rename(path, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		f.track(-size)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// on-disk format version of the file store
+package session
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// versionFile records the format version of a root, roots written before
+// it existed are version 1
+const versionFile = ".version"
+
+// formatVersion is the format the file store writes, a var for the tests.
+// Version 2 named key files by percent-encoding '%', the path separators
+// and NUL only, version 3 names them with encodeKey
+var formatVersion = 3
+
+var (
+	migrationsLock sync.RWMutex
+	migrations     = map[int]func(root string) error{1: escapeKeyFiles, 2: encodeKeyFiles}
+)
+
+// escapeKeyFiles renames the key files of the sessions under root to the
+// names given by encodeKey: a key holding '/' was a file in a
+// subdirectory, it becomes a file of the session directory. Archived
+// sessions keep their names until they are thawed
+func escapeKeyFiles(root string) error {
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		directory := filepath.Join(root, fi.Name())
+		var nested []string
+		err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == directory {
+				return nil
+			}
+			if info.IsDir() {
+				nested = append(nested, path)
+				return nil
+			}
+			key, err := filepath.Rel(directory, path)
+			if err != nil {
+				return err
+			}
+			name, err := encodeKey(filepath.ToSlash(key))
+			if err != nil {
+				return fmt.Errorf("key %q: %v", key, err)
+			}
+			if name != key {
+				return os.Rename(path, filepath.Join(directory, name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// deepest first, so each directory is empty by the time it is removed
+		for i := len(nested) - 1; i >= 0; i-- {
+			if err := os.Remove(nested[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeKeyFiles renames the key files of the sessions under root from
+// their version 2 names to the names given by encodeKey, which also encodes
+// the bytes version 2 kept, spaces and non-ASCII ones for instance.
+// Archived sessions keep their names until they are thawed
+func encodeKeyFiles(root string) error {
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		directory := filepath.Join(root, fi.Name())
+		files, err := ioutil.ReadDir(directory)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			key, err := url.PathUnescape(file.Name())
+			if err != nil {
+				key = file.Name()
+			}
+			name, err := encodeKey(key)
+			if err != nil {
+				return fmt.Errorf("key %q: %v", key, err)
+			}
+			if name != file.Name() {
+				if err := os.Rename(filepath.Join(directory, file.Name()), filepath.Join(directory, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// RegisterMigration registers the function upgrading the files under a
+// root from format version from to from+1. NewFileStore runs the
+// migrations a root needs before using it. It panics if migrate is nil or a
+// migration from the same version is already registered
+func RegisterMigration(from int, migrate func(root string) error) {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	if migrate == nil {
+		panic("session: nil migration")
+	}
+	if _, dup := migrations[from]; dup {
+		panic(fmt.Errorf("session: migration from version %d registered twice", from))
+	}
+	migrations[from] = migrate
+}
+
+// readVersion returns the format version of the root, an empty root has the
+// current one
+func readVersion(root string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(root, versionFile))
+	if err == nil {
+		version, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return 0, fmt.Errorf("session: corrupt version file in %s: %v", root, err)
+		}
+		return version, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	if len(fis) == 0 {
+		return formatVersion, nil
+	}
+	return 1, nil
+}
+
+func writeVersion(root string, version int) error {
+	tmp, err := ioutil.TempFile(root, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(strconv.Itoa(version) + "\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), permission); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(root, versionFile))
+}
+
+// checkVersion brings the root to the current format version, refusing a
+// root written by a newer version of the store
+func checkVersion(root string) error {
+	version, err := readVersion(root)
+	if err != nil {
+		return err
+	}
+	if version > formatVersion {
+		return fmt.Errorf("session: %s has format version %d, newer than %d", root, version, formatVersion)
+	}
+	if err := migrate(root, version, formatVersion); err != nil {
+		return err
+	}
+	return writeVersion(root, formatVersion)
+}
+
+// migrate runs the migrations from version from to version to in turn,
+// recording each version reached so an interrupted upgrade resumes there
+func migrate(root string, from, to int) error {
+	for version := from; version < to; version++ {
+		migrationsLock.RLock()
+		m, ok := migrations[version]
+		migrationsLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("session: no migration from format version %d of %s", version, root)
+		}
+		if err := m(root); err != nil {
+			return fmt.Errorf("session: migrating %s from format version %d: %v", root, version, err)
+		}
+		if err := writeVersion(root, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate upgrades the root of the store from format version from to
+// version to with the registered migrations, see RegisterMigration.
+// NewFileStore already runs it for a root older than the current version.
+// The store should not be used meanwhile
+func (f file) Migrate(from, to int) error {
+	if from > to {
+		return fmt.Errorf("session: can not migrate from format version %d down to %d", from, to)
+	}
+	return migrate(f.root, from, to)
+}
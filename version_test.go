@@ -0,0 +1,98 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_FormatVersion(t *testing.T) {
+	defer os.RemoveAll("migration")
+	s := NewFileStore(nil, "migration", "/")
+	sid := s.GenerateID()
+	s.Set(sid, "name", "gopher")
+	if version, err := readVersion("migration"); err != nil || version != 3 {
+		t.Fatalf("a new root should be at version 3, got %v %v", version, err)
+	}
+	s.Flush()
+	if _, err := os.Stat(filepath.Join("migration", versionFile)); err != nil {
+		t.Fatalf("Flush should keep the version file, got %v", err)
+	}
+	sid = s.GenerateID()
+	s.Set(sid, "name", "gopher")
+
+	// version 4 renames the key name to username
+	formatVersion = 4
+	defer func() {
+		formatVersion = 3
+		delete(migrations, 3)
+	}()
+	RegisterMigration(3, func(root string) error {
+		fis, err := ioutil.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			old := filepath.Join(root, fi.Name(), "name")
+			if err := os.Rename(old, filepath.Join(root, fi.Name(), "username")); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	s = NewFileStore(nil, "migration", "/")
+	if version, _ := readVersion("migration"); version != 4 {
+		t.Fatalf("the root should be migrated to version 4, got %v", version)
+	}
+	if s.Get(sid, "username") != "gopher" || s.Get(sid, "name") != nil {
+		t.Fatal("the migration should have renamed the key")
+	}
+
+	writeVersion("migration", 5)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("a root of a newer version should be refused")
+			}
+		}()
+		NewFileStore(nil, "migration", "/")
+	}()
+}
+
+func Test_EscapeKeyFiles(t *testing.T) {
+	defer os.RemoveAll("unescaped")
+	sid := "session"
+	os.MkdirAll(filepath.Join("unescaped", sid, "user"), permission)
+	ioutil.WriteFile(filepath.Join("unescaped", sid, "user", "name"), marshal("gopher"), permission)
+	ioutil.WriteFile(filepath.Join("unescaped", sid, "100%"), marshal("full"), permission)
+	ioutil.WriteFile(filepath.Join("unescaped", sid, "plain"), marshal("kept"), permission)
+	s := NewFileStore(nil, "unescaped", "/")
+	if s.Get(sid, "user/name") != "gopher" || s.Get(sid, "100%") != "full" || s.Get(sid, "plain") != "kept" {
+		t.Fatal("the migration should rename the key files to their escaped names")
+	}
+	if _, err := os.Stat(filepath.Join("unescaped", sid, "user")); !os.IsNotExist(err) {
+		t.Fatal("the migration should remove the directories of nested keys")
+	}
+}
+
+func Test_EncodeKeyFiles(t *testing.T) {
+	defer os.RemoveAll("reencoded")
+	sid := "session"
+	os.MkdirAll(filepath.Join("reencoded", sid), permission)
+	writeVersion("reencoded", 2)
+	ioutil.WriteFile(filepath.Join("reencoded", sid, "user%2Fname"), marshal("gopher"), permission)
+	ioutil.WriteFile(filepath.Join("reencoded", sid, "a b"), marshal("spaced"), permission)
+	ioutil.WriteFile(filepath.Join("reencoded", sid, "plain"), marshal("kept"), permission)
+	s := NewFileStore(nil, "reencoded", "/")
+	if s.Get(sid, "user/name") != "gopher" || s.Get(sid, "a b") != "spaced" || s.Get(sid, "plain") != "kept" {
+		t.Fatal("the migration should rename the key files to their encoded names")
+	}
+	if _, err := os.Stat(filepath.Join("reencoded", sid, "a%20b")); err != nil {
+		t.Fatalf("the key file should be renamed to its encoded name, got %v", err)
+	}
+}
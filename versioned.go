@@ -0,0 +1,221 @@
+// optimistic concurrency with version tokens
+package session
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// unversioned is the version of a value stored without one: written before
+// versions existed, by Append or by SetRaw. The versions of the file store
+// are larger
+const unversioned = 1
+
+// newVersion returns a random version for the file store, random so two
+// processes sharing a root do not give out the same versions. The top bit
+// is set so every version encodes to the same size
+func newVersion() uint64 {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(b) | 1<<63
+}
+
+// versionOf returns the version stamped in a decoded payload
+func versionOf(v map[string]interface{}) uint64 {
+	if version, ok := v[_VERSION].(uint64); ok {
+		return version
+	}
+	return unversioned
+}
+
+// stamp gives the key of the session a new version, under the session lock
+func (m *memory) stamp(d *memoryElement, key string) {
+	if d.versions == nil {
+		d.versions = make(map[string]uint64)
+	}
+	d.versions[key] = atomic.AddUint64(&m.version, 1)
+}
+
+// GetVersioned returns the value of key with its version, which changes on
+// every write of the key, see SetVersioned
+func (m *memory) GetVersioned(ID, key string) (val interface{}, version uint64, err error) {
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return nil, 0, err
+	}
+	s := m.shard(ID)
+	s.withReadLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if val, ok = d.data[key]; !ok {
+			err = ErrKeyNotFound
+			return
+		}
+		version = d.versions[key]
+	})
+	return
+}
+
+// SetVersioned sets key if its version is still expectedVersion, as
+// returned by GetVersioned, 0 expecting the key to be absent, and returns
+// the new version. It fails with ErrVersionConflict when the key was
+// written meanwhile, by any write, and drops the metadata like Set. The
+// session must exist.
+//
+// Versions come from a counter of the store, so a key deleted and set
+// again never gets back a version it had
+func (m *memory) SetVersioned(ID, key string, val interface{}, expectedVersion uint64) (version uint64, err error) {
+	atomic.AddInt64(&m.metrics.sets, 1)
+	key = m.normalize(key)
+	if err := validateID(m.IDValidator, ID); err != nil {
+		return 0, err
+	}
+	s := m.shard(ID)
+	s.withWriteLock(func() {
+		d, ok := s.data[ID]
+		if !ok {
+			err = ErrSessionNotFound
+			return
+		}
+		if d.versions[key] != expectedVersion {
+			err = ErrVersionConflict
+			return
+		}
+		if err = m.checkKeyLimit(d, key); err != nil {
+			return
+		}
+		m.put(d, key, val)
+		delete(d.meta, key)
+		version = d.versions[key]
+	})
+	if err == nil {
+		m.access(ID)
+		m.grown()
+		m.watchers.notify(ID, key, OpSet)
+	}
+	return
+}
+
+// GetVersioned returns the value of key with its version, which changes on
+// every write of the key, see SetVersioned. The version is stored in the
+// key file, in the single file layout it is the version of the session
+func (f file) GetVersioned(ID, key string) (val interface{}, version uint64, err error) {
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return nil, 0, err
+	}
+	if err := f.thaw(ID); err != nil {
+		return nil, 0, err
+	}
+	if f.singleFile {
+		values, _, version, err := f.readVersionedSession(ID)
+		if err != nil {
+			return nil, 0, err
+		}
+		val, ok := values[key]
+		if !ok {
+			return nil, 0, ErrKeyNotFound
+		}
+		return val, version, nil
+	}
+	// under the lock of the session, so a file SetVersioned is writing is
+	// not read half written
+	f.locks.withLock(ID, func() {
+		var b []byte
+		if b, err = f.readFile(ID, key); err == nil {
+			val, version = unmarshalVersioned(b)
+		}
+	})
+	return
+}
+
+// SetVersioned sets key if its version is still expectedVersion, as
+// returned by GetVersioned, 0 expecting the key to be absent, and returns
+// the new version. It fails with ErrVersionConflict when the key was
+// written meanwhile and drops the metadata like Set. The session must
+// exist.
+//
+// Versions are random, so they also tell apart the writes of processes
+// sharing the root. In the single file layout a write to any key of the
+// session conflicts. As with Patch, Set does not take the lock of the
+// session in the per key layout, so only the writes through SetVersioned
+// are serialized, and lists built by Append keep the same version
+func (f file) SetVersioned(ID, key string, val interface{}, expectedVersion uint64) (version uint64, err error) {
+	key = f.normalize(key)
+	if err := validateID(f.IDValidator, ID); err != nil {
+		return 0, err
+	}
+	f.flushing.RLock()
+	defer f.flushing.RUnlock()
+	defer f.cache.invalidate(ID, key)
+	defer func() {
+		if err == nil {
+			f.index.set(ID, key, val)
+		}
+	}()
+	if err := f.thaw(ID); err != nil {
+		return 0, err
+	}
+	if f.MaxTotalBytes > 0 {
+		if err := f.reserve(ID, int64(len(marshalVersioned(val, nil, newVersion())))); err != nil {
+			return 0, err
+		}
+	}
+	f.locks.withLock(ID, func() {
+		if f.singleFile {
+			version, err = f.setVersionedSession(ID, key, val, expectedVersion)
+			return
+		}
+		var current uint64
+		var b []byte
+		if b, err = f.readFile(ID, key); err == nil {
+			_, current = unmarshalVersioned(b)
+		} else if err != ErrKeyNotFound {
+			return
+		}
+		if current != expectedVersion {
+			err = ErrVersionConflict
+			return
+		}
+		if current == 0 {
+			if err = f.checkKeyLimit(ID, key); err != nil {
+				return
+			}
+		}
+		if err = f.clearTTL(ID, key); err != nil {
+			return
+		}
+		version = newVersion()
+		err = f.writeFile(ID, key, marshalVersioned(val, nil, version))
+	})
+	return
+}
+
+// setVersionedSession is SetVersioned in the single file layout, under the
+// lock of the session
+func (f file) setVersionedSession(ID, key string, val interface{}, expectedVersion uint64) (uint64, error) {
+	values, metas, version, err := f.readVersionedSession(ID)
+	if err != nil {
+		return 0, err
+	}
+	_, ok := values[key]
+	if !ok {
+		version = 0
+	}
+	if version != expectedVersion {
+		return 0, ErrVersionConflict
+	}
+	if !ok && f.MaxKeysPerSession > 0 && len(values) >= f.MaxKeysPerSession {
+		return 0, ErrTooManyKeys
+	}
+	values[key] = val
+	delete(metas, key)
+	version = newVersion()
+	return version, f.writeVersionedSession(ID, values, metas, version)
+}
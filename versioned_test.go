@@ -0,0 +1,71 @@
+package session
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+type versionedStore interface {
+	SessionStore
+	GetVersioned(ID, key string) (interface{}, uint64, error)
+	SetVersioned(ID, key string, val interface{}, expectedVersion uint64) (uint64, error)
+}
+
+func Test_Versioned(t *testing.T) {
+	defer os.RemoveAll("versioned")
+	defer os.RemoveAll("versioned1")
+	for _, s := range []versionedStore{NewFileStore(nil, "versioned", "/"), NewSingleFileStore(nil, "versioned1", "/"), NewMemoryStore(nil)} {
+		sid := s.GenerateID()
+		if _, _, err := s.GetVersioned(sid, "n"); err != ErrKeyNotFound {
+			t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+		}
+		v1, err := s.SetVersioned(sid, "n", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.SetVersioned(sid, "n", 0, 0); err != ErrVersionConflict {
+			t.Fatalf("setting a present key expecting it absent should conflict, got %v", err)
+		}
+		if val, v, err := s.GetVersioned(sid, "n"); err != nil || v != v1 || val.(int) != 0 {
+			t.Fatalf("expected 0 at version %d, got %v %d %v", v1, val, v, err)
+		}
+		s.Set(sid, "n", 1)
+		if _, err := s.SetVersioned(sid, "n", 2, v1); err != ErrVersionConflict {
+			t.Fatalf("a Set should change the version, got %v", err)
+		}
+
+		const workers, increments = 8, 20
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		conflicts := 0
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for done := 0; done < increments; {
+					val, v, err := s.GetVersioned(sid, "n")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := s.SetVersioned(sid, "n", val.(int)+1, v); err == ErrVersionConflict {
+						lock.Lock()
+						conflicts++
+						lock.Unlock()
+						continue
+					} else if err != nil {
+						t.Error(err)
+						return
+					}
+					done++
+				}
+			}()
+		}
+		wg.Wait()
+		if val := s.Get(sid, "n"); val.(int) != 1+workers*increments {
+			t.Fatalf("expected %d increments without a lost update, got %v after %d conflicts", workers*increments, val, conflicts)
+		}
+		s.Expire(sid)
+	}
+}
@@ -0,0 +1,318 @@
+// write-ahead log mode of the file store
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ SessionStore = new(wal)
+
+// walCompactEvery is the default number of logged operations between
+// compactions
+const walCompactEvery = 1000
+
+const (
+	walSet    = "set"
+	walDelete = "delete"
+)
+
+// walOp is a logged or buffered operation not yet written to the store,
+// see wal and writeBehind
+type walOp struct {
+	val     interface{}
+	deleted bool
+}
+
+// wal is a file store whose Set and Delete append a record to a single log
+// file instead of writing a file per key. Logged operations are kept in
+// memory to serve reads until a compaction writes them to the session files
+// and truncates the log. Session directories are still created, updated and
+// removed directly, so GenerateID, Update, Expire and GC cost what they cost
+// on the file store
+type wal struct {
+	store file
+	log   walLog
+
+	// pending holds the logged operations by session and key
+	pending map[string]map[string]walOp
+	ops     int
+
+	// Durable makes Set and Delete fsync the log before returning
+	Durable bool
+
+	// CompactEvery is the number of logged operations triggering a
+	// compaction, defaults to 1000
+	CompactEvery int
+
+	lock sync.Mutex
+}
+
+// walLog is the log file, an interface so tests can fail its writes
+type walLog interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+}
+
+// NewWALStore is a file store under rootPath logging writes to logPath,
+// which must lie outside rootPath. The log left by a previous run is
+// replayed and compacted first, a record cut short by a crash is dropped. A
+// failed append is cut from the log, so no torn record is followed by good
+// ones
+func NewWALStore(IDGenerator func() string, rootPath, logPath, pathSeparator string) (*wal, error) {
+	w := &wal{
+		store:        NewFileStore(IDGenerator, rootPath, pathSeparator),
+		pending:      make(map[string]map[string]walOp),
+		CompactEvery: walCompactEvery,
+	}
+	fd, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, permission)
+	if err != nil {
+		return nil, err
+	}
+	w.log = fd
+	w.replay()
+	if err := w.compact(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// replay loads the records of the log into pending
+func (w *wal) replay() {
+	r := bufio.NewReader(w.log)
+	for {
+		b, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		op, err := decodeWALRecord(b)
+		if err != nil {
+			break
+		}
+		w.apply(op.meta["id"], op.meta["key"], walOp{op.val, op.meta["op"] == walDelete})
+	}
+}
+
+type walRecord struct {
+	val  interface{}
+	meta map[string]string
+}
+
+func decodeWALRecord(b []byte) (r walRecord, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	r.val, r.meta = unmarshalWithMeta(b)
+	return
+}
+
+func (w *wal) apply(ID, key string, op walOp) {
+	keys, ok := w.pending[ID]
+	if !ok {
+		keys = make(map[string]walOp)
+		w.pending[ID] = keys
+	}
+	keys[key] = op
+	w.ops++
+}
+
+// append logs an operation and compacts once enough operations are logged
+func (w *wal) append(ID, key string, op walOp) (err error) {
+	defer func() {
+		if isStorageFull(err) {
+			err = ErrStorageFull
+		}
+	}()
+	name := walSet
+	if op.deleted {
+		name = walDelete
+	}
+	var record bytes.Buffer
+	writeRecord(&record, marshalWithMeta(op.val, map[string]string{"op": name, "id": ID, "key": key}))
+	offset, err := w.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.log.Write(record.Bytes()); err != nil {
+		// a partial write would hide the records appended after it from
+		// the replay
+		if rerr := w.rewind(offset); rerr != nil {
+			log.Println(rerr)
+		}
+		return err
+	}
+	if w.Durable {
+		if err := w.log.Sync(); err != nil {
+			return err
+		}
+	}
+	w.apply(ID, key, op)
+	if w.CompactEvery > 0 && w.ops >= w.CompactEvery {
+		return w.compact()
+	}
+	return nil
+}
+
+// Compact writes the logged operations to the session files and truncates
+// the log
+func (w *wal) Compact() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.compact()
+}
+
+// compact writes the logged operations, durably when the log is, before
+// truncating the log
+func (w *wal) compact() error {
+	store := w.store
+	store.Durable = store.Durable || w.Durable
+	for ID, keys := range w.pending {
+		for key, op := range keys {
+			var err error
+			if op.deleted {
+				if err = store.Delete(ID, key); os.IsNotExist(err) {
+					err = nil
+				}
+			} else {
+				err = store.Set(ID, key, op.val)
+			}
+			// sessions expired since the operation was logged are gone
+			if err != nil && store.Exists(ID) {
+				return err
+			}
+		}
+		// the deletions too must reach the disk before the log is gone
+		if w.Durable {
+			if err := w.syncSession(ID); err != nil {
+				return err
+			}
+		}
+	}
+	return w.truncate()
+}
+
+// syncSession flushes the directory of the session, if it still exists
+func (w *wal) syncSession(ID string) error {
+	directory, err := w.store.directoryPath(ID)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(directory); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// truncate empties the log and forgets the logged operations
+func (w *wal) truncate() error {
+	if err := w.rewind(0); err != nil {
+		return err
+	}
+	w.pending = make(map[string]map[string]walOp)
+	w.ops = 0
+	return nil
+}
+
+// rewind cuts the log at offset and appends from there
+func (w *wal) rewind(offset int64) error {
+	if err := w.log.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := w.log.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Close compacts and closes the log
+func (w *wal) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.compact()
+	if cerr := w.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *wal) GenerateID() string {
+	return w.store.GenerateID()
+}
+
+func (w *wal) Set(ID string, key string, val interface{}) error {
+	if err := validateID(w.store.IDValidator, ID); err != nil {
+		return err
+	}
+	if _, err := w.store.filePath(ID, key); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.store.Exists(ID) {
+		return ErrSessionNotFound
+	}
+	return w.append(ID, key, walOp{val: val})
+}
+
+func (w *wal) Get(ID string, key string) interface{} {
+	w.lock.Lock()
+	op, ok := w.pending[ID][key]
+	w.lock.Unlock()
+	if ok {
+		return op.val
+	}
+	return w.store.Get(ID, key)
+}
+
+func (w *wal) Delete(ID string, key string) error {
+	if err := validateID(w.store.IDValidator, ID); err != nil {
+		return err
+	}
+	if _, err := w.store.filePath(ID, key); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.store.Exists(ID) {
+		return nil
+	}
+	return w.append(ID, key, walOp{deleted: true})
+}
+
+func (w *wal) Update(ID string) error {
+	return w.store.Update(ID)
+}
+
+func (w *wal) Expire(ID string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.pending, ID)
+	return w.store.Expire(ID)
+}
+
+func (w *wal) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.truncate(); err != nil {
+		return err
+	}
+	return w.store.Flush()
+}
+
+// GC compacts first so no logged operation outlives its session
+func (w *wal) GC(lifeTime time.Duration, timeNow time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.compact(); err != nil {
+		log.Println(err)
+	}
+	w.store.GC(lifeTime, timeNow)
+}
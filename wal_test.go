@@ -0,0 +1,104 @@
+package session
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_WALStore(t *testing.T) {
+	defer os.RemoveAll("waldir")
+	defer os.Remove("wal.log")
+	w, err := NewWALStore(nil, "waldir", "wal.log", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := w.GenerateID()
+	w.Set(sid, "kept", "val")
+	w.Set(sid, "deleted", "val")
+	w.Delete(sid, "deleted")
+	if w.store.Get(sid, "kept") != nil {
+		t.Fatal("logged operations should not reach the session files before a compaction")
+	}
+	// a record cut short by a crash
+	w.log.Write([]byte{100, 1, 2})
+	w.log.Close()
+
+	if w, err = NewWALStore(nil, "waldir", "wal.log", "/"); err != nil {
+		t.Fatal(err)
+	}
+	if w.store.Get(sid, "kept").(string) != "val" || w.store.Get(sid, "deleted") != nil {
+		t.Fatal("the log should be replayed and compacted on open")
+	}
+	if info, _ := os.Stat("wal.log"); info.Size() != 0 {
+		t.Fatal("the log should be truncated by the compaction")
+	}
+
+	w.CompactEvery = 2
+	w.Set(sid, "a", 1)
+	w.Set(sid, "b", 2)
+	if w.store.Get(sid, "a").(int) != 1 || w.Get(sid, "b").(int) != 2 {
+		t.Fatal("reaching CompactEvery should compact")
+	}
+
+	test(t, NewSession(w, 1*time.Second, 50))
+}
+
+// tornLog writes half of the next record then fails, as a full disk would
+type tornLog struct {
+	walLog
+	torn bool
+}
+
+func (l *tornLog) Write(b []byte) (int, error) {
+	if l.torn {
+		l.torn = false
+		n, _ := l.walLog.Write(b[:len(b)/2])
+		return n, io.ErrShortWrite
+	}
+	return l.walLog.Write(b)
+}
+
+func Test_WALTornRecord(t *testing.T) {
+	defer os.RemoveAll("waltorn")
+	defer os.Remove("waltorn.log")
+	w, err := NewWALStore(nil, "waltorn", "waltorn.log", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Durable = true
+	sid := w.GenerateID()
+	w.Set(sid, "before", 1)
+	torn := &tornLog{walLog: w.log, torn: true}
+	w.log = torn
+	if err := w.Set(sid, "failed", 2); err != io.ErrShortWrite {
+		t.Fatalf("the failed write should be returned, got %v", err)
+	}
+	if err := w.Set(sid, "after", 3); err != nil {
+		t.Fatal(err)
+	}
+	if w.Get(sid, "failed") != nil {
+		t.Fatal("a failed append should not be applied")
+	}
+	// a crash, the log is not compacted
+	torn.walLog.Close()
+
+	if w, err = NewWALStore(nil, "waltorn", "waltorn.log", "/"); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.store.Get(sid, "before") != 1 || w.store.Get(sid, "after") != 3 || w.store.Get(sid, "failed") != nil {
+		t.Fatal("the records around a failed append should be replayed")
+	}
+
+	w.Durable = true
+	w.Set(sid, "durable", 4)
+	w.Delete(sid, "before")
+	if err := w.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if w.store.Get(sid, "durable") != 4 || w.store.Get(sid, "before") != nil {
+		t.Fatal("a durable compaction should write the logged operations")
+	}
+}
@@ -0,0 +1,82 @@
+package session
+
+import "sync"
+
+// Op is the kind of change an Event reports
+type Op int
+
+const (
+	OpSet Op = iota
+	OpDelete
+	OpExpire
+	// OpGenerate is only recorded by the event store, watchers never see it
+	OpGenerate
+)
+
+var opNames = [...]string{"set", "delete", "expire", "generate"}
+
+func (o Op) String() string {
+	if o < 0 || int(o) >= len(opNames) {
+		return "unknown"
+	}
+	return opNames[o]
+}
+
+// Event reports a change to a watched session, Key is empty for OpExpire
+type Event struct {
+	ID  string
+	Key string
+	Op  Op
+}
+
+// watchBuffer is the number of events a watcher may lag behind before
+// further events are dropped
+const watchBuffer = 16
+
+// watchers fans out session events to subscribed channels
+type watchers struct {
+	subs map[string]map[chan Event]struct{}
+	lock sync.RWMutex
+}
+
+func newWatchers() *watchers {
+	return &watchers{subs: make(map[string]map[chan Event]struct{})}
+}
+
+// watch subscribes to the events of a session, the returned func
+// unsubscribes and closes the channel
+func (w *watchers) watch(ID string) (<-chan Event, func()) {
+	ch := make(chan Event, watchBuffer)
+	w.lock.Lock()
+	if w.subs[ID] == nil {
+		w.subs[ID] = make(map[chan Event]struct{})
+	}
+	w.subs[ID][ch] = struct{}{}
+	w.lock.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.lock.Lock()
+			defer w.lock.Unlock()
+			delete(w.subs[ID], ch)
+			if len(w.subs[ID]) == 0 {
+				delete(w.subs, ID)
+			}
+			close(ch)
+		})
+	}
+}
+
+// notify sends the event to every watcher of the session without blocking,
+// a watcher whose buffer is full misses the event
+func (w *watchers) notify(ID string, key string, op Op) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	for ch := range w.subs[ID] {
+		select {
+		case ch <- Event{ID, key, op}:
+		default:
+		}
+	}
+}
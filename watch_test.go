@@ -0,0 +1,44 @@
+package session
+
+import "testing"
+
+func Test_Watch(t *testing.T) {
+	m := NewMemoryStore(nil)
+	sid := m.GenerateID()
+	events, stop := m.Watch(sid)
+
+	m.Set(sid, "key", "value")
+	m.Delete(sid, "key")
+	m.Delete(sid, "absent")
+	m.Expire(sid)
+
+	for _, want := range []Event{{sid, "key", OpSet}, {sid, "key", OpDelete}, {sid, "", OpExpire}} {
+		if got := <-events; got != want {
+			t.Fatalf("event should be %v but get %v", want, got)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %v", e)
+	default:
+	}
+
+	nsid := m.GenerateID()
+	for i := 0; i < 2*watchBuffer; i++ {
+		m.Set(nsid, "key", i)
+	}
+	stop()
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatal("the channel should be closed after unsubscribing")
+	}
+
+	other, stopOther := m.Watch(nsid)
+	defer stopOther()
+	for i := 0; i < 2*watchBuffer; i++ {
+		m.Set(nsid, "key", i)
+	}
+	if len(other) != watchBuffer {
+		t.Fatalf("a full watcher should drop events but holds %d", len(other))
+	}
+}
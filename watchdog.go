@@ -0,0 +1,96 @@
+// watchdog logging slow store operations
+package session
+
+import (
+	"log"
+	"time"
+)
+
+var _ SessionStore = new(watchdog)
+
+// watchdog arms a timer around each operation of inner and logs the
+// operations outliving it
+type watchdog struct {
+	inner     SessionStore
+	threshold time.Duration
+	logf      func(format string, args ...interface{})
+}
+
+// NewWatchdogStore wraps inner so an operation still running after
+// threshold is logged with logf, log.Printf if nil, along with the session
+// and key, and logged again with the time it took once it completes. The
+// outcome of the operation is unchanged, a stalled backend, an NFS mount
+// for instance, shows in the logs instead. A fast operation only arms and
+// stops a timer. Sessions are identified by a hash of their ID, as in
+// traces, never the ID itself
+func NewWatchdogStore(inner SessionStore, threshold time.Duration, logf func(format string, args ...interface{})) *watchdog {
+	if logf == nil {
+		logf = log.Printf
+	}
+	return &watchdog{inner, threshold, logf}
+}
+
+// watch arms the timer of an operation and returns the func stopping it
+func (w *watchdog) watch(op, ID, key string) func() {
+	start := time.Now()
+	target := op
+	if ID != "" {
+		target += " of session " + hashID(ID)
+	}
+	if key != "" {
+		target += " key " + key
+	}
+	timer := time.AfterFunc(w.threshold, func() {
+		w.logf("session: %s still running after %v", target, time.Since(start))
+	})
+	return func() {
+		if !timer.Stop() {
+			w.logf("session: %s completed after %v", target, time.Since(start))
+		}
+	}
+}
+
+func (w *watchdog) GenerateID() string {
+	defer w.watch("generate", "", "")()
+	return w.inner.GenerateID()
+}
+
+func (w *watchdog) Set(ID string, key string, val interface{}) error {
+	defer w.watch("set", ID, key)()
+	return w.inner.Set(ID, key, val)
+}
+
+func (w *watchdog) Get(ID string, key string) interface{} {
+	defer w.watch("get", ID, key)()
+	return w.inner.Get(ID, key)
+}
+
+func (w *watchdog) GetWithError(ID string, key string) (interface{}, error) {
+	defer w.watch("get", ID, key)()
+	return getWithError(w.inner, ID, key)
+}
+
+func (w *watchdog) Delete(ID string, key string) error {
+	defer w.watch("delete", ID, key)()
+	return w.inner.Delete(ID, key)
+}
+
+func (w *watchdog) Update(ID string) error {
+	defer w.watch("update", ID, "")()
+	return w.inner.Update(ID)
+}
+
+func (w *watchdog) Expire(ID string) error {
+	defer w.watch("expire", ID, "")()
+	return w.inner.Expire(ID)
+}
+
+func (w *watchdog) Flush() error {
+	defer w.watch("flush", "", "")()
+	return w.inner.Flush()
+}
+
+func (w *watchdog) GC(lifeTime time.Duration, timeNow time.Time) {
+	defer w.watch("gc", "", "")()
+	w.inner.GC(lifeTime, timeNow)
+}
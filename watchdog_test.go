@@ -0,0 +1,55 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalling sleeps in every Set
+type stalling struct {
+	*memory
+	stall time.Duration
+}
+
+func (s *stalling) Set(ID string, key string, val interface{}) error {
+	time.Sleep(s.stall)
+	return s.memory.Set(ID, key, val)
+}
+
+func Test_WatchdogStore(t *testing.T) {
+	var lock sync.Mutex
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	inner := &stalling{memory: NewMemoryStore(nil)}
+	w := NewWatchdogStore(inner, 20*time.Millisecond, logf)
+	sid := w.GenerateID()
+	if err := w.Set(sid, "key", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Get(sid, "key") != "val" || len(logs) != 0 {
+		t.Fatalf("fast operations should not be logged, got %q", logs)
+	}
+
+	inner.stall = 50 * time.Millisecond
+	if err := w.Set(sid, "key", "slow"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Get(sid, "key") != "slow" {
+		t.Fatal("a slow operation should still complete")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(logs) != 2 || !strings.Contains(logs[0], "still running") || !strings.Contains(logs[1], "completed") {
+		t.Fatalf("expected the slow Set to be logged twice, got %q", logs)
+	}
+	if !strings.Contains(logs[0], "set of session "+hashID(sid)+" key key") || strings.Contains(logs[0], sid) {
+		t.Fatalf("the log should name the operation, the hashed session and the key, got %q", logs[0])
+	}
+}
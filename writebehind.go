@@ -0,0 +1,241 @@
+// write-behind buffer
+package session
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var _ SessionStore = new(writeBehind)
+
+// writeBehind keeps Sets and Deletes in memory and writes them to the inner
+// store in batches
+type writeBehind struct {
+	inner SessionStore
+	size  int
+
+	// pending holds the buffered operations by session and key, flushing
+	// those being written by Sync, which are still served to readers
+	pending  map[string]map[string]walOp
+	flushing map[string]map[string]walOp
+	ops      int
+	lock     sync.Mutex
+
+	// syncing serializes Sync, so operations reach inner in order
+	syncing sync.Mutex
+
+	done   chan struct{}
+	closed sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewWriteBehindStore buffers the Sets and Deletes made through it and
+// writes them to inner every interval, once size operations are buffered,
+// on Sync and on Close. Reads see the buffered operations first.
+//
+// It trades durability for throughput: the buffered operations are lost if
+// the process dies before they are written, and a write inner refuses, to
+// a session that no longer exists for instance, is only logged. Successive
+// Sets of a key within an interval are written once. Expire, Flush and GC
+// wait for a Sync in progress. An interval <= 0 writes only once size
+// operations are buffered, on Sync and on Close
+func NewWriteBehindStore(inner SessionStore, size int, interval time.Duration) *writeBehind {
+	w := &writeBehind{
+		inner:   inner,
+		size:    size,
+		pending: make(map[string]map[string]walOp),
+		done:    make(chan struct{}),
+	}
+	if interval > 0 {
+		w.wg.Add(1)
+		go w.flusher(interval)
+	}
+	return w
+}
+
+func (w *writeBehind) flusher(interval time.Duration) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Println(err)
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Sync writes the buffered operations to inner, returning the first error
+func (w *writeBehind) Sync() (err error) {
+	w.syncing.Lock()
+	defer w.syncing.Unlock()
+	w.lock.Lock()
+	batch := w.pending
+	w.flushing, w.pending, w.ops = batch, make(map[string]map[string]walOp), 0
+	w.lock.Unlock()
+	for ID, keys := range batch {
+		for key, op := range keys {
+			var werr error
+			if op.deleted {
+				werr = w.inner.Delete(ID, key)
+			} else {
+				werr = w.inner.Set(ID, key, op.val)
+			}
+			if werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	w.lock.Lock()
+	w.flushing = nil
+	w.lock.Unlock()
+	return
+}
+
+// Close stops the flusher and writes the buffered operations
+func (w *writeBehind) Close() (err error) {
+	w.closed.Do(func() {
+		close(w.done)
+		w.wg.Wait()
+		err = w.Sync()
+	})
+	return
+}
+
+// buffer adds an operation, syncing once the buffer is full
+func (w *writeBehind) buffer(ID, key string, op walOp) error {
+	w.lock.Lock()
+	keys, ok := w.pending[ID]
+	if !ok {
+		keys = make(map[string]walOp)
+		w.pending[ID] = keys
+	}
+	keys[key] = op
+	w.ops++
+	full := w.size > 0 && w.ops >= w.size
+	w.lock.Unlock()
+	if full {
+		return w.Sync()
+	}
+	return nil
+}
+
+// buffered returns the buffered operation on the key, if any
+func (w *writeBehind) buffered(ID, key string) (walOp, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if op, ok := w.pending[ID][key]; ok {
+		return op, true
+	}
+	op, ok := w.flushing[ID][key]
+	return op, ok
+}
+
+func (w *writeBehind) GenerateID() string {
+	return w.inner.GenerateID()
+}
+
+func (w *writeBehind) Set(ID string, key string, val interface{}) error {
+	return w.buffer(ID, key, walOp{val: val})
+}
+
+func (w *writeBehind) Get(ID string, key string) interface{} {
+	if op, ok := w.buffered(ID, key); ok {
+		return op.val
+	}
+	return w.inner.Get(ID, key)
+}
+
+func (w *writeBehind) GetWithError(ID string, key string) (interface{}, error) {
+	if op, ok := w.buffered(ID, key); ok {
+		if op.deleted {
+			return nil, ErrKeyNotFound
+		}
+		return op.val, nil
+	}
+	return getWithError(w.inner, ID, key)
+}
+
+// GetAll returns every key of the session, the buffered operations applied
+// over the keys of inner, which must list them with KeysWithPrefix
+func (w *writeBehind) GetAll(ID string) (map[string]interface{}, error) {
+	lister, ok := w.inner.(interface {
+		KeysWithPrefix(ID string, prefix string) ([]string, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("session: %T can not list keys", w.inner)
+	}
+	keys, err := lister.KeysWithPrefix(ID, "")
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		val, err := getWithError(w.inner, ID, key)
+		if err == ErrKeyNotFound {
+			// deleted meanwhile, by a Sync in progress for instance
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = val
+	}
+	// read after inner, so an operation a Sync moves to inner meanwhile is
+	// still applied
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, ops := range []map[string]walOp{w.flushing[ID], w.pending[ID]} {
+		for key, op := range ops {
+			if op.deleted {
+				delete(values, key)
+			} else {
+				values[key] = op.val
+			}
+		}
+	}
+	return values, nil
+}
+
+func (w *writeBehind) Delete(ID string, key string) error {
+	return w.buffer(ID, key, walOp{deleted: true})
+}
+
+func (w *writeBehind) Update(ID string) error {
+	return w.inner.Update(ID)
+}
+
+// Expire drops the buffered operations of the session
+func (w *writeBehind) Expire(ID string) error {
+	w.syncing.Lock()
+	defer w.syncing.Unlock()
+	w.lock.Lock()
+	w.ops -= len(w.pending[ID])
+	delete(w.pending, ID)
+	w.lock.Unlock()
+	return w.inner.Expire(ID)
+}
+
+// Flush drops the buffered operations
+func (w *writeBehind) Flush() error {
+	w.syncing.Lock()
+	defer w.syncing.Unlock()
+	w.lock.Lock()
+	w.pending, w.ops = make(map[string]map[string]walOp), 0
+	w.lock.Unlock()
+	return w.inner.Flush()
+}
+
+// GC syncs first so no buffered operation outlives its session
+func (w *writeBehind) GC(lifeTime time.Duration, timeNow time.Time) {
+	if err := w.Sync(); err != nil {
+		log.Println(err)
+	}
+	w.inner.GC(lifeTime, timeNow)
+}
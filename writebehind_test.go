@@ -0,0 +1,82 @@
+package session
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_WriteBehindStore(t *testing.T) {
+	defer os.RemoveAll("behind")
+	inner := NewFileStore(nil, "behind", "/")
+	w := NewWriteBehindStore(inner, 3, time.Hour)
+	sid := w.GenerateID()
+	w.Set(sid, "kept", "val")
+	inner.Set(sid, "deleted", "val")
+	w.Delete(sid, "deleted")
+	if inner.Get(sid, "kept") != nil || inner.Get(sid, "deleted") == nil {
+		t.Fatal("buffered operations should not reach the store before a Sync")
+	}
+	if w.Get(sid, "kept").(string) != "val" {
+		t.Fatal("a buffered Set should be read back")
+	}
+	if _, err := w.GetWithError(sid, "deleted"); err != ErrKeyNotFound {
+		t.Fatalf("error should be ErrKeyNotFound but get %v", err)
+	}
+	inner.Set(sid, "stored", "val")
+	if all, err := w.GetAll(sid); err != nil || len(all) != 2 || all["kept"] != "val" || all["stored"] != "val" {
+		t.Fatalf("GetAll should merge the buffered operations, got %v %v", all, err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if inner.Get(sid, "kept").(string) != "val" || inner.Get(sid, "deleted") != nil {
+		t.Fatal("Sync should write the buffered operations")
+	}
+
+	w.Set(sid, "a", 1)
+	w.Set(sid, "b", 2)
+	w.Set(sid, "c", 3)
+	if inner.Get(sid, "c") == nil {
+		t.Fatal("a full buffer should be synced")
+	}
+	w.Set(sid, "d", 4)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if inner.Get(sid, "d").(int) != 4 {
+		t.Fatal("Close should write the buffered operations")
+	}
+
+	// no periodic flush
+	w = NewWriteBehindStore(inner, 0, 0)
+	w.Set(sid, "e", 5)
+	if inner.Get(sid, "e") != nil {
+		t.Fatal("without an interval the operations wait for a Sync")
+	}
+	w.Close()
+	if inner.Get(sid, "e").(int) != 5 {
+		t.Fatal("Close should write the buffered operations")
+	}
+}
+
+func Benchmark_FileSet(b *testing.B) {
+	defer os.RemoveAll("behind")
+	f := NewFileStore(nil, "behind", "/")
+	sid := f.GenerateID()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Set(sid, "key", i)
+	}
+}
+
+func Benchmark_FileSetWriteBehind(b *testing.B) {
+	defer os.RemoveAll("behind")
+	w := NewWriteBehindStore(NewFileStore(nil, "behind", "/"), 1000, 100*time.Millisecond)
+	sid := w.GenerateID()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Set(sid, "key", i)
+	}
+	w.Close()
+}